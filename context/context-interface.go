@@ -42,8 +42,10 @@ type Context interface {
 	/*---------------------------- Error handling -----------------------------*/
 
 	// Side effect: must set the http status code corresponding to the error type
-	// and send the error's message as plain text. Intended for use in API
-	// handlers.
+	// and send the error's message as plain text. A ValidationError must be sent
+	// as json like {"errors": {"email": "required"}} with the code 422, and an
+	// *HTTPError as json like {"error": "not found", "code": "not_found"} with
+	// its status. Intended for use in API handlers.
 	SendError(error)
 
 	// When called with a non-nil error, this must render the error page and set
@@ -70,7 +72,8 @@ type Context interface {
 
 	// Side effect: must write the given value as json and set the Content-Type
 	// header to "application/json; charset=UTF-8". If encoding fails, must send
-	// error 500 instead.
+	// error 500 instead. A ValidationError or an *HTTPError must be sent like in
+	// SendError.
 	SendAsJson(interface{})
 
 	// Side effect: must decode the body of the current request as json and write
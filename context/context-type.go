@@ -5,6 +5,7 @@ package context
 import (
 	// Standard
 	"encoding/json"
+	"errors"
 	"net/http"
 	"reflect"
 )
@@ -61,9 +62,23 @@ func (this *ContextInstance) Render(path string) {
 
 /****************************** Error Handling *******************************/
 
-// Sets the status code corresponding to the error and sends its message.
+// Sets the status code corresponding to the error and sends its message. A
+// ValidationError is sent as json with its field messages, and an *HTTPError
+// as json with its message, code and details.
 func (this *ContextInstance) SendError(err error) {
 	log(this, err)
+
+	var verr ValidationError
+	if errors.As(err, &verr) {
+		sendJson(this, ErrorCode(err), verr)
+		return
+	}
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		sendJson(this, ErrorCode(err), herr)
+		return
+	}
+
 	this.Code(ErrorCode(err))
 	this.Send(err.Error())
 }
@@ -83,19 +98,15 @@ func (this *ContextInstance) Must(err error) {
 	Panic()
 }
 
-// Version of Must that sends the error text instead of rendering an error page.
-// Intended for JSON API.
+// Version of Must that sends the error as per SendError instead of rendering an
+// error page. Intended for JSON API.
 func (this *ContextInstance) Ought(err error) {
 	// No error -> no-op.
 	if err == nil {
 		return
 	}
-	log(this, err)
 	// Error -> set status and write error message, then panic.
-	code := ErrorCode(err)
-	bytes := []byte(err.Error())
-	this.Code(code).RW().Write(bytes)
-
+	this.SendError(err)
 	Panic()
 }
 
@@ -113,8 +124,20 @@ func (this *ContextInstance) RedirectPermanent(path string) {
 
 // Sends the given value as json. If the value is nil, sends a placeholder value
 // obtained by checking the value's type with reflection. If decoding fails,
-// ends the request with 500 and an empty response.
+// ends the request with 500 and an empty response. A ValidationError or an
+// *HTTPError is sent with the status code from ErrorCode.
 func (this *ContextInstance) SendAsJson(value interface{}) {
+	switch err := value.(type) {
+	case ValidationError:
+		sendJson(this, ErrorCode(err), err)
+		return
+	case *HTTPError:
+		if err != nil {
+			sendJson(this, ErrorCode(err), err)
+			return
+		}
+	}
+
 	// Try to encode and fail with 500 if can't.
 	bytes, err := json.Marshal(value)
 	if err != nil {
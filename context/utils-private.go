@@ -4,6 +4,7 @@ package context
 
 import (
 	// Standard
+	"encoding/json"
 	"reflect"
 	// Third party
 	"github.com/Mitranim/gotools/utils"
@@ -59,6 +60,19 @@ func refValue(value interface{}) reflect.Value {
 	return val
 }
 
+// Sends the given value as json with the given status code. If encoding fails,
+// ends the request with 500 and an empty response.
+func sendJson(ct *ContextInstance, code int, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		log(ct, err)
+		ct.Code(500).End()
+		return
+	}
+	ct.rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ct.Code(code).RW().Write(bytes)
+}
+
 // Logs the given error if it maps to code 500 and if the logging function is
 // defined.
 func log(ct *ContextInstance, err error) {
@@ -61,3 +61,11 @@ var Log = utils.Log
 
 // Converts an error to an http status code.
 var ErrorCode = utils.ErrorCode
+
+// Error with an http status, a machine-readable code and optional details and
+// cause. Sent as json by SendError, Ought and SendAsJson.
+type HTTPError = utils.HTTPError
+
+// Maps invalid fields to error messages. Sent as json by SendError, Ought and
+// SendAsJson.
+type ValidationError = utils.ValidationError
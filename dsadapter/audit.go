@@ -0,0 +1,502 @@
+package dsadapter
+
+// Audit log: a record of who created, changed and deleted each record.
+
+import (
+	// Standard
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+/********************************* Audit Log *********************************/
+
+/**
+ * If the config has an Audit sink, every write of a record through Save,
+ * SaveMulti, Patch, PatchJson, Delete, DeleteMulti, Restore and Purge produces
+ * an AuditEntry, which is passed to the sink. That includes the writes done by
+ * the REST handler, Populate and Import. Migrations write records directly and
+ * aren't audited.
+ *
+ *   dsa := dsadapter.Setup(dsadapter.Config{
+ *     Store:     store,
+ *     Audit:     dsadapter.NewAuditKind(),
+ *     AuditUser: func(req *http.Request) string { return currentUserId(req) },
+ *   })
+ *
+ * To diff the records, the stored copies are read before the write. The read,
+ * the write and the sink run in one transaction if the store supports them, so
+ * with the kind sink, a record and its entries are written together. Big
+ * batches are split into several transactions, see RunInTransaction. Other
+ * sinks get the entries before the transaction commits, and may see entries of
+ * transactions that are rolled back or retried. A failing sink fails the
+ * operation.
+ */
+type AuditEntry struct {
+	// Random id of the entry, a UUIDv7.
+	Id string
+	// Kind and id of the record.
+	Kind     string
+	RecordId string
+	// CodeCreate, CodeUpdate or CodeDelete. A soft deletion is CodeDelete, and
+	// Restore is CodeUpdate.
+	Op int
+	// Who made the change, per the config's AuditUser. Empty if there's no
+	// AuditUser.
+	User string
+	At   time.Time
+	// The stored properties that changed. On create, the non-zero properties of
+	// the new record; on a hard delete, those of the deleted one. Fields tagged
+	// `dsa:"hidden"` or `dsa:"writeonly"` are listed with nil values, so secrets
+	// don't end up in the log.
+	Changes []FieldChange
+}
+
+// AuditSink receives audit entries. Write is called once per operation, with
+// the state that ran it: inside a transaction, that's the transaction's state.
+type AuditSink interface {
+	Write(*http.Request, State, []AuditEntry) error
+}
+
+// AuditReader is an optional interface for sinks that can read entries back.
+// History returns the entries of the record with the given kind and id, oldest
+// first.
+type AuditReader interface {
+	History(*http.Request, State, string, string) ([]AuditEntry, error)
+}
+
+// Returns the audit entries of the record, oldest first. The record needs only
+// its id. Checks CodeRead like Read. Returns a 500 error if the config's Audit
+// sink isn't an AuditReader.
+func (this *stateInstance) History(req *http.Request, record Record) ([]AuditEntry, error) {
+	reader, ok := this.config.Audit.(AuditReader)
+	if !ok {
+		return nil, errNoHistory
+	}
+	if !record.Can(req, CodeRead) {
+		return nil, err403
+	}
+	return reader.History(req, this, record.Kind(), record.GetId())
+}
+
+/*********************************** Sinks ***********************************/
+
+/**
+ * AuditKind stores audit entries in the "DsaAudit" kind of the state's own
+ * store, in the same transaction as the records they describe. It's an
+ * AuditReader. With a SchemaStore, SyncSchema creates its schema.
+ *
+ * Field values are stored as json, so History returns them as decoded json:
+ * numbers as float64, times as strings and so on.
+ */
+type AuditKind struct{}
+
+// Returns a new AuditKind.
+func NewAuditKind() *AuditKind {
+	return &AuditKind{}
+}
+
+// Writes the entries to the state's store.
+func (this *AuditKind) Write(req *http.Request, state State, entries []AuditEntry) error {
+	records := make([]Record, len(entries))
+	for i, entry := range entries {
+		changes, err := json.Marshal(entry.Changes)
+		if err != nil {
+			return err
+		}
+		records[i] = &auditRecord{
+			Id:         entry.Id,
+			RecordKind: entry.Kind,
+			RecordId:   entry.RecordId,
+			Op:         entry.Op,
+			User:       entry.User,
+			At:         entry.At,
+			Changes:    changes,
+		}
+	}
+
+	store := state.Store()
+	if batchStore, ok := store.(BatchStore); ok && len(records) > 1 {
+		return batchStore.PutMulti(req, records)
+	}
+	for _, record := range records {
+		if err := store.Put(req, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the entries of the record from the state's store.
+func (this *AuditKind) History(req *http.Request, state State, kind, id string) ([]AuditEntry, error) {
+	records := []*auditRecord{}
+	query := Query{}.Filter("RecordKind", OpEq, kind).Filter("RecordId", OpEq, id)
+	if _, err := state.Store().GetAll(req, auditMetaKind, &records, query); err != nil {
+		return nil, err
+	}
+
+	// Sort in memory, which needs no composite index.
+	sort.SliceStable(records, func(i, j int) bool {
+		if !records[i].At.Equal(records[j].At) {
+			return records[i].At.Before(records[j].At)
+		}
+		return records[i].Id < records[j].Id
+	})
+
+	entries := make([]AuditEntry, len(records))
+	for i, record := range records {
+		entries[i] = AuditEntry{
+			Id:       record.Id,
+			Kind:     record.RecordKind,
+			RecordId: record.RecordId,
+			Op:       record.Op,
+			User:     record.User,
+			At:       record.At,
+		}
+		if err := json.Unmarshal(record.Changes, &entries[i].Changes); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// AuditLog writes audit entries to a writer as JSON Lines, one entry per line.
+// Safe for concurrent use.
+type AuditLog struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// Returns a new AuditLog that writes to the given writer, like os.Stderr or a
+// file.
+func NewAuditLog(writer io.Writer) *AuditLog {
+	return &AuditLog{writer: writer}
+}
+
+// Writes the entries, each on its own line.
+func (this *AuditLog) Write(req *http.Request, state State, entries []AuditEntry) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	encoder := json.NewEncoder(this.writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditChannel sends audit entries to a channel, one by one. Sends block until
+// the channel has room, so use a buffered channel and keep draining it. A send
+// that's still blocked when the request is cancelled fails the operation.
+type AuditChannel chan<- AuditEntry
+
+// Returns an AuditChannel that sends to the given channel.
+func NewAuditChannel(channel chan<- AuditEntry) AuditChannel {
+	return AuditChannel(channel)
+}
+
+// Sends the entries.
+func (this AuditChannel) Write(req *http.Request, state State, entries []AuditEntry) error {
+	done := requestContext(req).Done()
+	for _, entry := range entries {
+		select {
+		case this <- entry:
+		case <-done:
+			return requestContext(req).Err()
+		}
+	}
+	return nil
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Kind of the entities that store audit entries.
+const auditMetaKind = "DsaAudit"
+
+// A stored audit entry. The fields match those of AuditEntry, except for the
+// kind, which would clash with the Kind method, and the changes, which are
+// stored as json because their values may have any type.
+type auditRecord struct {
+	Id         string
+	RecordKind string
+	RecordId   string
+	Op         int
+	User       string
+	At         time.Time
+	Changes    []byte
+}
+
+// Record methods. Audit records are managed by the state.
+func (this *auditRecord) Validate(*http.Request) map[string]string { return nil }
+func (this *auditRecord) Compute()                                 {}
+func (this *auditRecord) Can(*http.Request, int) bool              { return true }
+func (this *auditRecord) Save(*http.Request) error                 { return errAudit }
+func (this *auditRecord) Read(*http.Request) error                 { return errAudit }
+func (this *auditRecord) Delete(*http.Request) error               { return errAudit }
+func (this *auditRecord) GetId() string                            { return this.Id }
+func (this *auditRecord) SetId(id string)                          { this.Id = id }
+func (this *auditRecord) Kind() string                             { return auditMetaKind }
+
+/********************************* Utilities *********************************/
+
+// Returns true if the config has an audit sink.
+func (this *stateInstance) audits() bool {
+	return this.config.Audit != nil
+}
+
+// Saves the records with putGenerated, see `ids.go`, setting the timestamps of
+// Timestamped records, see `timestamps.go`, recording an audit entry for each
+// record that's written if the config has an audit sink, and publishing change
+// events, see `events.go`. Records whose values are out of their scope get 403,
+// see `scope.go`. Returns an error only if the whole batch failed.
+//
+// If a feature needs the stored copies, see tracks, they're read first, in the
+// same transaction as the write if the store supports them, and big batches are
+// split into several transactions, see `transaction.go`. Otherwise the records
+// are written right away, and the stored copies are read beforehand only if
+// subscribers may need to tell creates from updates.
+func (this *stateInstance) putTracked(req *http.Request, records []Record, errs MultiError, fresh, generated map[int]bool) error {
+	at := now()
+
+	// Refuse to write values that the request couldn't see.
+	checkWriteScopes(req, records, errs)
+
+	// Without a feature that needs the stored copies, write right away.
+	if !this.tracks(records, fresh) {
+		befores := make([]Record, len(records))
+		if mayBeStored(records, fresh) && this.observed(records) {
+			var err error
+			if befores, err = this.readStored(req, records, errs, fresh); err != nil {
+				return err
+			}
+		}
+		for i, record := range records {
+			if errs[i] == nil {
+				touch(record, nil, at)
+			}
+		}
+		if err := this.putGenerated(req, records, errs, fresh, generated); err != nil {
+			return err
+		}
+		return this.publish(req, changeEvents(CodeUpdate, records, befores, errs, false))
+	}
+
+	// Otherwise read and write in chunks that fit in a transaction each.
+	return this.inChunks(records, func(start, end int) error {
+		return this.putTrackedChunk(req, records[start:end], errs[start:end], indexesIn(fresh, start, end), indexesIn(generated, start, end), at)
+	})
+}
+
+// Saves the records for putTracked, reading their stored copies in the same
+// transaction if possible.
+func (this *stateInstance) putTrackedChunk(req *http.Request, records []Record, errs MultiError, fresh, generated map[int]bool, at time.Time) error {
+	// A transaction may run more than once, so each attempt starts over from
+	// the original errors and versions.
+	initial := append(MultiError{}, errs...)
+	versions := map[int]int64{}
+	for i, record := range records {
+		if versioned, ok := record.(Versioned); ok {
+			versions[i] = versioned.GetVersion()
+		}
+	}
+
+	return this.atomically(req, func(state *stateInstance) error {
+		copy(errs, initial)
+		for i, version := range versions {
+			records[i].(Versioned).SetVersion(version)
+		}
+
+		// Read the stored copies and check them. Only Restore and Import may
+		// write over soft-deleted records.
+		befores, err := state.readStored(req, records, errs, fresh)
+		if err != nil {
+			return err
+		}
+		checkScopes(req, befores, errs)
+		for i, record := range records {
+			if errs[i] != nil {
+				continue
+			}
+			if isDeleted(befores[i]) && !state.writesDeleted {
+				errs[i] = err404
+				continue
+			}
+			touch(record, befores[i], at)
+		}
+
+		if err := state.putGenerated(req, records, errs, fresh, generated); err != nil {
+			return err
+		}
+		if state.audits() {
+			if err := state.audit(req, befores, records, errs); err != nil {
+				return err
+			}
+		}
+		return state.publish(req, changeEvents(CodeUpdate, records, befores, errs, false))
+	})
+}
+
+// Returns true if saving the records needs their stored copies, read in the
+// same transaction as the write: to keep the creation times of Timestamped
+// records, check the scopes of Scoper records, refuse to write over
+// soft-deleted records, diff them for the audit log, or tell creates from
+// updates in staged events. Fresh records and records without ids have no
+// stored copies, but the audit log and staged events still go in the same
+// transaction as them.
+func (this *stateInstance) tracks(records []Record, fresh map[int]bool) bool {
+	if this.audits() || this.stages() {
+		return true
+	}
+	for i, record := range records {
+		if fresh[i] || record.GetId() == "" {
+			continue
+		}
+		_, timestamped := record.(Timestamped)
+		_, scoped := record.(Scoper)
+		_, deletable := record.(SoftDeletable)
+		if timestamped || scoped || deletable {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the records may have a stored copy: it has an id and
+// isn't fresh.
+func mayBeStored(records []Record, fresh map[int]bool) bool {
+	for i, record := range records {
+		if !fresh[i] && record.GetId() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the stored copies of the records that don't have an error in errs yet,
+// except for the fresh ones, which can't exist yet. The result has nil for
+// records that weren't read or don't exist. Writes other failures into errs.
+func (this *stateInstance) readStored(req *http.Request, records []Record, errs MultiError, fresh map[int]bool) ([]Record, error) {
+	stored := make([]Record, len(records))
+	results := append(MultiError{}, errs...)
+	for i, record := range records {
+		if results[i] == nil && (fresh[i] || record.GetId() == "") {
+			results[i] = err404
+		}
+		stored[i] = newRecordLike(record)
+	}
+
+	if err := this.multi(req, stored, results, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return nil, err
+	}
+
+	for i := range records {
+		if results[i] == nil {
+			continue
+		}
+		if errs[i] == nil && ErrorCode(results[i]) != 404 {
+			errs[i] = results[i]
+		}
+		stored[i] = nil
+	}
+	return stored, nil
+}
+
+// Passes an audit entry for each record that doesn't have an error in errs to
+// the config's sink. Takes the stored copies from before and after the write;
+// a nil one means the record didn't exist then. The operation follows from
+// them: a record that didn't exist was created, and one that is missing or
+// marked as deleted after the write was deleted.
+func (this *stateInstance) audit(req *http.Request, befores, afters []Record, errs MultiError) error {
+	var user string
+	if this.config.AuditUser != nil {
+		user = this.config.AuditUser(req)
+	}
+	at := now()
+
+	entries := []AuditEntry{}
+	for i := range errs {
+		before, after := befores[i], afters[i]
+		if errs[i] != nil || (before == nil && after == nil) {
+			continue
+		}
+
+		entry := AuditEntry{Id: UUIDv7(), User: user, At: at, Op: CodeUpdate}
+		if before == nil {
+			entry.Op = CodeCreate
+		} else if after == nil || (isDeleted(after) && !isDeleted(before)) {
+			entry.Op = CodeDelete
+		}
+		if after != nil {
+			entry.Kind, entry.RecordId = after.Kind(), after.GetId()
+		} else {
+			entry.Kind, entry.RecordId = before.Kind(), before.GetId()
+		}
+		entry.Changes = auditChanges(before, after)
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+	return this.config.Audit.Write(req, this, entries)
+}
+
+// Returns the stored properties that differ between two copies of a record,
+// either of which may be nil. The values are copied, so the entry doesn't
+// share memory with the records. Values of secret fields are left out.
+func auditChanges(before, after Record) []FieldChange {
+	var one, other reflect.Value
+	if before != nil {
+		one = refValue(before)
+	}
+	if after != nil {
+		other = refValue(after)
+	}
+	if !one.IsValid() {
+		one = reflect.New(other.Type()).Elem()
+	}
+	if !other.IsValid() {
+		other = reflect.New(one.Type()).Elem()
+	}
+
+	secret := secretProperties(one.Type())
+	changes := []FieldChange{}
+	for _, prop := range propertiesOf(one.Type()) {
+		previous, current := prop.value(one), prop.value(other)
+		if equalValues(previous, current) {
+			continue
+		}
+		change := FieldChange{Field: prop.name}
+		if !secret[prop.name] {
+			change.Old, change.New = deepCopy(previous).Interface(), deepCopy(current).Interface()
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Returns the names of the stored properties of the struct type whose fields
+// are tagged `dsa:"hidden"` or `dsa:"writeonly"`.
+func secretProperties(typ reflect.Type) map[string]bool {
+	indexes := map[string]bool{}
+	for _, field := range accessFieldsOf(typ) {
+		if field.tag == "hidden" || field.tag == "writeonly" {
+			indexes[fmt.Sprint(field.index)] = true
+		}
+	}
+
+	names := map[string]bool{}
+	for _, prop := range propertiesOf(typ) {
+		if indexes[fmt.Sprint(prop.index)] {
+			names[prop.name] = true
+		}
+	}
+	return names
+}
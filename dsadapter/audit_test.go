@@ -0,0 +1,116 @@
+package dsadapter
+
+import (
+	// Standard
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Returns the operations of the audit entries.
+func auditOps(entries []AuditEntry) []int {
+	ops := []int{}
+	for _, entry := range entries {
+		ops = append(ops, entry.Op)
+	}
+	return ops
+}
+
+// Returns the changes of the entry by field.
+func auditChangesByField(entry AuditEntry) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for _, change := range entry.Changes {
+		changes[change.Field] = change
+	}
+	return changes
+}
+
+func TestAudit(t *testing.T) {
+	config := Config{
+		Audit:     NewAuditKind(),
+		AuditUser: func(req *http.Request) string { return req.Header.Get("User") },
+	}
+	forEachStore(t, config, func(t *testing.T, state State, req *http.Request) {
+		ann := testUserRequest("GET", "/", "ann")
+		mustSave(t, state, ann, &testMember{Id: "one", Email: "one@example.com", PasswordHash: "hash"})
+		mustSave(t, state, ann, &testMember{Id: "one", Email: "uno@example.com", PasswordHash: "hash"})
+		expectCode(t, state.Delete(ann, &testMember{Id: "one"}), 0)
+
+		entries, err := state.History(req, &testMember{Id: "one"})
+		expectCode(t, err, 0)
+		if !equalInts(auditOps(entries), []int{CodeCreate, CodeUpdate, CodeDelete}) {
+			t.Fatalf("expected a create, an update and a delete, got %v", auditOps(entries))
+		}
+		for _, entry := range entries {
+			if entry.User != "ann" || entry.Kind != "Member" || entry.RecordId != "one" {
+				t.Fatalf("expected entries of ann for the member, got %#v", entry)
+			}
+		}
+
+		// Creates list the set fields, with secrets left out; updates list the
+		// changed fields.
+		created := auditChangesByField(entries[0])
+		if created["Email"].New != "one@example.com" || created["PasswordHash"].New != nil {
+			t.Fatalf("expected the email and a hidden hash, got %#v", entries[0].Changes)
+		}
+		if _, ok := created["PasswordHash"]; !ok {
+			t.Fatalf("expected the hash to be listed, got %#v", entries[0].Changes)
+		}
+		updated := auditChangesByField(entries[1])
+		if len(updated) != 1 || updated["Email"].Old != "one@example.com" || updated["Email"].New != "uno@example.com" {
+			t.Fatalf("expected only the email to change, got %#v", entries[1].Changes)
+		}
+
+		// Soft deletions are deletes and restores are updates.
+		note := &testNote{Text: "one"}
+		mustSave(t, state, req, note)
+		expectCode(t, state.Delete(req, &testNote{Id: note.Id}), 0)
+		expectCode(t, state.Restore(req, &testNote{Id: note.Id}), 0)
+		entries, err = state.History(req, &testNote{Id: note.Id})
+		expectCode(t, err, 0)
+		if !equalInts(auditOps(entries), []int{CodeCreate, CodeDelete, CodeUpdate}) {
+			t.Fatalf("expected a create, a delete and an update, got %v", auditOps(entries))
+		}
+
+		// Entries are rolled back with their writes.
+		failure := errors.New("failure")
+		err = state.RunInTransaction(req, func(tx State) error {
+			mustSave(t, tx, req, &testEngine{Id: "two", Name: "two"})
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("expected the function's error, got %v", err)
+		}
+		entries, err = state.History(req, &testEngine{Id: "two"})
+		expectCode(t, err, 0)
+		if len(entries) != 0 {
+			t.Fatalf("expected no entries, got %#v", entries)
+		}
+	})
+}
+
+func TestAuditSinks(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	channel := make(chan AuditEntry, 10)
+
+	for name, sink := range map[string]AuditSink{"log": NewAuditLog(buffer), "channel": NewAuditChannel(channel)} {
+		t.Run(name, func(t *testing.T) {
+			state := Setup(Config{Store: NewMemoryStore(), Audit: sink})
+			req := testRequest("GET", "/")
+			mustSave(t, state, req, &testEngine{Name: "one"}, &testEngine{Name: "two"})
+
+			// Only the kind sink can read entries back.
+			_, err := state.History(req, &testEngine{Id: "one"})
+			expectCode(t, err, 500)
+		})
+	}
+
+	if lines := strings.Count(buffer.String(), "\n"); lines != 2 {
+		t.Fatalf("expected two lines, got %d: %s", lines, buffer)
+	}
+	if len(channel) != 2 {
+		t.Fatalf("expected two entries, got %d", len(channel))
+	}
+}
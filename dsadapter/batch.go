@@ -0,0 +1,339 @@
+package dsadapter
+
+// Batch operations on collections of records.
+
+import (
+	// Standard
+	"net/http"
+	"strconv"
+)
+
+/******************************** MultiError *********************************/
+
+// MultiError is returned by the batch operations when some records fail. It
+// has one entry per record, in the order of the collection; nil entries mean
+// the record succeeded. Like other errors in this package, its message starts
+// with a status code: the status shared by all failures, or 400 or 500 if
+// they differ.
+type MultiError []error
+
+// Error method. Lists each failure with its index.
+func (this MultiError) Error() string {
+	code, count, msg := 0, 0, ""
+	for i, err := range this {
+		if err == nil {
+			continue
+		}
+		count++
+
+		// Find the status shared by all failures.
+		if next := ErrorCode(err); code == 0 {
+			code = next
+		} else if code != next && code < 500 && next < 500 {
+			code = 400
+		} else if code != next {
+			code = 500
+		}
+
+		if msg == "" {
+			msg += ": "
+		} else {
+			msg += "; "
+		}
+		msg += "[" + strconv.Itoa(i) + "] " + err.Error()
+	}
+
+	if count == 0 {
+		return "no errors"
+	}
+	return strconv.Itoa(code) + " " + strconv.Itoa(count) + " of " + strconv.Itoa(len(this)) + " records failed" + msg
+}
+
+// Returns nil if no entry is an error, and self otherwise.
+func (this MultiError) orNil() error {
+	for _, err := range this {
+		if err != nil {
+			return this
+		}
+	}
+	return nil
+}
+
+/***************************** Batch Operations ******************************/
+
+// Reads the records in the given collection from the store by their ids, using
+// the store's batch read if it has one. Checks CodeRead, computes each record
+// and runs its AfterRead hook like Read.
+//
+// If some records fail, returns a MultiError with one entry per record: 403
+// for records that can't be read and 404 for records that can't be found or
+// are out of the request's scope. The other records are read anyway. Any
+// other error means the whole batch failed.
+func (this *stateInstance) ReadMulti(req *http.Request, collection interface{}) error {
+	return this.readMulti(req, ToRecords(collection), nil)
+}
+
+// Reads the records like ReadMulti, loading the relations at the given paths
+// before computing them. See Include.
+func (this *stateInstance) readMulti(req *http.Request, records []Record, includes []string) error {
+	errs := make(MultiError, len(records))
+
+	// Check for read permission.
+	for i, record := range records {
+		if !record.Can(req, CodeRead) {
+			errs[i] = err403
+		}
+	}
+
+	// Read from the store.
+	if err := this.multi(req, records, errs, BatchStore.GetMulti, Store.Get, notFound); err != nil {
+		return err
+	}
+
+	// Hide soft-deleted records and records out of the request's scope.
+	found := []Record{}
+	for i, record := range records {
+		if errs[i] == nil && isDeleted(record) {
+			errs[i] = err404
+		} else if errs[i] == nil {
+			errs[i] = checkScope(req, record)
+		}
+		if errs[i] == nil {
+			found = append(found, record)
+		}
+	}
+
+	// Load the relations of the records that were read, then compute them.
+	if err := this.include(req, found, includes); err != nil {
+		return err
+	}
+	for _, record := range found {
+		this.Compute(record)
+	}
+
+	// Run the AfterRead hooks.
+	this.hookMulti(req, records, errs, (*stateInstance).afterRead)
+
+	return errs.orNil()
+}
+
+// Saves the records in the given collection to the store, using the store's
+// batch write if it has one. Checks CodeCreate or CodeUpdate, runs the hooks,
+// validates each record and assigns random ids to new ones, like Save.
+//
+// If some records fail, returns a MultiError with one entry per record: 403
+// for records that can't be saved, a ValidationError for invalid records and
+// 409 for stale Versioned records. The other records are saved anyway. Any
+// other error means the whole batch failed.
+func (this *stateInstance) SaveMulti(req *http.Request, collection interface{}) error {
+	return this.saveMulti(req, ToRecords(collection), nil)
+}
+
+// Saves the records like SaveMulti. The records whose indexes are in creates
+// are new despite having ids: they're checked for CodeCreate and created with
+// their own ids, failing with ErrExists if the ids are taken.
+func (this *stateInstance) saveMulti(req *http.Request, records []Record, creates map[int]bool) error {
+	errs := make(MultiError, len(records))
+	fresh := map[int]bool{}
+	generated := map[int]bool{}
+	for i := range creates {
+		fresh[i] = true
+	}
+
+	for i, record := range records {
+		// If the record is new, check the `create` permission, otherwise check for
+		// update permission.
+		isNew := record.GetId() == "" || creates[i]
+		if isNew && !record.Can(req, CodeCreate) {
+			errs[i] = err403
+			continue
+		}
+		if !isNew && !record.Can(req, CodeUpdate) {
+			errs[i] = err403
+			continue
+		}
+
+		// Run the BeforeSave hook.
+		if err := this.beforeSave(req, record); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// Validate before saving.
+		if verr := record.Validate(req); len(verr) != 0 {
+			errs[i] = ValidationError(verr)
+			continue
+		}
+
+		// If the id is missing, set a random id.
+		if record.GetId() == "" {
+			record.SetId(this.RndId())
+			fresh[i] = record.GetId() != ""
+			generated[i] = fresh[i]
+		}
+	}
+
+	// Save to the store, setting the timestamps, checking the versions of
+	// versioned records, retrying with new ids if generated ones are taken,
+	// recording the changes in the audit log and publishing them.
+	if err := this.putTracked(req, records, errs, fresh, generated); err != nil {
+		return err
+	}
+
+	// Run the AfterSave hooks of the saved records.
+	this.hookMulti(req, records, errs, (*stateInstance).afterSave)
+
+	return errs.orNil()
+}
+
+// Deletes the records in the given collection from the store, using the
+// store's batch delete if it has one. Checks CodeDelete and runs the
+// BeforeDelete hooks like Delete, and marks SoftDeletable records as deleted.
+//
+// If some records fail, returns a MultiError with one entry per record: 403
+// for records that can't be deleted and 404 for records that can't be found.
+// The other records are deleted anyway. Any other error means the whole batch
+// failed.
+func (this *stateInstance) DeleteMulti(req *http.Request, collection interface{}) error {
+	records := ToRecords(collection)
+	errs := make(MultiError, len(records))
+
+	// Check for delete permission.
+	for i, record := range records {
+		if !record.Can(req, CodeDelete) {
+			errs[i] = err403
+		}
+	}
+
+	// Run the BeforeDelete hooks.
+	this.hookMulti(req, records, errs, (*stateInstance).beforeDelete)
+
+	// Mark soft-deletable records as deleted. A collection holds one type, so
+	// the first record tells.
+	if len(records) > 0 {
+		if _, ok := records[0].(SoftDeletable); ok {
+			if err := this.softDeleteMulti(req, records, errs); err != nil {
+				return err
+			}
+			return errs.orNil()
+		}
+	}
+
+	// Delete from the store.
+	if err := this.removeMulti(req, records, errs); err != nil {
+		return err
+	}
+
+	return errs.orNil()
+}
+
+/********************************* Utilities *********************************/
+
+// Deletes the records that don't have an error in errs yet from the store, like
+// multi with Store.Delete, converting failures to 404. Checks the scopes of the
+// stored copies, see `scope.go`, releases the claims of unique indexes, see
+// `index.go`, records the deletions in the audit log, see `audit.go`, and
+// publishes them, see `events.go`, in the same transaction if the store
+// supports them. Big batches are split into several transactions, see
+// `transaction.go`. Returns an error only if the whole batch failed.
+func (this *stateInstance) removeMulti(req *http.Request, records []Record, errs MultiError) error {
+	release := !this.enforcesUnique() && hasUnique(records)
+	if !release && !hasScope(records) && !this.audits() && !this.stages() {
+		if err := this.multi(req, records, errs, BatchStore.DeleteMulti, Store.Delete, notFound); err != nil {
+			return err
+		}
+		return this.publish(req, changeEvents(CodeDelete, records, nil, errs, true))
+	}
+
+	return this.inChunks(records, func(start, end int) error {
+		return this.removeChunk(req, records[start:end], errs[start:end], release)
+	})
+}
+
+// Deletes the records for removeMulti, in one transaction if possible.
+func (this *stateInstance) removeChunk(req *http.Request, records []Record, errs MultiError, release bool) error {
+	// A transaction may run more than once, so start over each time.
+	initial := append(MultiError{}, errs...)
+	return this.atomically(req, func(state *stateInstance) error {
+		copy(errs, initial)
+
+		// Read the stored copies to check their scopes and to diff for the audit
+		// log.
+		var befores []Record
+		if hasScope(records) || state.audits() {
+			var err error
+			if befores, err = state.readStored(req, records, errs, nil); err != nil {
+				return err
+			}
+			checkScopes(req, befores, errs)
+		}
+
+		if release {
+			if err := state.releaseUnique(req, records, errs); err != nil {
+				return err
+			}
+		}
+		if err := state.multi(req, records, errs, BatchStore.DeleteMulti, Store.Delete, notFound); err != nil {
+			return err
+		}
+
+		if state.audits() {
+			if err := state.audit(req, befores, make([]Record, len(records)), errs); err != nil {
+				return err
+			}
+		}
+		return state.publish(req, changeEvents(CodeDelete, records, nil, errs, true))
+	})
+}
+
+// Runs a store operation on the records that don't have an error in errs yet.
+// Uses the batch method if the store is a BatchStore and there's more than one
+// record, and calls the single method once per record otherwise. Writes the
+// failures into errs, passing them through convert if it's not nil. Returns an
+// error only if the whole batch failed.
+func (this *stateInstance) multi(req *http.Request, records []Record, errs MultiError,
+	batch func(BatchStore, *http.Request, []Record) error,
+	single func(Store, *http.Request, Record) error,
+	convert func(error) error) error {
+
+	// Pick the records that passed the checks.
+	indexes := []int{}
+	pending := []Record{}
+	for i, record := range records {
+		if errs[i] == nil {
+			indexes = append(indexes, i)
+			pending = append(pending, record)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Collect the errors by their indexes in the pending list.
+	results := make(MultiError, len(pending))
+	store := this.Store()
+	if batchStore, ok := store.(BatchStore); ok && len(pending) > 1 {
+		err := batch(batchStore, req, pending)
+		if multiErr, ok := err.(MultiError); ok && len(multiErr) == len(pending) {
+			results = multiErr
+		} else if err != nil {
+			if ErrorCode(err) == 500 {
+				this.log(req, "-- error in store batch:", err)
+			}
+			return err
+		}
+	} else {
+		for i, record := range pending {
+			results[i] = single(store, req, record)
+		}
+	}
+
+	// Map the errors back to the indexes in the full list.
+	for i, err := range results {
+		if err != nil && convert != nil {
+			err = convert(err)
+		}
+		errs[indexes[i]] = err
+	}
+	return nil
+}
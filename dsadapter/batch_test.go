@@ -0,0 +1,90 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Hides the optional interfaces of a store, so the state falls back to one call
+// per record.
+type testPlainStore struct {
+	Store
+}
+
+func TestBatchFallback(t *testing.T) {
+	stores := testStores(t)
+	stores["plain"] = testPlainStore{NewMemoryStore()}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			state := Setup(Config{Store: store})
+			state.Resources()["engines"] = (*testEngine)(nil)
+			req := testRequest("GET", "/")
+			expectCode(t, state.SyncSchema(req), 0)
+
+			// More records than one SQL statement takes.
+			engines := []*testEngine{}
+			for i := 0; i < 1200; i++ {
+				engines = append(engines, &testEngine{Name: strconv.Itoa(i)})
+			}
+			engines[5].Name = ""
+			err := state.SaveMulti(req, engines)
+			multiErr, _ := err.(MultiError)
+			if multiErr == nil || ErrorCode(multiErr[5]) != 422 || multiErr[4] != nil || ErrorCode(err) != 422 {
+				t.Fatalf("expected only the sixth record to fail, got %v", err)
+			}
+
+			reads := []*testEngine{{Id: engines[0].Id}, {Id: engines[1199].Id}}
+			expectCode(t, state.ReadMulti(req, reads), 0)
+			if reads[0].Name != "0" || reads[1].Name != "1199" {
+				t.Fatalf("expected the records to be read, got %#v", reads)
+			}
+
+			all := []*testEngine{}
+			expectCode(t, state.FindAll(req, &all, nil), 0)
+			if len(all) != 1199 {
+				t.Fatalf("expected 1199 records, got %d", len(all))
+			}
+			err = state.DeleteMulti(req, append(all, &testEngine{Id: "missing"}))
+			multiErr, _ = err.(MultiError)
+			if multiErr == nil || ErrorCode(multiErr[1199]) != 404 || multiErr[0] != nil {
+				t.Fatalf("expected only the missing record to fail, got %v", err)
+			}
+			all = nil
+			expectCode(t, state.FindAll(req, &all, nil), 0)
+			if len(all) != 0 {
+				t.Fatalf("expected the records to be deleted, got %d", len(all))
+			}
+
+			// The last write of an id wins.
+			duplicates := []*testEngine{{Id: "one", Name: "first"}, {Id: "one", Name: "second"}}
+			expectCode(t, state.SaveMulti(req, duplicates), 0)
+			read := &testEngine{Id: "one"}
+			expectCode(t, state.Read(req, read), 0)
+			if read.Name != "second" {
+				t.Fatalf("expected the last write to win, got %q", read.Name)
+			}
+		})
+	}
+}
+
+func TestBatchPermissions(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testEngine{Id: "one", Name: "one"})
+
+		forbidden := testRequest("GET", "/")
+		forbidden.Header.Set("Forbid", "true")
+		for name, err := range map[string]error{
+			"save":   state.SaveMulti(forbidden, []*testEngine{{Name: "two"}}),
+			"read":   state.ReadMulti(forbidden, []*testEngine{{Id: "one"}}),
+			"delete": state.DeleteMulti(forbidden, []*testEngine{{Id: "one"}}),
+		} {
+			if ErrorCode(err) != 403 {
+				t.Errorf("%s: expected 403, got %v", name, err)
+			}
+		}
+		expectCode(t, state.Read(req, &testEngine{Id: "one"}), 0)
+	})
+}
@@ -5,67 +5,97 @@ package dsadapter
 import (
 	// Standard
 	"net/http"
-
-	// App Engine
-	"appengine"
-	"appengine/datastore"
 )
 
 /****************************** Query Functions ******************************/
 
-// Takes a pointer to a Collection and finds records for it, filtered by the
-// given params and limited to the given count. The records are added to the
-// collection. The collection may be created with reflect like so:
-// reflect.New(<slice type>).Interface(). Zero or negative limit means no limit.
-func (this *stateInstance) Find(req *http.Request, collection interface{}, params map[string]string, limit int) error {
-	gc := appengine.NewContext(req)
-
+// Takes a pointer to a Collection and finds records for it that satisfy the
+// given query. The records are added to the collection. The collection may be
+// created with reflect like so: reflect.New(<slice type>).Interface().
+//
+// If the query has a limit and there may be more results, returns an opaque
+// URL-safe cursor. Pass it in Query.Cursor, keeping the rest of the query the
+// same but without the offset, to fetch the next page. An empty cursor means
+// there are no more results.
+//
+// Soft-deleted records are left out unless the query sets WithDeleted or
+// filters on the deletion mark. See `softdelete.go`. If the record type is a
+// Scoper, the filters of its scope are added to the query. See `scope.go`.
+func (this *stateInstance) Find(req *http.Request, collection interface{}, query Query) (string, error) {
 	// Make a Record of this collection's type to get its Datastore kind.
 	record, err := this.NewRecordFromCollection(collection)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Check for read permission.
 	if !record.Can(req, CodeRead) {
-		return err403
+		return "", err403
 	}
 
-	// Form a query.
-	q := datastore.NewQuery(record.Kind())
+	// Hide soft-deleted records unless asked for. This looks at the caller's
+	// filters only, so a scope filter on the deletion mark doesn't show them.
+	hide := hidesDeleted(record, query)
 
-	// Apply params, if any.
-	for key, param := range params {
-		q = q.Filter(key+" =", param)
+	// Limit the query to the records the request may see.
+	if query, err = scopeQuery(req, record, query); err != nil {
+		return "", err
 	}
-
-	// Apply limit, if any. Zero or negative means no limit.
-	if limit > 0 {
-		q = q.Limit(limit)
+	if hide {
+		query = query.Filter(softDeleteProperty, OpEq, false)
 	}
 
+	// Remember where the new records start.
+	start := refValue(collection).Len()
+
 	// Run the query, writing to the collection.
-	_, err = q.GetAll(gc, collection)
+	cursor, err := this.Store().GetAll(req, record.Kind(), collection, query)
 
 	if err != nil {
-		this.log(req, "-- error in datastore query:", err)
-		return err
+		if ErrorCode(err) == 500 {
+			this.log(req, "-- error in store query:", err)
+		}
+		return "", err
+	}
+
+	// Load the relations of the new records.
+	if err := this.include(req, ToRecords(collection)[start:], query.Includes); err != nil {
+		return "", err
 	}
 
 	// Compute properties on children.
 	this.Compute(collection)
 
-	return nil
+	// Run the AfterRead hooks of the new records.
+	for _, record := range ToRecords(collection)[start:] {
+		if err := this.afterRead(req, record); err != nil {
+			return "", err
+		}
+	}
+
+	return cursor, nil
 }
 
-// Takes a pointer to a Collection and finds records for it, filtered by the
-// given params.
+// Takes a pointer to a Collection and finds records for it whose properties
+// are equal to the given params.
 func (this *stateInstance) FindAll(req *http.Request, collection interface{}, params map[string]string) error {
-	return this.Find(req, collection, params, 0)
+	_, err := this.Find(req, collection, NewQuery(params))
+	return err
 }
 
 // Takes a pointer to a Collection and finds records for it, filtered by the URL
-// query params (if any).
-func (this *stateInstance) FindByQuery(req *http.Request, collection interface{}) error {
-	return this.Find(req, collection, toParams(req.URL.Query()), 0)
+// query params (if any). See ParseQuery for the syntax. Returns the cursor for
+// the next page, if any; put it in the `cursor` param to fetch that page.
+func (this *stateInstance) FindByQuery(req *http.Request, collection interface{}) (string, error) {
+	record, err := this.NewRecordFromCollection(collection)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := ParseQuery(record, req.URL.Query())
+	if err != nil {
+		return "", err
+	}
+
+	return this.Find(req, collection, query)
 }
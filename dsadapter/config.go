@@ -12,12 +12,34 @@ import (
 // Config passed by the user into a Setup call.
 type Config struct {
 	// Function to call when generating a missing id for a new record. If omitted,
-	// the default dsadapter.RndId function is used. To disable automatic id generation
+	// the default dsadapter.RndId function is used. Pass dsadapter.UUIDv4,
+	// UUIDv7 or ULID for other kinds of ids. To disable automatic id generation
 	// (not recommended), pass a function that returns an empty string.
 	RndId func() string
 	// Logger function to call on populate and critical errors. If omitted, no
 	// logging is done. Pass dsadapter.Log to use the default (recommended).
 	Logger func(*http.Request, ...interface{})
+	// Storage backend for records. If omitted, the Datastore is used on App
+	// Engine; on other runtimes, every operation fails until a store is given.
+	Store Store
+	// Number of times to run a transaction that fails because of concurrent
+	// changes. If omitted, transactions are tried 3 times.
+	TransactionAttempts int
+	// Decoders for fixture files by extension, like ".yaml", used by
+	// ReadFixtures and LoadFixtures. Each decodes a file into a pointer to a
+	// collection. ".json" is built in.
+	FixtureDecoders map[string]func([]byte, interface{}) error
+	// Sink for audit entries of record writes. If omitted, nothing is audited.
+	// Pass dsadapter.NewAuditKind() to store the entries with the records. See
+	// `audit.go`.
+	Audit AuditSink
+	// Function that identifies the user who makes a request, for audit entries.
+	// If omitted, entries have no user.
+	AuditUser func(*http.Request) string
+	// Publisher of change events for Subscribe. If omitted, a new MemoryBus is
+	// used. Pass dsadapter.NewOutbox() to write the events with the records. See
+	// `events.go`.
+	Publisher Publisher
 }
 
 /*********************************** Setup ***********************************/
@@ -27,9 +49,17 @@ type Config struct {
 // the setup process fails. The state object's methods comprise most of the
 // public API of the package.
 func Setup(config Config) State {
+	// Fall back on the runtime's default store.
+	if config.Store == nil {
+		config.Store = defaultStore()
+	}
+	// Deliver change events in this process by default.
+	if config.Publisher == nil {
+		config.Publisher = NewMemoryBus()
+	}
+
 	return &stateInstance{
-		resources:     map[string]Record{},
-		populateFuncs: map[string]func(*http.Request){},
-		config:        config,
+		resources: map[string]Record{},
+		config:    config,
 	}
 }
@@ -0,0 +1,358 @@
+package dsadapter
+
+// Change events: notifications of record writes for subscribers in the same
+// process.
+
+import (
+	// Standard
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/******************************* Change Events *******************************/
+
+/**
+ * Every record written through Save, SaveMulti, Patch, PatchJson, Delete,
+ * DeleteMulti, Restore and Purge produces a ChangeEvent, which goes to the
+ * config's Publisher. That includes the writes done by the REST handler,
+ * Populate and Import. Migrations write records directly and produce no
+ * events. Subscribe to react to them, for example to invalidate a cache:
+ *
+ *   unsubscribe := dsa.Subscribe("Engine", func(req *http.Request, event dsadapter.ChangeEvent) {
+ *     cache.Delete(event.RecordId)
+ *   })
+ *
+ * Events are published after the write succeeds. Inside a transaction, they're
+ * published after the commit, and not at all if it's rolled back.
+ */
+type ChangeEvent struct {
+	// Random id of the event, a UUIDv7.
+	Id string
+	// Kind and id of the record.
+	Kind     string
+	RecordId string
+	// CodeCreate for saves of records that weren't stored yet, CodeUpdate for
+	// saves of stored records, including Restore, and CodeDelete for deletions,
+	// including soft ones.
+	Op int
+	At time.Time
+	// Copy of the record as written. Nil for records deleted from the store.
+	// Shared by the subscribers, so treat it as read-only.
+	Record Record
+}
+
+// Publisher delivers change events to subscribers. Publish is called with the
+// events of one operation after the write, or after the commit of the
+// transaction that made it. Subscribe registers a function for the events of
+// a kind, or of every kind if the kind is "", and returns a function that
+// cancels the subscription.
+type Publisher interface {
+	Publish(*http.Request, State, []ChangeEvent)
+	Subscribe(string, func(*http.Request, ChangeEvent)) func()
+}
+
+// StagingPublisher is an optional interface for publishers that also need the
+// events before the commit. Stage is called with the state that runs the
+// write, in the same transaction if the store supports them. An error from
+// Stage fails the operation.
+type StagingPublisher interface {
+	Stage(*http.Request, State, []ChangeEvent) error
+}
+
+// Registers a function to call with the change events of the given kind, or of
+// every kind if the kind is "". The function is called synchronously by the
+// goroutine that made the change, so it should be quick. Returns a function
+// that cancels the subscription.
+func (this *stateInstance) Subscribe(kind string, fn func(*http.Request, ChangeEvent)) func() {
+	return this.config.Publisher.Subscribe(kind, fn)
+}
+
+/******************************** Publishers *********************************/
+
+// MemoryBus is a Publisher that calls the subscribers of this process right
+// away. It's the default. Safe for concurrent use.
+type MemoryBus struct {
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+}
+
+// Returns a new empty MemoryBus.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+// Calls the subscribers of each event's kind, in the order they subscribed.
+func (this *MemoryBus) Publish(req *http.Request, state State, events []ChangeEvent) {
+	// Call the subscribers outside of the lock, so they may subscribe and
+	// unsubscribe.
+	this.mutex.RLock()
+	subscriptions := append([]*subscription{}, this.subscriptions...)
+	this.mutex.RUnlock()
+
+	for _, event := range events {
+		for _, sub := range subscriptions {
+			if sub.kind == "" || sub.kind == event.Kind {
+				sub.fn(req, event)
+			}
+		}
+	}
+}
+
+// Registers a subscriber.
+func (this *MemoryBus) Subscribe(kind string, fn func(*http.Request, ChangeEvent)) func() {
+	sub := &subscription{kind: kind, fn: fn}
+	this.mutex.Lock()
+	this.subscriptions = append(this.subscriptions, sub)
+	this.mutex.Unlock()
+
+	return func() {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+		for i, other := range this.subscriptions {
+			if other == sub {
+				this.subscriptions = append(this.subscriptions[:i:i], this.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Returns true if any subscriber gets the events of the kind.
+func (this *MemoryBus) subscribed(kind string) bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for _, sub := range this.subscriptions {
+		if sub.kind == "" || sub.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Outbox is a Publisher that writes each event to the "DsaOutbox" kind of the
+ * state's store, in the same transaction as the record, before delivering it.
+ * An event whose write committed is delivered even if the process stops right
+ * after the commit: call Relay periodically, in any process, to deliver the
+ * events left in the outbox:
+ *
+ *   for range time.Tick(time.Minute) {
+ *     if _, err := outbox.Relay(req, dsa); err != nil {
+ *       log.Println(err)
+ *     }
+ *   }
+ *
+ * Events are delivered at least once: an event may be delivered again if its
+ * row can't be deleted, or if Relay runs in two processes at once. Relay
+ * delivers events to the subscribers of the process that runs it, and decodes
+ * their records from json, so fields hidden from json are left out. With a
+ * SchemaStore, SyncSchema creates the schema of the outbox.
+ */
+type Outbox struct {
+	bus MemoryBus
+}
+
+// Returns a new empty Outbox.
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+// Writes the events to the outbox.
+func (this *Outbox) Stage(req *http.Request, state State, events []ChangeEvent) error {
+	for _, event := range events {
+		record, err := json.Marshal(event.Record)
+		if err != nil {
+			return err
+		}
+		row := &outboxRecord{
+			Id:         event.Id,
+			RecordKind: event.Kind,
+			RecordId:   event.RecordId,
+			Op:         event.Op,
+			At:         event.At,
+			Record:     record,
+		}
+		if err := state.Store().Put(req, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delivers the committed events to the subscribers, then deletes them from the
+// outbox. Events that can't be deleted stay for Relay.
+func (this *Outbox) Publish(req *http.Request, state State, events []ChangeEvent) {
+	this.bus.Publish(req, state, events)
+	for _, event := range events {
+		state.Store().Delete(req, &outboxRecord{Id: event.Id})
+	}
+}
+
+// Registers a subscriber.
+func (this *Outbox) Subscribe(kind string, fn func(*http.Request, ChangeEvent)) func() {
+	return this.bus.Subscribe(kind, fn)
+}
+
+// Delivers the events left in the outbox to the subscribers, oldest first,
+// deleting each after delivery. Returns the number of events delivered. Stops
+// at the first error.
+func (this *Outbox) Relay(req *http.Request, state State) (int, error) {
+	count := 0
+	for {
+		rows := []*outboxRecord{}
+		query := Query{Orders: []string{"Id"}, Limit: outboxBatchSize}
+		if _, err := state.Store().GetAll(req, outboxMetaKind, &rows, query); err != nil {
+			return count, err
+		}
+
+		for _, row := range rows {
+			event, err := row.event(state)
+			if err != nil {
+				return count, err
+			}
+			this.bus.Publish(req, state, []ChangeEvent{event})
+			if err := state.Store().Delete(req, row); err != nil && ErrorCode(err) != 404 {
+				return count, err
+			}
+			count++
+		}
+
+		if len(rows) < outboxBatchSize {
+			return count, nil
+		}
+	}
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Kind of the entities that hold undelivered events.
+const outboxMetaKind = "DsaOutbox"
+
+// Number of events that Relay reads at once.
+const outboxBatchSize = 100
+
+// A subscriber of a MemoryBus.
+type subscription struct {
+	kind string
+	fn   func(*http.Request, ChangeEvent)
+}
+
+// A stored change event. The fields match those of ChangeEvent, except for the
+// kind, which would clash with the Kind method, and the record, which is
+// stored as json.
+type outboxRecord struct {
+	Id         string
+	RecordKind string
+	RecordId   string
+	Op         int
+	At         time.Time
+	Record     []byte
+}
+
+// Record methods. Outbox records are managed by the state.
+func (this *outboxRecord) Validate(*http.Request) map[string]string { return nil }
+func (this *outboxRecord) Compute()                                 {}
+func (this *outboxRecord) Can(*http.Request, int) bool              { return true }
+func (this *outboxRecord) Save(*http.Request) error                 { return errOutbox }
+func (this *outboxRecord) Read(*http.Request) error                 { return errOutbox }
+func (this *outboxRecord) Delete(*http.Request) error               { return errOutbox }
+func (this *outboxRecord) GetId() string                            { return this.Id }
+func (this *outboxRecord) SetId(id string)                          { this.Id = id }
+func (this *outboxRecord) Kind() string                             { return outboxMetaKind }
+
+// Returns the stored event. The record is decoded into a record of the
+// resource with the event's kind, and left nil if there's no such resource.
+func (this *outboxRecord) event(state State) (ChangeEvent, error) {
+	event := ChangeEvent{
+		Id:       this.Id,
+		Kind:     this.RecordKind,
+		RecordId: this.RecordId,
+		Op:       this.Op,
+		At:       this.At,
+	}
+	for resource := range state.Resources() {
+		record := state.NewRecordByResource(resource)
+		if record.Kind() != this.RecordKind {
+			continue
+		}
+		if err := json.Unmarshal(this.Record, record); err != nil {
+			return event, err
+		}
+		if record.GetId() != "" {
+			state.Compute(record)
+			event.Record = record
+		}
+		break
+	}
+	return event, nil
+}
+
+/********************************* Utilities *********************************/
+
+// Returns true if the config's publisher stages events.
+func (this *stateInstance) stages() bool {
+	_, ok := this.config.Publisher.(StagingPublisher)
+	return ok
+}
+
+// Returns true if the config's publisher may have subscribers for the events
+// of the records. Only a MemoryBus can tell that it has none.
+func (this *stateInstance) observed(records []Record) bool {
+	bus, ok := this.config.Publisher.(*MemoryBus)
+	if !ok {
+		return true
+	}
+	for _, record := range records {
+		if bus.subscribed(record.Kind()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes change events for the records that don't have an error in errs. For
+// saves, pass CodeUpdate and the stored copies from before the write, like for
+// the audit log; records without a stored copy are reported as created. The
+// events hold copies of the records unless they were removed from the store.
+func changeEvents(op int, records, befores []Record, errs MultiError, removed bool) []ChangeEvent {
+	at := now()
+	events := []ChangeEvent{}
+	for i, record := range records {
+		if errs[i] != nil {
+			continue
+		}
+
+		event := ChangeEvent{Id: UUIDv7(), Kind: record.Kind(), RecordId: record.GetId(), Op: op, At: at}
+		if op == CodeUpdate && befores[i] == nil {
+			event.Op = CodeCreate
+		}
+		if !removed {
+			event.Record = newRecordLike(record)
+			copyFields(refValue(event.Record), refValue(record))
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Passes the events to the config's publisher: to Stage right away if it's a
+// StagingPublisher, and to Publish right away, or after the commit inside a
+// transaction.
+func (this *stateInstance) publish(req *http.Request, events []ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if stager, ok := this.config.Publisher.(StagingPublisher); ok {
+		if err := stager.Stage(req, this, events); err != nil {
+			return err
+		}
+	}
+	if this.inTransaction {
+		*this.pending = append(*this.pending, events...)
+		return nil
+	}
+	this.config.Publisher.Publish(req, this, events)
+	return nil
+}
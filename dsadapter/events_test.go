@@ -0,0 +1,112 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"testing"
+)
+
+// Collects the events of a kind until the returned function is called.
+func collectEvents(state State, kind string) (*[]ChangeEvent, func()) {
+	events := &[]ChangeEvent{}
+	stop := state.Subscribe(kind, func(_ *http.Request, event ChangeEvent) {
+		*events = append(*events, event)
+	})
+	return events, stop
+}
+
+// Returns the operations of the events.
+func eventOps(events []ChangeEvent) []int {
+	ops := []int{}
+	for _, event := range events {
+		ops = append(ops, event.Op)
+	}
+	return ops
+}
+
+func TestEvents(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		events, stop := collectEvents(state, "Engine")
+		defer stop()
+
+		// A record is created whether its id is generated or given.
+		engine := &testEngine{Name: "one"}
+		mustSave(t, state, req, engine, &testEngine{Id: "two", Name: "two"})
+		expectCode(t, state.SaveMulti(req, []*testEngine{{Id: "three", Name: "three"}, {Id: engine.Id, Name: "uno"}}), 0)
+		expectCode(t, state.Patch(req, &testEngine{Id: "two", Cars: 2}, []string{"Cars"}), 0)
+		expectCode(t, state.Delete(req, &testEngine{Id: "three"}), 0)
+
+		expected := []int{CodeCreate, CodeCreate, CodeCreate, CodeUpdate, CodeUpdate, CodeDelete}
+		if !equalInts(eventOps(*events), expected) {
+			t.Fatalf("expected the operations %v, got %v", expected, eventOps(*events))
+		}
+		if last := (*events)[5]; last.RecordId != "three" || last.Record != nil {
+			t.Fatalf("expected a deletion of three without a record, got %#v", last)
+		}
+		if update := (*events)[4]; update.Record.(*testEngine).Cars != 2 {
+			t.Fatalf("expected the patched record, got %#v", update.Record)
+		}
+
+		// Other kinds and stopped subscriptions get nothing.
+		stop()
+		mustSave(t, state, req, &testEngine{Name: "four"}, &testTrain{Name: "five"})
+		if len(*events) != 6 {
+			t.Fatalf("expected no more events, got %d", len(*events))
+		}
+	})
+}
+
+func TestEventsSoftDelete(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		events, stop := collectEvents(state, "Note")
+		defer stop()
+
+		note := &testNote{Text: "one"}
+		mustSave(t, state, req, note)
+		expectCode(t, state.Delete(req, &testNote{Id: note.Id}), 0)
+		expectCode(t, state.Restore(req, &testNote{Id: note.Id}), 0)
+
+		expected := []int{CodeCreate, CodeDelete, CodeUpdate}
+		if !equalInts(eventOps(*events), expected) {
+			t.Fatalf("expected the operations %v, got %v", expected, eventOps(*events))
+		}
+		if deleted := (*events)[1].Record; deleted == nil || !deleted.(*testNote).Deleted {
+			t.Fatalf("expected the marked record, got %#v", deleted)
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	outbox := NewOutbox()
+	forEachStore(t, Config{Publisher: outbox}, func(t *testing.T, state State, req *http.Request) {
+		events, stop := collectEvents(state, "Engine")
+		defer stop()
+
+		// Committed events are delivered and removed from the outbox.
+		engine := &testEngine{Name: "one"}
+		mustSave(t, state, req, engine)
+		expectCode(t, state.Delete(req, &testEngine{Id: engine.Id}), 0)
+		if !equalInts(eventOps(*events), []int{CodeCreate, CodeDelete}) {
+			t.Fatalf("expected a create and a delete, got %v", eventOps(*events))
+		}
+		count, err := outbox.Relay(req, state)
+		if count != 0 || err != nil {
+			t.Fatalf("expected an empty outbox, got %d events and %v", count, err)
+		}
+
+		// Events staged but not published, as after a crash, are relayed once.
+		staged := ChangeEvent{Id: UUIDv7(), Kind: "Engine", RecordId: "two", Op: CodeUpdate, Record: &testEngine{Id: "two", Name: "two"}}
+		expectCode(t, outbox.Stage(req, state, []ChangeEvent{staged}), 0)
+		count, err = outbox.Relay(req, state)
+		if count != 1 || err != nil || len(*events) != 3 {
+			t.Fatalf("expected one event relayed, got %d and %v", count, err)
+		}
+		if relayed := (*events)[2]; relayed.Op != CodeUpdate || relayed.Record.(*testEngine).Name != "two" {
+			t.Fatalf("expected the staged event, got %#v", relayed)
+		}
+		count, err = outbox.Relay(req, state)
+		if count != 0 || err != nil {
+			t.Fatalf("expected an empty outbox, got %d events and %v", count, err)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package dsadapter
+
+// Export and import of whole resources as JSON Lines.
+
+import (
+	// Standard
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************* Constants *********************************/
+
+// Ways to handle imported records whose ids are taken. See ImportOptions.
+const (
+	// Stop the import with ErrExists.
+	ConflictFail = iota
+	// Leave the stored record alone and go on.
+	ConflictSkip
+	// Replace the stored record.
+	ConflictOverwrite
+)
+
+// Number of records per page or batch, unless the options say otherwise.
+const exportBatchSize = 100
+
+/********************************** Export ***********************************/
+
+// Writes every record of the given resource to the writer as JSON Lines: one
+// json object per line, in the order of ids. The resource may also be given by
+// its kind. Records are read page by page with Find, so permissions, hooks and
+// computed properties apply, and soft-deleted records are included. Fields
+// hidden from json are left out.
+func (this *stateInstance) Export(req *http.Request, name string, out io.Writer) error {
+	record, err := this.resourceRecord(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	query := Query{Limit: exportBatchSize, WithDeleted: true}
+	for {
+		collection := this.SliceOf(record)
+		cursor, err := this.Find(req, collection, query)
+		if err != nil {
+			return err
+		}
+		for _, record := range ToRecords(collection) {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		if cursor == "" {
+			return nil
+		}
+		query.Cursor = cursor
+	}
+}
+
+/********************************** Import ***********************************/
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// What to do with records whose ids are taken: one of the ConflictX
+	// constants. Defaults to ConflictFail.
+	Conflict int
+	// Number of records to save at once. If omitted, 100.
+	BatchSize int
+}
+
+// ImportResult counts the records written by Import.
+type ImportResult struct {
+	Created int
+	Updated int
+	Skipped int
+}
+
+// ImportError is the error of one line of an import. It unwraps to the
+// record's error, so ErrorCode reports its status.
+type ImportError struct {
+	// Line number, starting with 1.
+	Line int
+	Err  error
+}
+
+// Error method. The message of the record's error, followed by the line.
+func (this *ImportError) Error() string {
+	return this.Err.Error() + " (line " + strconv.Itoa(this.Line) + ")"
+}
+
+// Returns the record's error for errors.Is and errors.As.
+func (this *ImportError) Unwrap() error {
+	return this.Err
+}
+
+/**
+ * Reads JSON Lines, as written by Export, into records of the given resource
+ * and saves them in batches like SaveMulti, so permissions, hooks, validation
+ * and timestamps apply. Records without ids are created with new ids, and
+ * other records that don't exist yet are created with their own, checking
+ * CodeCreate. Records whose ids are taken, including by soft-deleted records,
+ * are handled per options.Conflict. Versions in the input are ignored:
+ * imported Versioned records continue from the stored version.
+ *
+ * Stops at the first failure and returns an *ImportError with its line:
+ * malformed json and unknown fields (400), taken ids with ConflictFail
+ * (ErrExists, 409), or a record that fails to save. Batches aren't atomic: the
+ * batches before it stay saved, and so do the other records of its batch if it
+ * failed to save. Returns the counts of the records written, including those.
+ */
+func (this *stateInstance) Import(req *http.Request, name string, in io.Reader, options ImportOptions) (ImportResult, error) {
+	result := ImportResult{}
+	record, err := this.resourceRecord(name)
+	if err != nil {
+		return result, err
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = exportBatchSize
+	}
+
+	reader := bufio.NewReader(in)
+	records := []Record{}
+	lines := []int{}
+	line := 0
+
+	for {
+		// Read the next line. The last one may lack a newline.
+		content, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return result, err
+		}
+		eof := err == io.EOF
+
+		if content = bytes.TrimSpace(content); len(content) > 0 {
+			line++
+			rec := reflect.New(reflect.TypeOf(record).Elem()).Interface().(Record)
+			if err := decodeJsonStrict(content, rec); err != nil {
+				return result, &ImportError{Line: line, Err: errJson.Wrap(err)}
+			}
+			records = append(records, rec)
+			lines = append(lines, line)
+		} else if !eof {
+			line++
+		}
+
+		// Save a full batch, or what's left at the end.
+		if len(records) >= batchSize || (eof && len(records) > 0) {
+			if err := this.importBatch(req, records, lines, options, &result); err != nil {
+				return result, err
+			}
+			records, lines = records[:0], lines[:0]
+		}
+		if eof {
+			return result, nil
+		}
+	}
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Saves one batch of imported records, resolving taken ids per the options.
+func (this *stateInstance) importBatch(req *http.Request, records []Record, lines []int, options ImportOptions, result *ImportResult) error {
+	// Read the stored copies of the records with ids.
+	stored := make([]Record, len(records))
+	errs := make(MultiError, len(records))
+	for i, record := range records {
+		if record.GetId() == "" {
+			errs[i] = err404
+			continue
+		}
+		stored[i] = newRecordLike(record)
+	}
+	if err := this.multi(req, stored, errs, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return err
+	}
+
+	// Sort out the records to save. Records that don't exist yet are created,
+	// so an id taken since the read fails instead of being overwritten.
+	saves := []Record{}
+	saveLines := []int{}
+	created := []bool{}
+	creates := map[int]bool{}
+	for i, record := range records {
+		exists := errs[i] == nil
+		if errs[i] != nil && ErrorCode(errs[i]) != 404 {
+			return &ImportError{Line: lines[i], Err: errs[i]}
+		}
+
+		if exists && options.Conflict == ConflictSkip {
+			result.Skipped++
+			continue
+		}
+		if exists && options.Conflict != ConflictOverwrite {
+			return &ImportError{Line: lines[i], Err: errExists(record.GetId())}
+		}
+
+		// Continue from the stored version, or 0 for new records.
+		if versioned, ok := record.(Versioned); ok {
+			var version int64
+			if exists {
+				version = stored[i].(Versioned).GetVersion()
+			}
+			versioned.SetVersion(version)
+		}
+
+		this.Compute(record)
+		if !exists && record.GetId() != "" {
+			creates[len(saves)] = true
+		}
+		saves = append(saves, record)
+		saveLines = append(saveLines, lines[i])
+		created = append(created, !exists)
+	}
+
+	if len(saves) == 0 {
+		return nil
+	}
+
+	// Save with a state that may overwrite soft-deleted records.
+	importer := *this
+	importer.writesDeleted = true
+	err := importer.saveMulti(req, saves, creates)
+	multiErr, ok := err.(MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	// Count the saved records, and report the first failure, if any.
+	var failure error
+	for i := range saves {
+		if ok && multiErr[i] != nil {
+			if failure == nil {
+				failure = &ImportError{Line: saveLines[i], Err: multiErr[i]}
+			}
+			continue
+		}
+		if created[i] {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+	return failure
+}
+
+// Returns a record of the resource with the given name or kind.
+func (this *stateInstance) resourceRecord(name string) (Record, error) {
+	if record := this.NewRecordByResource(name); record != nil {
+		return record, nil
+	}
+	for resource := range this.Resources() {
+		if record := this.NewRecordByResource(resource); record.Kind() == name {
+			return record, nil
+		}
+	}
+	return nil, utils.Error("unknown resource: " + name)
+}
+
+// Makes the error for a record to create whose id is taken.
+func errExists(id string) error {
+	return ErrExists.WithDetails(map[string]interface{}{"id": id})
+}
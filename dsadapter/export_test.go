@@ -0,0 +1,157 @@
+package dsadapter
+
+import (
+	// Standard
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A MemoryStore that writes a record with the given id right after a read, as
+// if another request created it in between.
+type testRaceStore struct {
+	*MemoryStore
+	id string
+}
+
+func (this *testRaceStore) Get(req *http.Request, record Record) error {
+	err := this.MemoryStore.Get(req, record)
+	this.race(req)
+	return err
+}
+
+func (this *testRaceStore) GetMulti(req *http.Request, records []Record) error {
+	err := this.MemoryStore.GetMulti(req, records)
+	this.race(req)
+	return err
+}
+
+func (this *testRaceStore) race(req *http.Request) {
+	if this.id != "" {
+		this.MemoryStore.Put(req, &testEngine{Id: this.id, Name: "racer"})
+		this.id = ""
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		for i := 0; i < 250; i++ {
+			mustSave(t, state, req, &testEngine{Name: "engine", Cars: i})
+		}
+
+		// Export pages through every record, by resource or kind.
+		dump := &bytes.Buffer{}
+		expectCode(t, state.Export(req, "Engine", dump), 0)
+		if lines := strings.Count(dump.String(), "\n"); lines != 250 {
+			t.Fatalf("expected 250 lines, got %d", lines)
+		}
+		if err := state.Export(req, "sleepers", dump); err == nil {
+			t.Fatal("expected an error for an unknown resource")
+		}
+
+		// Import into an empty state.
+		other := Setup(Config{Store: NewMemoryStore()})
+		other.Resources()["engines"] = (*testEngine)(nil)
+		result, err := other.Import(req, "engines", strings.NewReader(dump.String()), ImportOptions{})
+		expectCode(t, err, 0)
+		if result.Created != 250 {
+			t.Fatalf("expected 250 created records, got %#v", result)
+		}
+
+		// Taken ids are handled per the options.
+		_, err = other.Import(req, "engines", strings.NewReader(dump.String()), ImportOptions{})
+		var importErr *ImportError
+		if !errors.As(err, &importErr) || importErr.Line != 1 || !errors.Is(err, ErrExists) {
+			t.Fatalf("expected ErrExists on line 1, got %v", err)
+		}
+		result, err = other.Import(req, "engines", strings.NewReader(dump.String()), ImportOptions{Conflict: ConflictSkip})
+		expectCode(t, err, 0)
+		if result.Skipped != 250 {
+			t.Fatalf("expected 250 skipped records, got %#v", result)
+		}
+		input := dump.String() + "\n\n" + `{"Name":"new"}`
+		result, err = other.Import(req, "engines", strings.NewReader(input), ImportOptions{Conflict: ConflictOverwrite, BatchSize: 7})
+		expectCode(t, err, 0)
+		if result.Updated != 250 || result.Created != 1 {
+			t.Fatalf("expected 250 updated and 1 created record, got %#v", result)
+		}
+
+		// Missing records are created with their ids, whatever the options.
+		input = `{"Id":"missing","Name":"new"}`
+		forbidden := testRequest("POST", "/")
+		forbidden.Header.Set("Forbid", "create")
+		for _, conflict := range []int{ConflictSkip, ConflictOverwrite} {
+			_, err = other.Import(forbidden, "engines", strings.NewReader(input), ImportOptions{Conflict: conflict})
+			expectCode(t, err, 403)
+		}
+		result, err = other.Import(req, "engines", strings.NewReader(input), ImportOptions{Conflict: ConflictOverwrite})
+		expectCode(t, err, 0)
+		if result.Created != 1 {
+			t.Fatalf("expected 1 created record, got %#v", result)
+		}
+	})
+}
+
+func TestImportErrors(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		tests := []struct {
+			input   string
+			line    int
+			code    int
+			created int
+		}{
+			{`{"Name":"one"}` + "\n\n" + `{"Wheels":1}`, 3, 400, 0},
+			{`{"Name":"one"}` + "\n" + `{"Name":`, 2, 400, 0},
+			// The other records of a failing batch are saved.
+			{`{"Name":"one"}` + "\n" + `{}` + "\n" + `{"Name":"three"}`, 2, 422, 2},
+		}
+		for _, test := range tests {
+			result, err := state.Import(req, "engines", strings.NewReader(test.input), ImportOptions{})
+			var importErr *ImportError
+			if !errors.As(err, &importErr) || importErr.Line != test.line || ErrorCode(err) != test.code {
+				t.Errorf("%q: expected %d on line %d, got %v", test.input, test.code, test.line, err)
+			}
+			if result.Created != test.created {
+				t.Errorf("%q: expected %d created records, got %d", test.input, test.created, result.Created)
+			}
+		}
+	})
+}
+
+func TestImportRace(t *testing.T) {
+	store := &testRaceStore{MemoryStore: NewMemoryStore(), id: "one"}
+	state := Setup(Config{Store: store})
+	state.Resources()["engines"] = (*testEngine)(nil)
+	req := testRequest("GET", "/")
+
+	// A record created after the check isn't overwritten.
+	_, err := state.Import(req, "engines", strings.NewReader(`{"Id":"one","Name":"imported"}`), ImportOptions{})
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	read := &testEngine{Id: "one"}
+	expectCode(t, state.Read(req, read), 0)
+	if read.Name != "racer" {
+		t.Fatalf("expected the other record to be kept, got %#v", read)
+	}
+}
+
+func TestImportDeleted(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		note := &testNote{Text: "deleted"}
+		mustSave(t, state, req, note)
+		expectCode(t, state.Delete(req, &testNote{Id: note.Id}), 0)
+
+		// Soft-deleted records are overwritten like others.
+		input := `{"Id":"` + note.Id + `","Text":"imported"}`
+		result, err := state.Import(req, "notes", strings.NewReader(input), ImportOptions{Conflict: ConflictOverwrite})
+		expectCode(t, err, 0)
+		read := &testNote{Id: note.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if result.Updated != 1 || read.Text != "imported" {
+			t.Fatalf("expected the record to be overwritten, got %#v and %#v", result, read)
+		}
+	})
+}
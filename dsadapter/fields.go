@@ -0,0 +1,383 @@
+package dsadapter
+
+// Field-level permissions: which fields of a record a request may read and
+// write.
+
+import (
+	// Standard
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/***************************** Field Permissions *****************************/
+
+/**
+ * Fields of a record type can be restricted with the `dsa` struct tag:
+ *
+ *   type User struct {
+ *     Id           string
+ *     Email        string
+ *     Role         string `dsa:"readonly"`
+ *     Login        string `dsa:"createonly"`
+ *     Password     string `dsa:"writeonly" datastore:"-"`
+ *     PasswordHash string `dsa:"hidden"`
+ *   }
+ *
+ *   readonly    -> read, never written by clients
+ *   createonly  -> read, written by clients only when creating
+ *   writeonly   -> written by clients, never read
+ *   hidden      -> neither read nor written by clients
+ *
+ * For rules that depend on the request, like fields that only admins may see,
+ * the record may implement FieldRestricted. A field may be read or written only
+ * if both its tag and CanField allow it.
+ *
+ * The rules apply to what clients send and receive. The REST handler leaves
+ * the fields a request may not read out of its responses, and rejects requests
+ * that change fields they may not write with 403; so do Patch and PatchJson.
+ * Readable and CheckWrites do the same for other handlers. Save, SaveMulti and
+ * the other methods don't check fields, so the application itself can still
+ * set them.
+ */
+
+// FieldRestricted is an optional interface for records whose field
+// permissions depend on the request.
+type FieldRestricted interface {
+	// Must return true if the request may perform the operation on the field.
+	// The operation is CodeRead, CodeCreate or CodeUpdate, and the field is the
+	// name of the struct field. Fields of embedded structs are named without
+	// the embedded struct.
+	CanField(*http.Request, int, string) bool
+}
+
+/**
+ * Returns a value that encodes as json like the given record or collection,
+ * but without the fields that the request may not read. Related records held
+ * in the fields are filtered too. Use it to send records from other handlers:
+ *
+ *   ctx.SendAsJson(dsa.Readable(req, engines))
+ */
+func (this *stateInstance) Readable(req *http.Request, value interface{}) interface{} {
+	return readableJson{req: req, value: value}
+}
+
+// Returns a 403 error if the record changes fields that the request may not
+// write, with the names of the fields in the details. For an update, pass the
+// stored copy of the record, which also decides CanField. For a create, pass
+// nil: then any non-zero value counts as a change. Fields set to the values
+// they already have are allowed, so clients may send back what they read.
+func (this *stateInstance) CheckWrites(req *http.Request, record, stored Record) error {
+	val, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	op := CodeCreate
+	owner := record
+	var old reflect.Value
+	if stored != nil {
+		if old, err = recordStruct(stored); err != nil {
+			return err
+		}
+		op = CodeUpdate
+		owner = stored
+	}
+
+	names := []string{}
+	for _, field := range accessFieldsOf(val.Type()) {
+		if canField(req, owner, field, op) {
+			continue
+		}
+		previous := reflect.Zero(field.typ)
+		if stored != nil {
+			previous = field.value(old)
+		}
+		if !sameValues(field.value(val), previous) {
+			names = append(names, field.name)
+		}
+	}
+
+	if len(names) > 0 {
+		return errFields.WithDetails(map[string]interface{}{"fields": names})
+	}
+	return nil
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// A struct field as seen by field permissions.
+type accessField struct {
+	// Struct field name.
+	name string
+	// Json key, or "" if the field is hidden from json.
+	key string
+	// Index sequence for reflect.Value.FieldByIndex.
+	index []int
+	typ   reflect.Type
+	// First part of the `dsa` tag.
+	tag string
+}
+
+// Cache of field lists by struct type.
+var accessFieldCache sync.Map
+
+// Returns the value of the field in the given struct value.
+func (this accessField) value(val reflect.Value) reflect.Value {
+	return val.FieldByIndex(this.index)
+}
+
+// Returns the exported fields of the given struct type. Fields of embedded
+// structs without a json name are treated as if they belonged to the outer
+// struct, like encoding/json does.
+func accessFieldsOf(typ reflect.Type) []accessField {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if cached, ok := accessFieldCache.Load(typ); ok {
+		return cached.([]accessField)
+	}
+
+	fields := []accessField{}
+	if typ.Kind() == reflect.Struct {
+		fields = appendAccessFields(fields, typ, nil)
+	}
+
+	accessFieldCache.Store(typ, fields)
+	return fields
+}
+
+// Appends the fields of the given struct type, prefixing each field index with
+// the given index sequence.
+func appendAccessFields(fields []accessField, typ reflect.Type, prefix []int) []accessField {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		index := append(append([]int{}, prefix...), i)
+
+		// Skip unexported fields.
+		if field.PkgPath != "" {
+			continue
+		}
+
+		key := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			key = ""
+		} else if tag != "" {
+			key = tag
+		} else if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			// Flatten embedded structs.
+			fields = appendAccessFields(fields, field.Type, index)
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("dsa"), ",")[0]
+		fields = append(fields, accessField{name: field.Name, key: key, index: index, typ: field.Type, tag: tag})
+	}
+	return fields
+}
+
+// Returns true if the request may perform the operation on the field of the
+// record, per the field's tag and the record's CanField method.
+func canField(req *http.Request, record Record, field accessField, op int) bool {
+	switch field.tag {
+	case "hidden":
+		return false
+	case "readonly":
+		if op != CodeRead {
+			return false
+		}
+	case "createonly":
+		if op == CodeUpdate {
+			return false
+		}
+	case "writeonly":
+		if op == CodeRead {
+			return false
+		}
+	}
+
+	if restricted, ok := record.(FieldRestricted); ok {
+		return restricted.CanField(req, op, field.name)
+	}
+	return true
+}
+
+// Returns true if the record's type has any field rules.
+func hasFieldRules(record Record) bool {
+	if _, ok := record.(FieldRestricted); ok {
+		return true
+	}
+	for _, field := range accessFieldsOf(reflect.TypeOf(record)) {
+		if field.tag != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks two field values for equality like equalValues, except that empty
+// slices and maps equal nil ones, since json can't tell them apart.
+func sameValues(one, other reflect.Value) bool {
+	switch one.Kind() {
+	case reflect.Slice, reflect.Map:
+		if one.Len() == 0 && other.Len() == 0 {
+			return true
+		}
+	}
+	return equalValues(one, other)
+}
+
+/**
+ * Prepares a record decoded from a json body to replace its stored copy. The
+ * fields that the request may not update and that the body leaves out keep
+ * their stored values, so a client can send only what it may write. Then
+ * checks the writes with CheckWrites. A record that isn't stored yet is
+ * checked as a create. Does nothing for records without field rules.
+ */
+func (this *stateInstance) keepFields(req *http.Request, record Record, body []byte) error {
+	if !hasFieldRules(record) {
+		return nil
+	}
+
+	stored := newRecordLike(record)
+	if err := this.Store().Get(req, stored); ErrorCode(err) == 404 {
+		return this.CheckWrites(req, record, nil)
+	} else if err != nil {
+		return err
+	}
+	this.Compute(stored)
+
+	// Find the keys in the body. Like encoding/json, match them
+	// case-insensitively.
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return errJson
+	}
+	hasKey := func(key string) bool {
+		for other := range keys {
+			if strings.EqualFold(other, key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	dst, src := refValue(record), refValue(stored)
+	for _, field := range accessFieldsOf(dst.Type()) {
+		if !canField(req, stored, field, CodeUpdate) && (field.key == "" || !hasKey(field.key)) {
+			field.value(dst).Set(deepCopy(field.value(src)))
+		}
+	}
+
+	return this.CheckWrites(req, record, stored)
+}
+
+/********************************* Encoding **********************************/
+
+// Encodes a record or collection as json without the fields that the request
+// may not read. See Readable.
+type readableJson struct {
+	req   *http.Request
+	value interface{}
+}
+
+// Implements json.Marshaler.
+func (this readableJson) MarshalJSON() ([]byte, error) {
+	return readableBytes(this.req, reflect.ValueOf(this.value))
+}
+
+// Encodes the value as json, leaving out the fields of records that the
+// request may not read.
+func readableBytes(req *http.Request, val reflect.Value) ([]byte, error) {
+	if !val.IsValid() {
+		return []byte("null"), nil
+	}
+	if val.Kind() == reflect.Interface || (val.Kind() == reflect.Ptr && !val.Type().Implements(recordType)) {
+		if val.IsNil() {
+			return []byte("null"), nil
+		}
+		return readableBytes(req, val.Elem())
+	}
+
+	// Encode lists of records element by element.
+	if (val.Kind() == reflect.Slice || val.Kind() == reflect.Array) && holdsRecords(val.Type()) {
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			return []byte("null"), nil
+		}
+		var buffer bytes.Buffer
+		buffer.WriteByte('[')
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			bytes, err := readableBytes(req, val.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(bytes)
+		}
+		buffer.WriteByte(']')
+		return buffer.Bytes(), nil
+	}
+
+	plain, err := json.Marshal(val.Interface())
+	record, ok := val.Interface().(Record)
+	if err != nil || !ok || val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return plain, err
+	}
+
+	// Find the fields to leave out, and the related records to filter.
+	src := val.Elem()
+	hidden := []string{}
+	nested := map[string]json.RawMessage{}
+	for _, field := range accessFieldsOf(src.Type()) {
+		if field.key == "" {
+			continue
+		}
+		if !canField(req, record, field, CodeRead) {
+			hidden = append(hidden, field.key)
+			continue
+		}
+		if holdsRecords(field.typ) {
+			if nested[field.key], err = readableBytes(req, field.value(src)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(hidden) == 0 && len(nested) == 0 {
+		return plain, nil
+	}
+
+	// Edit the encoded object. Keys missing from it, like empty fields with
+	// omitempty, stay missing.
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(plain, &object); err != nil || object == nil {
+		return plain, err
+	}
+	for _, key := range hidden {
+		delete(object, key)
+	}
+	for key, value := range nested {
+		if _, ok := object[key]; ok {
+			object[key] = value
+		}
+	}
+	return json.Marshal(object)
+}
+
+// Returns true if values of the type are records or lists of records.
+func holdsRecords(typ reflect.Type) bool {
+	if typ.Implements(recordType) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		return typ.Elem().Kind() != reflect.Uint8 && holdsRecords(typ.Elem())
+	case reflect.Ptr:
+		return holdsRecords(typ.Elem())
+	}
+	return false
+}
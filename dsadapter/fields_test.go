@@ -0,0 +1,116 @@
+package dsadapter
+
+import (
+	// Standard
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Has a field of each tag, and a secret only requests with the "Admin" header
+// may see and change.
+type testMember struct {
+	TestRecord
+	Id           string
+	Email        string
+	Role         string      `dsa:"readonly"`
+	Login        string      `dsa:"createonly"`
+	Password     string      `dsa:"writeonly" datastore:"-"`
+	PasswordHash string      `dsa:"hidden"`
+	Secret       string      `json:"secret"`
+	Friend       *testMember `datastore:"-"`
+}
+
+func (this *testMember) GetId() string   { return this.Id }
+func (this *testMember) SetId(id string) { this.Id = id }
+func (this *testMember) Kind() string    { return "Member" }
+
+func (this *testMember) CanField(req *http.Request, _ int, field string) bool {
+	return field != "Secret" || req.Header.Get("Admin") != ""
+}
+
+func TestReadable(t *testing.T) {
+	state := Setup(Config{Store: NewMemoryStore()})
+	req := testRequest("GET", "/")
+	admin := testRequest("GET", "/")
+	admin.Header.Set("Admin", "true")
+
+	member := &testMember{Id: "one", Role: "admin", Password: "pass", PasswordHash: "hash", Secret: "secret",
+		Friend: &testMember{Id: "two", Role: "user", PasswordHash: "nested"}}
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		value    interface{}
+		included []string
+		excluded []string
+	}{
+		{"record", req, member, []string{`"Role":"admin"`, `"Role":"user"`}, []string{"pass", "hash", "nested", "secret"}},
+		{"collection", req, []*testMember{member}, []string{`"Role":"admin"`}, []string{"hash", "nested"}},
+		{"admin", admin, member, []string{`"secret":"secret"`}, []string{"hash"}},
+	}
+	for _, test := range tests {
+		bytes, err := json.Marshal(state.Readable(test.req, test.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := string(bytes)
+		for _, str := range test.included {
+			if !strings.Contains(body, str) {
+				t.Errorf("%s: expected %s in %s", test.name, str, body)
+			}
+		}
+		for _, str := range test.excluded {
+			if strings.Contains(body, str) {
+				t.Errorf("%s: expected no %s in %s", test.name, str, body)
+			}
+		}
+	}
+}
+
+func TestHandlerFields(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// The application itself may set any field.
+		mustSave(t, state, req, &testMember{Id: "one", Email: "one@example.com", Role: "admin", Login: "one", PasswordHash: "hash", Secret: "secret"})
+		handler := state.Handler("/api")
+
+		rw := testServe(handler, "GET", "/api/members/one", "")
+		read := rw.Body.String()
+		if rw.Code != 200 || strings.Contains(read, "hash") || strings.Contains(read, "secret") || !strings.Contains(read, `"Role":"admin"`) {
+			t.Fatalf("expected the readable fields, got %d: %s", rw.Code, read)
+		}
+
+		tests := []struct {
+			method string
+			url    string
+			body   string
+			code   int
+		}{
+			{"POST", "/api/members", `{"Email":"two@example.com","Role":"admin"}`, 403},
+			{"POST", "/api/members", `{"Email":"two@example.com","Login":"two","Password":"pass"}`, 201},
+			{"PUT", "/api/members/one", read, 200},
+			{"PUT", "/api/members/one", `{"Email":"uno@example.com"}`, 200},
+			{"PUT", "/api/members/one", `{"Login":"uno"}`, 403},
+			{"PATCH", "/api/members/one", `{"Role":"user"}`, 403},
+			{"PATCH", "/api/members/one", `{"secret":"mine"}`, 403},
+			{"PATCH", "/api/members/one", `{"Role":"admin","Email":"one@example.com"}`, 200},
+		}
+		for _, test := range tests {
+			rw := testServe(handler, test.method, test.url, test.body)
+			if rw.Code != test.code {
+				t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.body, test.code, rw.Code, rw.Body)
+			}
+		}
+
+		// Fields the requests may not write keep their stored values.
+		member := &testMember{Id: "one"}
+		expectCode(t, state.Read(req, member), 0)
+		if member.Role != "admin" || member.Login != "one" || member.PasswordHash != "hash" || member.Secret != "secret" {
+			t.Fatalf("expected the protected fields to be kept, got %#v", member)
+		}
+
+		// Patch checks the fields too.
+		expectCode(t, state.Patch(req, &testMember{Id: "one", PasswordHash: "other"}, []string{"PasswordHash"}), 403)
+	})
+}
@@ -0,0 +1,150 @@
+package dsadapter
+
+// Seed fixtures loaded from files.
+
+import (
+	// Standard
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************* Fixtures **********************************/
+
+/**
+ * Reads the fixture files in the given directory and returns the decoded
+ * collections by resource name. Each file is named after a registered
+ * resource and holds a list of records of its type:
+ *
+ *   fixtures/engines.json
+ *   [
+ *     {"Id": "steam", "Name": "Steam"},
+ *     {"Id": "diesel", "Name": "Diesel"}
+ *   ]
+ *
+ * Files are decoded by extension: ".json" is built in, and the config's
+ * FixtureDecoders add more, like ".yaml". Other files and subdirectories are
+ * ignored. JSON fields that don't match the record type are errors, to catch
+ * typos. Each collection is computed after decoding.
+ *
+ * Returns an error naming the file for unknown resources, files that fail to
+ * decode, records without ids and resources with more than one file.
+ */
+func (this *stateInstance) ReadFixtures(dir string) (map[string]interface{}, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	collections := map[string]interface{}{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(info.Name())
+		decode := this.fixtureDecoder(ext)
+		if decode == nil {
+			continue
+		}
+
+		name := strings.TrimSuffix(info.Name(), ext)
+		path := filepath.Join(dir, info.Name())
+		if collections[name] != nil {
+			return nil, errFixture(path, "another file for the same resource was already read")
+		}
+		collection := this.NewCollectionByResource(name)
+		if collection == nil {
+			return nil, errFixture(path, "unknown resource "+name)
+		}
+
+		// Decode the records.
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decode(content, collection); err != nil {
+			return nil, errFixture(path, err.Error())
+		}
+
+		// Seed records are identified by their ids.
+		for i, record := range ToRecords(collection) {
+			if record.GetId() == "" {
+				return nil, errFixture(path, "record "+strconv.Itoa(i)+" has no id")
+			}
+		}
+
+		this.Compute(collection)
+		collections[name] = collection
+	}
+
+	return collections, nil
+}
+
+/**
+ * Reads the fixture files in the given directory like ReadFixtures, and
+ * registers each non-empty collection as a seed set named after its resource,
+ * applied on every Populate. Returns an error if a seed set with that name is
+ * already registered. Call Populate to write them to the store, also in tests:
+ *
+ *   dsa.LoadFixtures("testdata/fixtures")
+ *   dsa.Populate(req)
+ */
+func (this *stateInstance) LoadFixtures(dir string) error {
+	collections, err := this.ReadFixtures(dir)
+	if err != nil {
+		return err
+	}
+
+	// Register in the order of resource names, which is the order of Populate.
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, set := range this.seeds {
+			if set.Name == name {
+				return utils.Error("a seed set named " + name + " is already registered")
+			}
+		}
+	}
+	for _, name := range names {
+		if len(ToRecords(collections[name])) > 0 {
+			this.RegisterSeeds(SeedSet{Name: name, Records: collections[name]})
+		}
+	}
+	return nil
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Returns the decoder for fixture files with the given extension, or nil.
+func (this *stateInstance) fixtureDecoder(ext string) func([]byte, interface{}) error {
+	if decode := this.config.FixtureDecoders[ext]; decode != nil {
+		return decode
+	}
+	if ext == ".json" {
+		return decodeJsonStrict
+	}
+	return nil
+}
+
+// Decodes json, failing on fields that don't match the destination.
+func decodeJsonStrict(content []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+// Makes an error for a fixture file.
+func errFixture(path, msg string) error {
+	return utils.Error("fixture " + path + ": " + msg)
+}
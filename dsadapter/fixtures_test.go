@@ -0,0 +1,89 @@
+package dsadapter
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Decodes lines of ids into engines named after them.
+func decodeTestLines(content []byte, value interface{}) error {
+	engines := value.(*[]*testEngine)
+	for _, id := range strings.Fields(string(content)) {
+		*engines = append(*engines, &testEngine{Id: id, Name: id})
+	}
+	return nil
+}
+
+// Writes the files into a new temporary directory and returns its path.
+func writeTestFixtures(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFixtures(t *testing.T) {
+	decoders := map[string]func([]byte, interface{}) error{".lines": decodeTestLines}
+	forEachStore(t, Config{FixtureDecoders: decoders}, func(t *testing.T, state State, req *http.Request) {
+		dir := writeTestFixtures(t, map[string]string{
+			"depots.json":   `[{"Id": "one", "Name": "north"}, {"Id": "two", "Name": "south"}]`,
+			"engines.lines": "steam diesel",
+			"readme.txt":    "ignored",
+		})
+
+		// Collections are decoded by extension and computed.
+		collections, err := state.ReadFixtures(dir)
+		expectCode(t, err, 0)
+		depots, _ := collections["depots"].(*[]*testDepot)
+		if len(collections) != 2 || depots == nil || len(*depots) != 2 || (*depots)[0].Code != "NORTH" {
+			t.Fatalf("expected two computed depots and the engines, got %#v", collections)
+		}
+
+		// Loaded fixtures are seed sets, written by Populate.
+		expectCode(t, state.LoadFixtures(dir), 0)
+		expectCode(t, state.Populate(req), 0)
+		engines := []*testEngine{}
+		expectCode(t, state.FindAll(req, &engines, nil), 0)
+		if len(engines) != 2 {
+			t.Fatalf("expected the engines to be written, got %#v", engines)
+		}
+		if err := state.LoadFixtures(dir); err == nil {
+			t.Fatal("expected an error for sets loaded twice")
+		}
+	})
+}
+
+func TestFixtureErrors(t *testing.T) {
+	state := Setup(Config{Store: NewMemoryStore()})
+	state.Resources()["depots"] = (*testDepot)(nil)
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		msg   string
+	}{
+		{"unknown field", map[string]string{"depots.json": `[{"Id": "one", "Nmae": "north"}]`}, "Nmae"},
+		{"missing id", map[string]string{"depots.json": `[{"Name": "north"}]`}, "depots.json"},
+		{"unknown resource", map[string]string{"sheds.json": `[]`}, "sheds.json"},
+		{"malformed file", map[string]string{"depots.json": `{`}, "depots.json"},
+	}
+	for _, test := range tests {
+		_, err := state.ReadFixtures(writeTestFixtures(t, test.files))
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", test.name, test.msg, err)
+		}
+	}
+
+	if _, err := state.ReadFixtures(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing directory to fail, got %v", err)
+	}
+}
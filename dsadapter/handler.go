@@ -0,0 +1,359 @@
+package dsadapter
+
+// REST handler generated from the registered resources.
+
+import (
+	// Standard
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/********************************** Handler **********************************/
+
+/**
+ * Returns an http.Handler that serves every registered resource as a JSON
+ * REST endpoint under the given path prefix:
+ *
+ *   GET    <prefix>/<resource>        -> FindByQuery
+ *   POST   <prefix>/<resource>        -> Save (create)
+ *   GET    <prefix>/<resource>/<id>   -> Read
+ *   PUT    <prefix>/<resource>/<id>   -> Save (replace, 404 if missing)
+ *   PATCH  <prefix>/<resource>/<id>   -> PatchJson
+ *   DELETE <prefix>/<resource>/<id>   -> Delete
+ *
+ * Permissions are enforced by the state methods, which call Record#Can.
+ * Errors are sent with the status from ErrorCode as {"error": "<message>"},
+ * plus "code" and "details" for an *HTTPError; a ValidationError is sent as
+ * {"errors": {"<field>": "<message>"}} with 422. Other 500 errors are logged
+ * and sent with a generic message.
+ * List responses carry the next page cursor, if any, in the X-Next-Cursor
+ * header.
+ *
+ * For Versioned records, single record responses carry the version as an
+ * ETag, and PUT, PATCH and DELETE honor an If-Match header with that ETag:
+ * if the stored version differs, the request fails with 409 and changes
+ * nothing. Without If-Match, PUT uses the version from the body, and PATCH and
+ * DELETE skip the check.
+ *
+ * Both GET routes load the relations listed in an `include` query param, like
+ * `?include=author,comments.author`. See Related.
+ *
+ * Responses leave out the fields that the request may not read. POST, PUT and
+ * PATCH fail with 403 if they change fields that the request may not write;
+ * PUT keeps the stored values of such fields if the body leaves them out. See
+ * `fields.go`.
+ */
+func (this *stateInstance) Handler(prefix string) http.Handler {
+	return &resourceHandler{state: this, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// A type that implements http.Handler for the resources of a state.
+type resourceHandler struct {
+	state  *stateInstance
+	prefix string
+}
+
+// Routes the request to the matching state method.
+func (this *resourceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Split the path into the resource name and the id.
+	path := req.URL.Path
+	if !strings.HasPrefix(path, this.prefix+"/") {
+		this.sendError(rw, req, err404)
+		return
+	}
+	parts := strings.Split(strings.Trim(path[len(this.prefix):], "/"), "/")
+	if len(parts) > 2 || this.state.Resources()[parts[0]] == nil {
+		this.sendError(rw, req, err404)
+		return
+	}
+	name := parts[0]
+
+	// Collection routes.
+	if len(parts) == 1 {
+		switch req.Method {
+		case "GET", "HEAD":
+			this.list(rw, req, name)
+		case "POST":
+			this.create(rw, req, name)
+		default:
+			rw.Header().Set("Allow", "GET, HEAD, POST")
+			this.sendError(rw, req, err405)
+		}
+		return
+	}
+
+	// Record routes.
+	id := parts[1]
+	switch req.Method {
+	case "GET", "HEAD":
+		this.read(rw, req, name, id)
+	case "PUT":
+		this.replace(rw, req, name, id)
+	case "PATCH":
+		this.patch(rw, req, name, id)
+	case "DELETE":
+		this.delete(rw, req, name, id)
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		this.sendError(rw, req, err405)
+	}
+}
+
+/*--------------------------------- Routes ----------------------------------*/
+
+// Sends the records that match the URL query.
+func (this *resourceHandler) list(rw http.ResponseWriter, req *http.Request, name string) {
+	collection := this.state.NewCollectionByResource(name)
+	cursor, err := this.state.FindByQuery(req, collection)
+	if err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+
+	if cursor != "" {
+		rw.Header().Set("X-Next-Cursor", cursor)
+	}
+
+	// Send an empty list rather than null.
+	if len(ToRecords(collection)) == 0 {
+		this.sendJson(rw, req, 200, []interface{}{})
+		return
+	}
+	this.sendJson(rw, req, 200, this.state.Readable(req, collection))
+}
+
+// Creates a new record from the request body. Any id or version in the body is
+// ignored.
+func (this *resourceHandler) create(rw http.ResponseWriter, req *http.Request, name string) {
+	record := this.state.NewRecordByResource(name)
+	if _, err := this.parseJson(req, record); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	record.SetId("")
+	if versioned, ok := record.(Versioned); ok {
+		versioned.SetVersion(0)
+	}
+
+	// Check the fields before computing them.
+	if err := this.state.CheckWrites(req, record, nil); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	this.state.Compute(record)
+
+	if err := this.state.Save(req, record); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	this.sendRecord(rw, req, 201, record)
+}
+
+// Sends the record with the given id.
+func (this *resourceHandler) read(rw http.ResponseWriter, req *http.Request, name, id string) {
+	record := this.state.NewRecordByResource(name)
+	record.SetId(id)
+
+	// Read the record with the requested relations, loaded before computing it.
+	includes := []string{}
+	for _, value := range req.URL.Query()["include"] {
+		includes = append(includes, splitList(value)...)
+	}
+	if err := this.state.readMulti(req, []Record{record}, includes); err != nil {
+		if multiErr, ok := err.(MultiError); ok {
+			err = multiErr[0]
+		}
+		this.sendError(rw, req, err)
+		return
+	}
+	this.sendRecord(rw, req, 200, record)
+}
+
+// Replaces the stored record with the given id with the request body. Returns
+// 404 if there's no such record: records are created with POST.
+func (this *resourceHandler) replace(rw http.ResponseWriter, req *http.Request, name, id string) {
+	record := this.state.NewRecordByResource(name)
+	body, err := this.parseJson(req, record)
+	if err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	record.SetId(id)
+
+	// An If-Match header takes precedence over the version in the body.
+	if err := this.ifMatch(req, record); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+
+	// Check that the record is stored and visible, keep the fields the request
+	// may not write, and check the others against the stored record, in the
+	// same transaction as the write if the store supports them.
+	err = this.state.atomically(req, func(state *stateInstance) error {
+		stored := newRecordLike(record)
+		if err := state.Store().Get(req, stored); err != nil {
+			return notFound(err)
+		}
+		if isDeleted(stored) {
+			return err404
+		}
+		if err := checkScope(req, stored); err != nil {
+			return err
+		}
+
+		if err := state.keepFields(req, record, body); err != nil {
+			return err
+		}
+		state.Compute(record)
+		return state.Save(req, record)
+	})
+	if err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	this.sendRecord(rw, req, 200, record)
+}
+
+// Applies the request body to the record with the given id as a JSON merge
+// patch. Fields missing from the body keep their stored values.
+func (this *resourceHandler) patch(rw http.ResponseWriter, req *http.Request, name, id string) {
+	doc, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		this.sendError(rw, req, errJson.Wrap(err))
+		return
+	}
+
+	record := this.state.NewRecordByResource(name)
+	record.SetId(id)
+
+	// Patch checks the version only if there's an If-Match header.
+	if err := this.ifMatch(req, record); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+
+	if err := this.state.PatchJson(req, record, doc); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	this.sendRecord(rw, req, 200, record)
+}
+
+// Deletes the record with the given id. With an If-Match header, checks the
+// stored version first, in the same transaction if the store supports them.
+func (this *resourceHandler) delete(rw http.ResponseWriter, req *http.Request, name, id string) {
+	record := this.state.NewRecordByResource(name)
+	record.SetId(id)
+
+	if err := this.ifMatch(req, record); err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+
+	err := this.state.atomically(req, func(state *stateInstance) error {
+		if versioned, ok := record.(Versioned); ok && versioned.GetVersion() != 0 {
+			stored := state.NewRecordByResource(name)
+			stored.SetId(id)
+			if err := state.Store().Get(req, stored); err != nil {
+				return notFound(err)
+			}
+			if version := stored.(Versioned).GetVersion(); version != versioned.GetVersion() {
+				return errStale(version)
+			}
+		}
+		return state.Delete(req, record)
+	})
+	if err != nil {
+		this.sendError(rw, req, err)
+		return
+	}
+	rw.WriteHeader(204)
+}
+
+/*-------------------------------- Utilities --------------------------------*/
+
+// Decodes the request body into the record and returns the body. Doesn't
+// compute the record, so its fields can be checked as the client sent them.
+func (this *resourceHandler) parseJson(req *http.Request, record Record) ([]byte, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errJson.Wrap(err)
+	}
+	if err := json.Unmarshal(body, record); err != nil {
+		return nil, errJson
+	}
+	return body, nil
+}
+
+// Sets the version from the If-Match header on a Versioned record. Does
+// nothing for other records and when the header is missing or "*".
+func (this *resourceHandler) ifMatch(req *http.Request, record Record) error {
+	versioned, ok := record.(Versioned)
+	if !ok {
+		return nil
+	}
+	version, ok, err := parseIfMatch(req.Header.Get("If-Match"))
+	if err != nil {
+		return err
+	}
+	if ok {
+		versioned.SetVersion(version)
+	}
+	return nil
+}
+
+// Sends the record as json with the given status code, without the fields that
+// the request may not read. A Versioned record's version is sent as the ETag.
+func (this *resourceHandler) sendRecord(rw http.ResponseWriter, req *http.Request, code int, record Record) {
+	if versioned, ok := record.(Versioned); ok {
+		rw.Header().Set("ETag", etag(versioned.GetVersion()))
+	}
+	this.sendJson(rw, req, code, this.state.Readable(req, record))
+}
+
+// Sends the value as json with the given status code.
+func (this *resourceHandler) sendJson(rw http.ResponseWriter, req *http.Request, code int, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		this.state.log(req, "-- failed to encode json:", err)
+		rw.WriteHeader(500)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	if req.Method != "HEAD" {
+		rw.Write(bytes)
+	}
+}
+
+// Sends the error as json with the status code from ErrorCode. See errorBody.
+func (this *resourceHandler) sendError(rw http.ResponseWriter, req *http.Request, err error) {
+	code := ErrorCode(err)
+	if code == 500 {
+		this.state.log(req, "-- error in resource handler:", err)
+	}
+	this.sendJson(rw, req, code, errorBody(err))
+}
+
+// Returns the json body for an error. A ValidationError is sent with its field
+// messages, and an *HTTPError with its code and details. Other errors are sent
+// as {"error": <message>}, except for 500 errors, whose messages may expose
+// internals like SQL. Those get a generic message; sendError logs them.
+func errorBody(err error) interface{} {
+	var verr ValidationError
+	if errors.As(err, &verr) {
+		return verr
+	}
+	var herr *HTTPError
+	if errors.As(err, &herr) {
+		return herr
+	}
+	if ErrorCode(err) == 500 {
+		return err500
+	}
+	return map[string]string{"error": err.Error()}
+}
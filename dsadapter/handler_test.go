@@ -0,0 +1,138 @@
+package dsadapter
+
+import (
+	// Standard
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends a request with the given body to the handler and returns the response.
+func testServe(handler http.Handler, method, url, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+// Decodes the response body, failing the test if it's not the expected json.
+func decodeBody(t *testing.T, rw *httptest.ResponseRecorder, value interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rw.Body.Bytes(), value); err != nil {
+		t.Fatalf("expected a json body, got %q: %v", rw.Body.String(), err)
+	}
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		handler := state.Handler("/api/")
+
+		// Create a record to use below.
+		rw := testServe(handler, "POST", "/api/engines", `{"Id":"ignored","Name":"Zugelgeheiner"}`)
+		if rw.Code != 201 {
+			t.Fatalf("expected 201, got %d: %s", rw.Code, rw.Body)
+		}
+		engine := &testEngine{}
+		decodeBody(t, rw, engine)
+		if engine.Id == "" || engine.Id == "ignored" {
+			t.Fatalf("expected a generated id, got %q", engine.Id)
+		}
+		path := "/api/engines/" + engine.Id
+
+		tests := []struct {
+			method  string
+			url     string
+			body    string
+			headers []string
+			code    int
+		}{
+			{"GET", "/api/engines", "", nil, 200},
+			{"GET", path, "", nil, 200},
+			{"HEAD", path, "", nil, 200},
+			{"GET", "/api/engines/missing", "", nil, 404},
+			{"GET", "/api/sleepers", "", nil, 404},
+			{"GET", "/elsewhere/engines", "", nil, 404},
+			{"GET", path + "/more", "", nil, 404},
+			{"GET", "/api/engines?Wheels=1", "", nil, 400},
+			{"GET", path, "", []string{"Forbid", "true"}, 403},
+			{"POST", "/api/engines", `{"Name":`, nil, 400},
+			{"POST", "/api/engines", `{}`, nil, 422},
+			{"POST", path, `{}`, nil, 405},
+			{"PUT", path, `{"Name":"Replaced"}`, nil, 200},
+			{"PUT", path, `{}`, nil, 422},
+			{"PUT", "/api/engines/missing", `{"Name":"Created"}`, nil, 404},
+			{"PATCH", path, `{"Cars":2}`, nil, 200},
+			{"PATCH", path, `{"Cars":`, nil, 400},
+			{"PATCH", "/api/engines/missing", `{"Cars":2}`, nil, 404},
+			{"DELETE", "/api/engines", "", nil, 405},
+			{"DELETE", path, "", []string{"Forbid", "true"}, 403},
+			{"DELETE", path, "", nil, 204},
+			{"DELETE", path, "", nil, 404},
+		}
+		for _, test := range tests {
+			rw := testServe(handler, test.method, test.url, test.body, test.headers...)
+			if rw.Code != test.code {
+				t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.url, test.code, rw.Code, rw.Body)
+			}
+		}
+
+		// PUT doesn't create records.
+		expectCode(t, state.Read(req, &testEngine{Id: "missing"}), 404)
+	})
+}
+
+func TestHandlerBodies(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		handler := state.Handler("/api")
+		for _, name := range []string{"one", "two", "three"} {
+			mustSave(t, state, req, &testEngine{Name: name})
+		}
+
+		// Lists are paged through the cursor header.
+		rw := testServe(handler, "GET", "/api/engines?limit=2", "")
+		engines := []*testEngine{}
+		decodeBody(t, rw, &engines)
+		cursor := rw.Header().Get("X-Next-Cursor")
+		if len(engines) != 2 || cursor == "" {
+			t.Fatalf("expected a page of 2 and a cursor, got %d and %q", len(engines), cursor)
+		}
+		rw = testServe(handler, "GET", "/api/engines?limit=2&cursor="+cursor, "")
+		decodeBody(t, rw, &engines)
+		if len(engines) != 1 || rw.Header().Get("X-Next-Cursor") != "" {
+			t.Fatalf("expected a last page of 1, got %d", len(engines))
+		}
+
+		// Empty lists are sent as [].
+		rw = testServe(handler, "GET", "/api/engines?Name=none", "")
+		if body := strings.TrimSpace(rw.Body.String()); body != "[]" {
+			t.Fatalf("expected an empty list, got %s", body)
+		}
+
+		// Validation errors are sent per field.
+		rw = testServe(handler, "POST", "/api/engines", `{}`)
+		errs := map[string]map[string]string{}
+		decodeBody(t, rw, &errs)
+		if errs["errors"]["Name"] == "" {
+			t.Fatalf("expected a message for the name, got %s", rw.Body)
+		}
+
+		// Other errors are sent with their code.
+		rw = testServe(handler, "GET", "/api/engines/missing", "")
+		body := map[string]interface{}{}
+		decodeBody(t, rw, &body)
+		if body["code"] != "not_found" {
+			t.Fatalf("expected a not_found code, got %s", rw.Body)
+		}
+
+		// Other 500 errors don't expose their messages.
+		if body := errorBody(errors.New("no such table: Engine")); body != err500 {
+			t.Fatalf("expected a generic error, got %v", body)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package dsadapter
+
+// Optional lifecycle hooks on records.
+
+import (
+	// Standard
+	"net/http"
+)
+
+/*********************************** Hooks ***********************************/
+
+/**
+ * Records may implement any of the interfaces below to run code at fixed
+ * points of their lifecycle, like setting timestamps, making slugs or
+ * deleting dependent records. A hook that returns an error aborts the
+ * operation, and the error is returned as-is.
+ *
+ * Each hook gets the state that runs the operation. Inside RunInTransaction,
+ * that's the transaction's state, so the hook's own reads and writes are part
+ * of the transaction and are rolled back with it. Outside of a transaction,
+ * the store writes done before a failing hook stay.
+ */
+
+// BeforeSaver is called by Save, SaveMulti, Patch and PatchJson after the
+// permission check and before validation. For a new record, the id is still
+// empty. May change the record.
+type BeforeSaver interface {
+	BeforeSave(*http.Request, State) error
+}
+
+// AfterSaver is called by Save, SaveMulti, Patch and PatchJson after the
+// record is written to the store.
+type AfterSaver interface {
+	AfterSave(*http.Request, State) error
+}
+
+// BeforeDeleter is called by Delete and DeleteMulti after the permission
+// check and before the record is deleted. The record holds only what the
+// caller passed, usually just the id.
+type BeforeDeleter interface {
+	BeforeDelete(*http.Request, State) error
+}
+
+// AfterReader is called by Read, ReadMulti, FindOne and Find after a record is
+// read from the store and computed.
+type AfterReader interface {
+	AfterRead(*http.Request, State) error
+}
+
+/********************************* Utilities *********************************/
+
+// Calls the record's BeforeSave hook, if any.
+func (this *stateInstance) beforeSave(req *http.Request, record Record) error {
+	if hook, ok := record.(BeforeSaver); ok {
+		return hook.BeforeSave(req, this)
+	}
+	return nil
+}
+
+// Calls the record's AfterSave hook, if any.
+func (this *stateInstance) afterSave(req *http.Request, record Record) error {
+	if hook, ok := record.(AfterSaver); ok {
+		return hook.AfterSave(req, this)
+	}
+	return nil
+}
+
+// Calls the record's BeforeDelete hook, if any.
+func (this *stateInstance) beforeDelete(req *http.Request, record Record) error {
+	if hook, ok := record.(BeforeDeleter); ok {
+		return hook.BeforeDelete(req, this)
+	}
+	return nil
+}
+
+// Calls the record's AfterRead hook, if any.
+func (this *stateInstance) afterRead(req *http.Request, record Record) error {
+	if hook, ok := record.(AfterReader); ok {
+		return hook.AfterRead(req, this)
+	}
+	return nil
+}
+
+// Calls a hook on each record that doesn't have an error in errs yet, writing
+// the failures into errs.
+func (this *stateInstance) hookMulti(req *http.Request, records []Record, errs MultiError,
+	hook func(*stateInstance, *http.Request, Record) error) {
+	for i, record := range records {
+		if errs[i] == nil {
+			errs[i] = hook(this, req, record)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package dsadapter
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var errTestHook = errors.New("hook failed")
+
+// Has every hook. Names starting with "before" or "after" make the hooks of
+// that stage fail; deleting a signal deletes the engine with the same id.
+type testSignal struct {
+	TestRecord
+	Id    string
+	Name  string
+	Slug  string
+	Reads int `datastore:"-"`
+}
+
+func (this *testSignal) GetId() string   { return this.Id }
+func (this *testSignal) SetId(id string) { this.Id = id }
+func (this *testSignal) Kind() string    { return "Signal" }
+
+func (this *testSignal) BeforeSave(*http.Request, State) error {
+	if strings.HasPrefix(this.Name, "before") {
+		return errTestHook
+	}
+	this.Slug = strings.ToLower(this.Name)
+	return nil
+}
+
+func (this *testSignal) AfterSave(*http.Request, State) error {
+	if strings.HasPrefix(this.Name, "after") {
+		return errTestHook
+	}
+	return nil
+}
+
+func (this *testSignal) BeforeDelete(req *http.Request, state State) error {
+	if strings.HasPrefix(this.Name, "before") {
+		return errTestHook
+	}
+	err := state.Delete(req, &testEngine{Id: this.Id})
+	if ErrorCode(err) == 404 {
+		return nil
+	}
+	return err
+}
+
+func (this *testSignal) AfterRead(*http.Request, State) error {
+	this.Reads++
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// BeforeSave may change the record before it's written.
+		signal := &testSignal{Name: "Home"}
+		mustSave(t, state, req, signal)
+		read := &testSignal{Id: signal.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Slug != "home" || read.Reads != 1 {
+			t.Fatalf("expected the slug and one read, got %#v", read)
+		}
+
+		// A failing BeforeSave keeps the record from being written; a failing
+		// AfterSave runs after the write.
+		if err := state.Save(req, &testSignal{Id: "before", Name: "before"}); err != errTestHook {
+			t.Fatalf("expected the hook's error, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testSignal{Id: "before"}), 404)
+		if err := state.Save(req, &testSignal{Id: "after", Name: "after"}); err != errTestHook {
+			t.Fatalf("expected the hook's error, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testSignal{Id: "after"}), 0)
+
+		// Only the failing records of a batch fail.
+		err := state.SaveMulti(req, []*testSignal{{Name: "Yard"}, {Name: "before"}})
+		multiErr, _ := err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || multiErr[1] != errTestHook {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+
+		// AfterRead runs for every found record.
+		signals := []*testSignal{}
+		expectCode(t, state.FindAll(req, &signals, nil), 0)
+		for _, signal := range signals {
+			if signal.Reads != 1 {
+				t.Fatalf("expected one read of each record, got %#v", signal)
+			}
+		}
+
+		// A failing BeforeDelete keeps the record.
+		if err := state.Delete(req, &testSignal{Id: "before", Name: "before"}); err != errTestHook {
+			t.Fatalf("expected the hook's error, got %v", err)
+		}
+	})
+}
+
+func TestHooksInTransactions(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testSignal{Id: "one", Name: "one"}, &testEngine{Id: "one", Name: "one"})
+
+		// The writes of hooks are rolled back with the transaction.
+		failure := errors.New("failure")
+		err := state.RunInTransaction(req, func(tx State) error {
+			expectCode(t, tx.Delete(req, &testSignal{Id: "one"}), 0)
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("expected the function's error, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testEngine{Id: "one"}), 0)
+
+		expectCode(t, state.Delete(req, &testSignal{Id: "one"}), 0)
+		expectCode(t, state.Read(req, &testEngine{Id: "one"}), 404)
+	})
+}
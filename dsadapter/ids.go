@@ -0,0 +1,233 @@
+package dsadapter
+
+// Random id generators and the creation of records with generated ids. The
+// generators read crypto/rand, so ids can't be guessed; pass one as the
+// config's RndId to use it for new records. They panic if the secure random
+// source fails.
+
+import (
+	// Standard
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/******************************** Generators *********************************/
+
+// Makes a random version 4 UUID, like "0b0f2b3e-6a5d-4c1e-9f3a-2d7c1e0b9a44":
+// 122 random bits.
+func UUIDv4() string {
+	id := randomBytes(16)
+	setUUIDVersion(id, 4)
+	return formatUUID(id)
+}
+
+// Makes a version 7 UUID, like "01890a5d-ac96-7c3e-9f3a-2d7c1e0b9a44": the
+// Unix time in milliseconds followed by 74 random bits. Ids sort by creation
+// time as strings, to the millisecond, which keeps new records together in
+// indexes.
+func UUIDv7() string {
+	id := randomBytes(16)
+	putMillis(id, time.Now())
+	setUUIDVersion(id, 7)
+	return formatUUID(id)
+}
+
+// Makes a ULID, like "01H4ZB3ZQ8E0T6V1Y2K9M3N7PQ": the Unix time in
+// milliseconds followed by 80 random bits, as 26 characters of Crockford's
+// base32. Ids sort by creation time as strings, to the millisecond.
+func ULID() string {
+	id := randomBytes(16)
+	putMillis(id, time.Now())
+	return encodeCrockford(id)
+}
+
+// Makes a short URL-safe id, like "q3Zt0Vb_Xk2mP9aL": 96 random bits as 16
+// characters of unpadded base64url.
+func ShortId() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(12))
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Number of times to write a record whose generated id turns out to be taken,
+// with a new id each time.
+const idAttempts = 3
+
+// Crockford's base32 alphabet, without I, L, O and U.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Returns n bytes from the secure random source.
+func randomBytes(n int) []byte {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		panic("dsadapter: failed to read random bytes: " + err.Error())
+	}
+	return bytes
+}
+
+// Writes the time in milliseconds into the first 6 bytes, big-endian.
+func putMillis(id []byte, at time.Time) {
+	var millis [8]byte
+	binary.BigEndian.PutUint64(millis[:], uint64(at.UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], millis[2:])
+}
+
+// Sets the version and the RFC 4122 variant bits of a UUID.
+func setUUIDVersion(id []byte, version byte) {
+	id[6] = id[6]&0x0f | version<<4
+	id[8] = id[8]&0x3f | 0x80
+}
+
+// Formats 16 bytes as a UUID string.
+func formatUUID(id []byte) string {
+	text := hex.EncodeToString(id)
+	return text[:8] + "-" + text[8:12] + "-" + text[12:16] + "-" + text[16:20] + "-" + text[20:]
+}
+
+// Encodes 16 bytes as 26 characters of Crockford's base32. The 128 bits are
+// padded with 2 leading zero bits, so the encoding sorts like the bytes.
+func encodeCrockford(id []byte) string {
+	text := make([]byte, 26)
+	var acc uint
+	bits := 0
+	pos := len(text) - 1
+
+	// Take 5 bits at a time from the end.
+	for i := len(id) - 1; i >= 0; i-- {
+		acc |= uint(id[i]) << uint(bits)
+		bits += 8
+		for bits >= 5 {
+			text[pos] = crockfordAlphabet[acc&31]
+			acc >>= 5
+			bits -= 5
+			pos--
+		}
+	}
+	// The 3 bits left make the first character.
+	text[0] = crockfordAlphabet[acc&31]
+	return string(text)
+}
+
+/********************************* Creation **********************************/
+
+// Writes the records with putMulti. Records whose indexes are in generated got
+// generated ids, and must be in fresh too; if one turns out to be taken, the
+// record gets a new id and is written again, up to idAttempts times in all. A
+// record that runs out of attempts fails with ErrExists, like other fresh
+// records whose ids are taken. Returns an error only if the whole batch
+// failed.
+func (this *stateInstance) putGenerated(req *http.Request, records []Record, errs MultiError, fresh, generated map[int]bool) error {
+	if err := this.putMulti(req, records, errs, fresh); err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt < idAttempts; attempt++ {
+		// Give new ids to the records whose ids were taken.
+		indexes := []int{}
+		retries := []Record{}
+		retryFresh := map[int]bool{}
+		for i, record := range records {
+			if !generated[i] || !errors.Is(errs[i], ErrExists) {
+				continue
+			}
+			record.SetId(this.RndId())
+			retryFresh[len(retries)] = true
+			indexes = append(indexes, i)
+			retries = append(retries, record)
+		}
+		if len(retries) == 0 {
+			return nil
+		}
+		this.log(req, "-- generated ids were taken, retrying records:", len(retries))
+
+		// Write them again.
+		retryErrs := make(MultiError, len(retries))
+		if err := this.putMulti(req, retries, retryErrs, retryFresh); err != nil {
+			return err
+		}
+		for j, i := range indexes {
+			errs[i] = retryErrs[j]
+		}
+	}
+	return nil
+}
+
+// Reads the stored copies of the fresh records that don't have an error in
+// errs yet and that checkVersions or claimUnique would read, and writes
+// ErrExists into errs for those that exist. Otherwise those checks would take
+// a record with a taken id for an update of the stored one.
+func (this *stateInstance) checkFresh(req *http.Request, records []Record, errs MultiError, fresh map[int]bool) error {
+	skip := utils.Error("skip")
+	stored := make([]Record, len(records))
+	results := make(MultiError, len(records))
+	for i, record := range records {
+		_, versioned := record.(Versioned)
+		claims := !this.enforcesUnique() && len(uniqueIndexes(record)) > 0
+		if !fresh[i] || errs[i] != nil || (!versioned && !claims) {
+			results[i] = skip
+			continue
+		}
+		stored[i] = newRecordLike(record)
+	}
+
+	if err := this.multi(req, stored, results, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return err
+	}
+
+	for i := range records {
+		if results[i] == skip {
+			continue
+		}
+		if results[i] == nil {
+			errs[i] = errExists(records[i].GetId())
+		} else if ErrorCode(results[i]) != 404 {
+			errs[i] = results[i]
+		}
+	}
+	return nil
+}
+
+// Writes the records that don't have an error in errs yet, like multi with
+// Store.Put. If the store is a CreateStore, the records whose indexes are in
+// fresh are written with Create instead, one by one.
+func (this *stateInstance) writeMulti(req *http.Request, records []Record, errs MultiError, fresh map[int]bool) error {
+	creator, ok := this.Store().(CreateStore)
+	if !ok || len(fresh) == 0 {
+		return this.multi(req, records, errs, BatchStore.PutMulti, Store.Put, nil)
+	}
+
+	// Put the other records, keeping the fresh ones aside.
+	skip := utils.Error("skip")
+	results := append(MultiError{}, errs...)
+	for i := range records {
+		if fresh[i] && results[i] == nil {
+			results[i] = skip
+		}
+	}
+	if err := this.multi(req, records, results, BatchStore.PutMulti, Store.Put, nil); err != nil {
+		return err
+	}
+
+	// Create the fresh records.
+	for i, record := range records {
+		if results[i] != skip {
+			continue
+		}
+		err := creator.Create(req, record)
+		if errors.Is(err, ErrExists) {
+			err = errExists(record.GetId())
+		}
+		results[i] = err
+	}
+
+	copy(errs, results)
+	return nil
+}
@@ -0,0 +1,80 @@
+package dsadapter
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIdFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      func() string
+		pattern string
+	}{
+		{"UUIDv4", UUIDv4, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"UUIDv7", UUIDv7, `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"ULID", ULID, `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`},
+		{"ShortId", ShortId, `^[0-9A-Za-z_-]{16}$`},
+	}
+	for _, test := range tests {
+		pattern := regexp.MustCompile(test.pattern)
+		seen := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			id := test.fn()
+			if !pattern.MatchString(id) || seen[id] {
+				t.Fatalf("%s: expected unique ids matching %s, got %q", test.name, test.pattern, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	// Time-based ids sort by creation time.
+	for name, fn := range map[string]func() string{"UUIDv7": UUIDv7, "ULID": ULID} {
+		first := fn()
+		time.Sleep(2 * time.Millisecond)
+		if second := fn(); second <= first {
+			t.Errorf("%s: expected %q to sort after %q", name, second, first)
+		}
+	}
+}
+
+func TestTakenIds(t *testing.T) {
+	// Hands out the queued ids, then random ones.
+	queue := []string{}
+	rndId := func() string {
+		if len(queue) == 0 {
+			return ShortId()
+		}
+		id := queue[0]
+		queue = queue[1:]
+		return id
+	}
+
+	forEachStore(t, Config{RndId: rndId}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testEngine{Id: "taken", Name: "first"})
+
+		// A taken id is replaced.
+		queue = []string{"taken", "free"}
+		engine := &testEngine{Name: "second"}
+		mustSave(t, state, req, engine)
+		if engine.Id != "free" {
+			t.Fatalf("expected the second id, got %q", engine.Id)
+		}
+		read := &testEngine{Id: "taken"}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Name != "first" {
+			t.Fatalf("expected the first record to be kept, got %#v", read)
+		}
+
+		// Up to a limit.
+		queue = []string{"taken", "taken", "taken", "taken"}
+		if err := state.Save(req, &testEngine{Name: "third"}); !errors.Is(err, ErrExists) {
+			t.Fatalf("expected ErrExists, got %v", err)
+		}
+		queue = nil
+	})
+}
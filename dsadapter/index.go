@@ -0,0 +1,330 @@
+package dsadapter
+
+// Secondary indexes and unique constraints declared on record types.
+
+import (
+	// Standard
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************** Indexes **********************************/
+
+// Index describes an index on some stored properties of a record type.
+type Index struct {
+	// Stored property names, in order.
+	Fields []string
+	// If true, no two records of the kind may have the same values in these
+	// properties, compared all together.
+	Unique bool
+}
+
+// Makes a unique index on the given stored properties.
+func UniqueIndex(fields ...string) Index {
+	return Index{Fields: fields, Unique: true}
+}
+
+/**
+ * Indexed is an optional interface for records that declare indexes:
+ *
+ *   func (this *User) Indexes() []dsa.Index {
+ *     return []dsa.Index{
+ *       dsa.UniqueIndex("Email"),
+ *       {Fields: []string{"Country", "City"}},
+ *     }
+ *   }
+ *
+ * Stores that keep a schema create the indexes in SyncSchema. Unique indexes
+ * are enforced on Save, SaveMulti, Patch and PatchJson: a record whose values
+ * are taken by another record of the kind fails with ErrDuplicate (409).
+ * Values are compared exactly, so normalise them first, for example in a
+ * BeforeSave hook. Zero values count as values too.
+ *
+ * Stores that implement IndexStore enforce unique indexes themselves, like SQL
+ * databases with unique constraints. For other stores, each record claims its
+ * unique values by writing an index entity of the kind "DsaUnique", in the same
+ * transaction as the record if the store supports transactions. Without
+ * transactions, two concurrent saves may still claim the same values.
+ */
+type Indexed interface {
+	Indexes() []Index
+}
+
+/******************************* Unique Claims *******************************/
+
+// Kind of the index entities that claim unique values.
+const uniqueKind = "DsaUnique"
+
+// An index entity. Its id is made from the kind, the index and the values of
+// the owner record.
+type uniqueClaim struct {
+	Id    string
+	Owner string
+}
+
+// Record methods. Claims are managed by the state, not saved on their own.
+func (this *uniqueClaim) Validate(*http.Request) map[string]string { return nil }
+func (this *uniqueClaim) Compute()                                 {}
+func (this *uniqueClaim) Can(*http.Request, int) bool              { return true }
+func (this *uniqueClaim) Save(*http.Request) error                 { return errClaim }
+func (this *uniqueClaim) Read(*http.Request) error                 { return errClaim }
+func (this *uniqueClaim) Delete(*http.Request) error               { return errClaim }
+func (this *uniqueClaim) GetId() string                            { return this.Id }
+func (this *uniqueClaim) SetId(id string)                          { this.Id = id }
+func (this *uniqueClaim) Kind() string                             { return uniqueKind }
+
+// Claims the unique values of the records that don't have an error in errs
+// yet, writing the failures into errs: ErrDuplicate for values claimed by
+// other records. Releases the claims of the values the records had before.
+// Does nothing if the store enforces unique indexes itself. Returns an error
+// only if the whole batch failed.
+func (this *stateInstance) claimUnique(req *http.Request, records []Record, errs MultiError) error {
+	if this.enforcesUnique() {
+		return nil
+	}
+
+	// Read the stored copies, to release the claims of their values.
+	stored, results, err := this.readIndexed(req, records, errs)
+	if err != nil {
+		return err
+	}
+
+	// Claims made in this batch, by claim id, to catch duplicates within it.
+	claimed := map[string]string{}
+
+	for i, record := range records {
+		if stored[i] == nil {
+			continue
+		}
+		var old Record
+		if results[i] == nil {
+			old = stored[i]
+		} else if ErrorCode(results[i]) != 404 {
+			errs[i] = results[i]
+			continue
+		}
+		errs[i] = this.claimRecord(req, record, old, claimed)
+	}
+	return nil
+}
+
+// Releases the claims of the stored copies of the records that don't have an
+// error in errs yet. Does nothing if the store enforces unique indexes itself.
+func (this *stateInstance) releaseUnique(req *http.Request, records []Record, errs MultiError) error {
+	if this.enforcesUnique() {
+		return nil
+	}
+
+	stored, results, err := this.readIndexed(req, records, errs)
+	if err != nil {
+		return err
+	}
+
+	for i, record := range stored {
+		if record == nil || results[i] != nil {
+			continue
+		}
+		for _, index := range uniqueIndexes(record) {
+			id, err := claimId(record, index)
+			if err != nil {
+				return err
+			}
+			if err := this.release(req, id, record.GetId()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/********************************* Utilities *********************************/
+
+// Returns true if the store enforces unique indexes itself.
+func (this *stateInstance) enforcesUnique() bool {
+	store, ok := this.Store().(IndexStore)
+	return ok && store.EnforcesUnique()
+}
+
+// Reads the stored copies of the records that don't have an error in errs yet
+// and have unique indexes. Other entries of the returned slice are nil. The
+// read errors are returned by index.
+func (this *stateInstance) readIndexed(req *http.Request, records []Record, errs MultiError) ([]Record, MultiError, error) {
+	stored := make([]Record, len(records))
+	results := make(MultiError, len(records))
+	for i, record := range records {
+		if errs[i] != nil || len(uniqueIndexes(record)) == 0 {
+			// Any error makes multi skip the record.
+			results[i] = err404
+			continue
+		}
+		stored[i] = newRecordLike(record)
+	}
+
+	if err := this.multi(req, stored, results, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return nil, nil, err
+	}
+	return stored, results, nil
+}
+
+// Claims the unique values of one record, and releases the claims of the old
+// values, if any, that changed. A claim whose owner no longer has the claimed
+// values is stale and taken over.
+func (this *stateInstance) claimRecord(req *http.Request, record, old Record, claimed map[string]string) error {
+	store := this.Store()
+	owner := record.GetId()
+	puts := []Record{}
+	released := []string{}
+
+	for _, index := range uniqueIndexes(record) {
+		id, err := claimId(record, index)
+		if err != nil {
+			return err
+		}
+
+		// Check the claims made in this batch, then the stored one.
+		if other, ok := claimed[id]; ok && other != owner {
+			return errDuplicate(index)
+		}
+		claim := &uniqueClaim{Id: id}
+		err = store.Get(req, claim)
+		if err != nil && ErrorCode(err) != 404 {
+			return err
+		}
+		if err == nil && claim.Owner != owner {
+			held, err := this.holds(req, record, claim.Owner, index, id)
+			if err != nil {
+				return err
+			}
+			if held {
+				return errDuplicate(index)
+			}
+		}
+		if err != nil || claim.Owner != owner {
+			puts = append(puts, &uniqueClaim{Id: id, Owner: owner})
+		}
+		claimed[id] = owner
+
+		// Release the old claim if the values changed.
+		if old != nil {
+			oldId, err := claimId(old, index)
+			if err != nil {
+				return err
+			}
+			if oldId != id {
+				released = append(released, oldId)
+			}
+		}
+	}
+
+	// Write the claims only when all of them are free.
+	for _, claim := range puts {
+		if err := store.Put(req, claim); err != nil {
+			return err
+		}
+	}
+	for _, id := range released {
+		if err := this.release(req, id, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the record with the given id, of the same type as the given
+// record, exists and still has the values behind the claim.
+func (this *stateInstance) holds(req *http.Request, record Record, owner string, index Index, id string) (bool, error) {
+	other := newRecordLike(record)
+	other.SetId(owner)
+	if err := this.Store().Get(req, other); err != nil {
+		if ErrorCode(err) == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	otherId, err := claimId(other, index)
+	return otherId == id, err
+}
+
+// Deletes the claim with the given id if it belongs to the given owner.
+func (this *stateInstance) release(req *http.Request, id, owner string) error {
+	claim := &uniqueClaim{Id: id}
+	if err := this.Store().Get(req, claim); err != nil {
+		if ErrorCode(err) == 404 {
+			return nil
+		}
+		return err
+	}
+	if claim.Owner != owner {
+		return nil
+	}
+	if err := this.Store().Delete(req, claim); err != nil && ErrorCode(err) != 404 {
+		return err
+	}
+	return nil
+}
+
+// Returns true if any of the records has unique indexes.
+func hasUnique(records []Record) bool {
+	for _, record := range records {
+		if len(uniqueIndexes(record)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the unique indexes of the record, if any.
+func uniqueIndexes(record Record) []Index {
+	indexed, ok := record.(Indexed)
+	if !ok {
+		return nil
+	}
+	indexes := []Index{}
+	for _, index := range indexed.Indexes() {
+		if index.Unique {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// Makes the id of the claim of the record's values in the given index: the
+// kind and the index fields, followed by a hash of the values.
+func claimId(record Record, index Index) (string, error) {
+	val, err := recordStruct(record)
+	if err != nil {
+		return "", err
+	}
+
+	values := make([]interface{}, len(index.Fields))
+	for i, name := range index.Fields {
+		prop, ok := propertyByName(val.Type(), name)
+		if !ok {
+			return "", errIndexField(record.Kind(), name)
+		}
+		values[i] = prop.value(val).Interface()
+	}
+
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(bytes)
+	return record.Kind() + ":" + strings.Join(index.Fields, ",") + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// Makes the error for a record whose values in a unique index are taken.
+func errDuplicate(index Index) error {
+	return ErrDuplicate.WithDetails(map[string]interface{}{"fields": index.Fields})
+}
+
+// Makes the error for an index on a property that doesn't exist.
+func errIndexField(kind, name string) error {
+	return utils.Error("unknown property in an index of " + kind + ": " + name)
+}
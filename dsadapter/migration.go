@@ -0,0 +1,359 @@
+package dsadapter
+
+// Schema migrations: numbered transformations of stored records.
+
+import (
+	// Standard
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/******************************** Migrations *********************************/
+
+/**
+ * Migration transforms the stored records of one kind, for example to fill a
+ * new field from an old one:
+ *
+ *   dsa.RegisterMigration(dsadapter.Migration{
+ *     Record: (*Engine)(nil),
+ *     Number: 1,
+ *     Name:   "split Title into Name and Model",
+ *     Migrate: func(req *http.Request, record dsadapter.Record) error {
+ *       engine := record.(*Engine)
+ *       engine.Name, engine.Model = splitTitle(engine.Title)
+ *       return nil
+ *     },
+ *   })
+ *
+ * Records are read with the record type, so a renamed field must stay in the
+ * type until its migration has run everywhere.
+ */
+type Migration struct {
+	// Record of the kind to migrate. May be a nil pointer, like with Resources.
+	Record Record
+	// Position among the migrations of the kind, starting with 1. Migrations of
+	// a kind run in this order, and each runs once.
+	Number int
+	// Human-readable description.
+	Name string
+	// Transforms one stored record in place. The record is computed first. An
+	// error stops the migration; it resumes from the failed batch on the next
+	// run.
+	Migrate func(*http.Request, Record) error
+	// Number of records to read and write at once. If omitted, 100.
+	BatchSize int
+}
+
+// MigrationStatus reports the progress of a migration. It's stored in the
+// "DsaMigration" kind, one entity per migration.
+type MigrationStatus struct {
+	Kind   string
+	Number int
+	Name   string
+	// Number of records migrated so far.
+	Migrated int
+	// True once every record was migrated.
+	Done       bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Message of the error that stopped the last run, if any.
+	Error string
+}
+
+// Registers a migration. Panics if the record is missing, the number isn't
+// positive, or the kind already has a migration with that number.
+func (this *stateInstance) RegisterMigration(migration Migration) {
+	if migration.Record == nil || migration.Number <= 0 || migration.Migrate == nil {
+		panic("dsadapter: a migration needs a record, a positive number and a Migrate func")
+	}
+	kind := migrationKind(migration)
+	for _, other := range this.migrations {
+		if migrationKind(other) == kind && other.Number == migration.Number {
+			panic("dsadapter: duplicate migration " + kind + " " + strconv.Itoa(migration.Number))
+		}
+	}
+	this.migrations = append(this.migrations, migration)
+}
+
+// Returns the registered migrations in the order they run: by kind, then by
+// number.
+func (this *stateInstance) Migrations() []Migration {
+	migrations := append([]Migration{}, this.migrations...)
+	sort.SliceStable(migrations, func(i, j int) bool {
+		one, other := migrationKind(migrations[i]), migrationKind(migrations[j])
+		if one != other {
+			return one < other
+		}
+		return migrations[i].Number < migrations[j].Number
+	})
+	return migrations
+}
+
+// Returns the status of every registered migration, in the order they run.
+func (this *stateInstance) MigrationStatuses(req *http.Request) ([]MigrationStatus, error) {
+	if err := this.syncSchemaOf(req, &migrationRecord{}); err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range this.Migrations() {
+		status, err := this.migrationStatus(req, migration)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status.status())
+	}
+	return statuses, nil
+}
+
+/**
+ * Runs the migrations that aren't done yet, in order. Reads the records of
+ * each kind in batches, passes each record to Migrate and writes the batch
+ * back, together with the migration's progress. If the store supports
+ * transactions, each batch and its progress are written in one, so a failed
+ * run resumes right after the last written batch. Otherwise a failed batch may
+ * be written in part, and runs again; write migrations that are harmless to
+ * repeat.
+ *
+ * Records are written directly: permissions, hooks, validation and timestamps
+ * are skipped. Versioned records get new versions, and a record changed by
+ * someone else during the batch fails it with 409. Unique indexes are checked.
+ * Soft-deleted records are migrated too.
+ *
+ * Calls the progress func, if any, after each batch. Stops at the first error,
+ * which is also recorded in the migration's status.
+ */
+func (this *stateInstance) Migrate(req *http.Request, progress func(MigrationStatus)) error {
+	if err := this.syncSchemaOf(req, &migrationRecord{}); err != nil {
+		return err
+	}
+
+	for _, migration := range this.Migrations() {
+		if err := this.runMigration(req, migration, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Kind of the entities that store migration progress.
+const migrationMetaKind = "DsaMigration"
+
+// Default number of records per batch.
+const migrationBatchSize = 100
+
+// A stored migration status. Versioned, so concurrent runs of the same
+// migration conflict instead of both writing. The fields match those of
+// MigrationStatus, except for the kind, which would clash with the Kind method.
+type migrationRecord struct {
+	Id         string
+	RecordKind string
+	Number     int
+	Name       string
+	Migrated   int
+	Done       bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Error      string
+	// Position after the last migrated batch.
+	Cursor  string
+	Version int64
+}
+
+// Record methods. Migration records are managed by the state.
+func (this *migrationRecord) Validate(*http.Request) map[string]string { return nil }
+func (this *migrationRecord) Compute()                                 {}
+func (this *migrationRecord) Can(*http.Request, int) bool              { return true }
+func (this *migrationRecord) Save(*http.Request) error                 { return errMigration }
+func (this *migrationRecord) Read(*http.Request) error                 { return errMigration }
+func (this *migrationRecord) Delete(*http.Request) error               { return errMigration }
+func (this *migrationRecord) GetId() string                            { return this.Id }
+func (this *migrationRecord) SetId(id string)                          { this.Id = id }
+func (this *migrationRecord) Kind() string                             { return migrationMetaKind }
+func (this *migrationRecord) GetVersion() int64                        { return this.Version }
+func (this *migrationRecord) SetVersion(version int64)                 { this.Version = version }
+
+// Returns the public part of the record.
+func (this *migrationRecord) status() MigrationStatus {
+	return MigrationStatus{
+		Kind:       this.RecordKind,
+		Number:     this.Number,
+		Name:       this.Name,
+		Migrated:   this.Migrated,
+		Done:       this.Done,
+		StartedAt:  this.StartedAt,
+		FinishedAt: this.FinishedAt,
+		Error:      this.Error,
+	}
+}
+
+// Runs one migration batch by batch, unless it's done.
+func (this *stateInstance) runMigration(req *http.Request, migration Migration, progress func(MigrationStatus)) error {
+	status, err := this.migrationStatus(req, migration)
+	if err != nil || status.Done {
+		return err
+	}
+	if status.StartedAt.IsZero() {
+		status.StartedAt = now()
+	}
+	this.log(req, "   running migration:", status.RecordKind, status.Number, status.Name)
+
+	batchSize := migration.BatchSize
+	if batchSize <= 0 {
+		batchSize = migrationBatchSize
+	}
+
+	for !status.Done {
+		// Read the next batch.
+		collection := this.SliceOf(migration.Record)
+		query := Query{Limit: batchSize, Cursor: status.Cursor}
+		cursor, err := this.Store().GetAll(req, status.RecordKind, collection, query)
+		if err != nil {
+			return this.failMigration(req, status, err)
+		}
+		this.Compute(collection)
+		records := ToRecords(collection)
+
+		// Transform the records.
+		for _, record := range records {
+			if err := migration.Migrate(req, record); err != nil {
+				return this.failMigration(req, status, err)
+			}
+		}
+
+		// Write the batch and the progress together. The progress is a copy, so
+		// a failed write leaves the last good one.
+		next := *status
+		next.Cursor = cursor
+		next.Migrated += len(records)
+		next.Error = ""
+		if cursor == "" || len(records) == 0 {
+			next.Done = true
+			next.FinishedAt = now()
+		}
+		err = this.atomically(req, func(state *stateInstance) error {
+			errs := make(MultiError, len(records))
+			if err := state.putMulti(req, records, errs, nil); err != nil {
+				return err
+			}
+			if err := errs.orNil(); err != nil {
+				return err
+			}
+			return state.putOne(req, &next)
+		})
+		if err != nil {
+			return this.failMigration(req, status, err)
+		}
+		status = &next
+
+		if progress != nil {
+			progress(status.status())
+		}
+	}
+
+	this.log(req, "++ finished migration:", status.RecordKind, status.Number, "records:", status.Migrated)
+	return nil
+}
+
+// Reads the stored status of the migration, or makes a new one.
+func (this *stateInstance) migrationStatus(req *http.Request, migration Migration) (*migrationRecord, error) {
+	kind := migrationKind(migration)
+	status := &migrationRecord{Id: kind + ":" + strconv.Itoa(migration.Number)}
+	if err := this.Store().Get(req, status); err != nil && ErrorCode(err) != 404 {
+		return nil, err
+	}
+	status.RecordKind = kind
+	status.Number = migration.Number
+	status.Name = migration.Name
+	return status, nil
+}
+
+// Records the error in the migration's status and returns it.
+func (this *stateInstance) failMigration(req *http.Request, status *migrationRecord, err error) error {
+	this.log(req, "!! migration failed:", status.RecordKind, status.Number, err)
+	failed := *status
+	failed.Error = err.Error()
+	if err := this.putOne(req, &failed); err != nil {
+		this.log(req, "!! failed to record the migration error:", err)
+	}
+	return err
+}
+
+// Writes one record like putMulti, returning its error.
+func (this *stateInstance) putOne(req *http.Request, record Record) error {
+	errs := make(MultiError, 1)
+	if err := this.putMulti(req, []Record{record}, errs, nil); err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// Returns the kind of the migration's records. The record may be a nil
+// pointer, so this asks a new one.
+func migrationKind(migration Migration) string {
+	return reflect.New(reflect.TypeOf(migration.Record).Elem()).Interface().(Record).Kind()
+}
+
+/********************************** Handler **********************************/
+
+/**
+ * Returns an http.Handler that runs migrations and reports their progress:
+ *
+ *   GET   -> the status of every migration, as a json list
+ *   POST  -> runs the pending migrations
+ *
+ * A POST response is streamed as json lines: the status of the migration after
+ * each batch, and a final {"error": <message>} line if a migration failed. The
+ * handler doesn't check permissions, so mount it behind the application's own
+ * authentication:
+ *
+ *   http.Handle("/admin/migrations", requireAdmin(dsa.MigrationHandler()))
+ */
+func (this *stateInstance) MigrationHandler() http.Handler {
+	return &migrationHandler{resourceHandler{state: this}}
+}
+
+// A type that implements http.Handler for migrations. Borrows the json helpers
+// of the resource handler.
+type migrationHandler struct {
+	resourceHandler
+}
+
+// Sends the statuses or runs the migrations.
+func (this *migrationHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		statuses, err := this.state.MigrationStatuses(req)
+		if err != nil {
+			this.sendError(rw, req, err)
+			return
+		}
+		this.sendJson(rw, req, 200, statuses)
+
+	case "POST":
+		rw.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		rw.WriteHeader(200)
+		encoder := json.NewEncoder(rw)
+		flusher, _ := rw.(http.Flusher)
+
+		err := this.state.Migrate(req, func(status MigrationStatus) {
+			encoder.Encode(status)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		if err != nil {
+			encoder.Encode(errorBody(err))
+		}
+
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		this.sendError(rw, req, err405)
+	}
+}
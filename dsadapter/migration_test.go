@@ -0,0 +1,110 @@
+package dsadapter
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		for i := 0; i < 25; i++ {
+			mustSave(t, state, req, &testTrain{Name: "train " + strconv.Itoa(i)})
+		}
+
+		// Registered out of order; they run by number. The first one fails on
+		// one record until told otherwise.
+		failure := errors.New("failure")
+		fail, calls := true, 0
+		state.RegisterMigration(Migration{Record: (*testTrain)(nil), Number: 2, Name: "shout", BatchSize: 10,
+			Migrate: func(_ *http.Request, record Record) error {
+				train := record.(*testTrain)
+				train.Name = strings.ToUpper(train.Name)
+				return nil
+			}})
+		state.RegisterMigration(Migration{Record: (*testTrain)(nil), Number: 1, Name: "exclaim", BatchSize: 10,
+			Migrate: func(_ *http.Request, record Record) error {
+				calls++
+				train := record.(*testTrain)
+				if fail && train.Name == "train 15" {
+					return failure
+				}
+				train.Name += "!"
+				return nil
+			}})
+
+		// Numbers must be unique within a kind.
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a panic for a taken number")
+				}
+			}()
+			state.RegisterMigration(Migration{Record: (*testTrain)(nil), Number: 1, Migrate: func(*http.Request, Record) error { return nil }})
+		}()
+
+		// A failure stops the run and is recorded.
+		if err := state.Migrate(req, nil); err != failure {
+			t.Fatalf("expected the migration's error, got %v", err)
+		}
+		statuses, err := state.MigrationStatuses(req)
+		expectCode(t, err, 0)
+		if len(statuses) != 2 || statuses[0].Name != "exclaim" || statuses[0].Done || statuses[0].Error != failure.Error() || statuses[1].Done {
+			t.Fatalf("expected the first migration to have failed, got %+v", statuses)
+		}
+
+		// The next run resumes from the failed batch, reporting each batch.
+		fail = false
+		batches := 0
+		expectCode(t, state.Migrate(req, func(MigrationStatus) { batches++ }), 0)
+		if batches == 0 {
+			t.Fatal("expected progress reports")
+		}
+		trains := []*testTrain{}
+		expectCode(t, state.FindAll(req, &trains, nil), 0)
+		for _, train := range trains {
+			if !strings.HasPrefix(train.Name, "TRAIN ") || strings.Count(train.Name, "!") != 1 || train.Version < 2 {
+				t.Fatalf("expected each record to be migrated once by each migration, got %#v", train)
+			}
+		}
+		statuses, err = state.MigrationStatuses(req)
+		expectCode(t, err, 0)
+		if !statuses[0].Done || statuses[0].Error != "" || !statuses[1].Done || statuses[1].Migrated != 25 {
+			t.Fatalf("expected both migrations to be done, got %+v", statuses)
+		}
+
+		// Done migrations don't run again.
+		calls = 0
+		expectCode(t, state.Migrate(req, nil), 0)
+		if calls != 0 {
+			t.Fatalf("expected no calls, got %d", calls)
+		}
+	})
+}
+
+func TestMigrationHandler(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testTrain{Name: "one"})
+		state.RegisterMigration(Migration{Record: (*testTrain)(nil), Number: 1, Name: "rename",
+			Migrate: func(_ *http.Request, record Record) error {
+				record.(*testTrain).Name = "renamed"
+				return nil
+			}})
+		handler := state.MigrationHandler()
+
+		rw := testServe(handler, "POST", "/", "")
+		if rw.Code != 200 || strings.Contains(rw.Body.String(), `"error"`) {
+			t.Fatalf("expected the migrations to run, got %d: %s", rw.Code, rw.Body)
+		}
+
+		rw = testServe(handler, "GET", "/", "")
+		statuses := []MigrationStatus{}
+		decodeBody(t, rw, &statuses)
+		if len(statuses) != 1 || !statuses[0].Done || statuses[0].Migrated != 1 {
+			t.Fatalf("expected the migration to be done, got %s", rw.Body)
+		}
+	})
+}
@@ -0,0 +1,305 @@
+package dsadapter
+
+// Partial updates of stored records.
+
+import (
+	// Standard
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+/*********************************** Patch ***********************************/
+
+/**
+ * Updates only the named properties of a stored record. The record must have
+ * an id. The stored record with that id is read, the named properties are
+ * copied onto it from the given record, and the result is computed, validated
+ * and saved. Other properties keep their stored values, even if they're zero
+ * in the given record, and the named properties are written even if they're
+ * zero, so there's no guessing which zero values were meant.
+ *
+ * Field names are stored property names, matched case-insensitively. Unknown
+ * names produce 400 errors. Returns 404 if the record doesn't exist and 403 if
+ * the stored record doesn't allow CodeUpdate, or if the patch changes fields
+ * that the request may not write; see `fields.go`. On success, the given
+ * record holds the saved result.
+ *
+ * If the record is Versioned and the given record has a non-zero version, it
+ * must match the stored one, or Patch fails with a 409 error. The stored
+ * version is incremented on every patch. The read and the write run in a
+ * transaction if the store supports them.
+ *
+ *   engine := &Engine{Id: id, Name: "Zugelgeheiner", Cars: 0}
+ *   err := dsa.Patch(req, engine, []string{"Cars"})
+ *   // engine.Cars -> 0, engine.Name -> the stored name
+ */
+func (this *stateInstance) Patch(req *http.Request, record Record, fields []string) error {
+	src, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the names before touching the store.
+	props := make([]property, 0, len(fields))
+	for _, name := range fields {
+		prop, ok := findProperty(src.Type(), name)
+		if !ok {
+			return errUnknownField(name)
+		}
+		props = append(props, prop)
+	}
+
+	// Copy the named properties. The source is copied deeply because it's
+	// overwritten with the result afterwards.
+	return this.patch(req, record, func(dst reflect.Value) error {
+		for _, prop := range props {
+			prop.value(dst).Set(deepCopy(prop.value(src)))
+		}
+		return nil
+	})
+}
+
+/**
+ * Version of Patch that takes a JSON merge patch (RFC 7396) instead of a list
+ * of fields. The document must be a json object. Its keys are matched to
+ * fields like in encoding/json: by the `json` tag or the field name,
+ * case-insensitively. A null value resets the field to its zero value, an
+ * object is merged into a struct or map field, and any other value replaces
+ * the field. Fields missing from the document keep their stored values.
+ *
+ *   err := dsa.PatchJson(req, &Engine{Id: id}, []byte(`{"name": "Zugelgeheiner", "cars": null}`))
+ *
+ * Returns 400 for malformed json, unknown keys and values that don't fit the
+ * field types. Otherwise behaves like Patch.
+ */
+func (this *stateInstance) PatchJson(req *http.Request, record Record, doc []byte) error {
+	src, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &values); err != nil || values == nil {
+		return errJson
+	}
+
+	// Resolve the keys before touching the store.
+	props := map[string]property{}
+	for key := range values {
+		prop, ok := jsonProperty(src.Type(), key)
+		if !ok {
+			return errUnknownField(key)
+		}
+		props[key] = prop
+	}
+
+	return this.patch(req, record, func(dst reflect.Value) error {
+		for key, raw := range values {
+			if err := mergeJson(props[key].value(dst), raw); err != nil {
+				return errMalformedValue(key, string(raw))
+			}
+		}
+		return nil
+	})
+}
+
+/********************************* Utilities *********************************/
+
+// Reads the stored record with the id of the given record, applies the changes
+// to it, then computes, validates and saves the result, and copies it into the
+// given record.
+func (this *stateInstance) patch(req *http.Request, record Record, apply func(reflect.Value) error) error {
+	dst, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	// A record without an id can't exist in the store.
+	id := record.GetId()
+	if id == "" {
+		return err404
+	}
+
+	// Read and write in a transaction if possible. The result is copied to the
+	// caller only after the commit.
+	var stored reflect.Value
+	err = this.atomically(req, func(state *stateInstance) error {
+		// Read the stored record into a new value of the same type.
+		stored = reflect.New(dst.Type())
+		current := stored.Interface().(Record)
+		current.SetId(id)
+		if err := state.Store().Get(req, current); err != nil {
+			return notFound(err)
+		}
+		if isDeleted(current) {
+			return err404
+		}
+
+		// Hide a record out of the request's scope, see `scope.go`.
+		if err := checkScope(req, current); err != nil {
+			return err
+		}
+
+		// Check for update permission on the stored record.
+		if !current.Can(req, CodeUpdate) {
+			return err403
+		}
+
+		// Check the version, if the caller gave one.
+		versioned, isVersioned := current.(Versioned)
+		var version int64
+		if isVersioned {
+			version = versioned.GetVersion()
+			if expected := record.(Versioned).GetVersion(); expected != 0 && expected != version {
+				return errStale(version)
+			}
+		}
+
+		// Keep a copy to check the field permissions against.
+		var before Record
+		if hasFieldRules(current) {
+			before = newRecordLike(current)
+			copyFields(refValue(before), stored.Elem())
+		}
+
+		// Apply the changes, keeping the id and the stored version, which the
+		// write checks and increments.
+		if err := apply(stored.Elem()); err != nil {
+			return err
+		}
+		current.SetId(id)
+		if hasFieldRules(current) {
+			if err := state.CheckWrites(req, current, before); err != nil {
+				return err
+			}
+		}
+		if isVersioned {
+			versioned.SetVersion(version)
+		}
+
+		// Compute properties, run the BeforeSave hook, then validate.
+		state.Compute(current)
+		if err := state.beforeSave(req, current); err != nil {
+			return err
+		}
+		if errs := current.Validate(req); len(errs) != 0 {
+			return ValidationError(errs)
+		}
+
+		// Save like Save does, then run the AfterSave hook.
+		errs := make(MultiError, 1)
+		if err := state.putTracked(req, []Record{current}, errs, nil, nil); err != nil {
+			return err
+		}
+		if errs[0] != nil {
+			return errs[0]
+		}
+		return state.afterSave(req, current)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hand the result back to the caller.
+	copyFields(dst, stored.Elem())
+	return nil
+}
+
+// Finds the property that encoding/json would decode the given key into.
+// Properties hidden with `json:"-"` don't match.
+func jsonProperty(typ reflect.Type, key string) (property, bool) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	var fold property
+	found := false
+	for _, prop := range propertiesOf(typ) {
+		field := typ.FieldByIndex(prop.index)
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		// Prefer an exact match, like encoding/json.
+		if name == key {
+			return prop, true
+		}
+		if !found && strings.EqualFold(name, key) {
+			fold, found = prop, true
+		}
+	}
+	return fold, found
+}
+
+// Applies a json merge patch value to the given settable field.
+func mergeJson(field reflect.Value, raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+
+	// Null resets the field.
+	if bytes.Equal(raw, []byte("null")) {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	// Objects are merged into structs and maps by round-tripping the current
+	// value through json.
+	typ := field.Type()
+	if raw[0] == '{' && ((typ.Kind() == reflect.Struct && typ != timeType) || typ.Kind() == reflect.Map) {
+		current, err := json.Marshal(field.Interface())
+		if err != nil {
+			return err
+		}
+		var target, patch interface{}
+		if err := decodeJson(current, &target); err != nil {
+			return err
+		}
+		if err := decodeJson(raw, &patch); err != nil {
+			return err
+		}
+		if raw, err = json.Marshal(mergePatch(target, patch)); err != nil {
+			return err
+		}
+	}
+
+	// Decode into a zero value so the result doesn't depend on the old value.
+	val := reflect.New(typ)
+	if err := json.Unmarshal(raw, val.Interface()); err != nil {
+		return err
+	}
+	field.Set(val.Elem())
+	return nil
+}
+
+// Merges a decoded json merge patch into a decoded json document as per
+// RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+	for key, value := range patchMap {
+		if value == nil {
+			delete(targetMap, key)
+		} else {
+			targetMap[key] = mergePatch(targetMap[key], value)
+		}
+	}
+	return targetMap
+}
+
+// Decodes json, keeping numbers as json.Number so large integers survive.
+func decodeJson(data []byte, dst interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(dst)
+}
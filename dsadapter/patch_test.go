@@ -0,0 +1,142 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"testing"
+)
+
+// A record with nested properties to patch.
+type testWagon struct {
+	TestRecord
+	Id      string
+	Name    string            `json:"name"`
+	Cars    int               `json:"cars"`
+	Load    testLoad          `json:"load"`
+	Labels  map[string]string `json:"labels"`
+	Secret  string            `json:"-"`
+	Version int64
+}
+
+// Nested property of testWagon.
+type testLoad struct {
+	Goods  string
+	Weight int
+}
+
+func (this *testWagon) Validate(*http.Request) map[string]string {
+	if this.Name == "" {
+		return map[string]string{"name": "required"}
+	}
+	return nil
+}
+func (this *testWagon) GetId() string            { return this.Id }
+func (this *testWagon) SetId(id string)          { this.Id = id }
+func (this *testWagon) Kind() string             { return "Wagon" }
+func (this *testWagon) GetVersion() int64        { return this.Version }
+func (this *testWagon) SetVersion(version int64) { this.Version = version }
+
+// Saves a wagon to patch.
+func mustSaveWagon(t *testing.T, state State, req *http.Request) *testWagon {
+	t.Helper()
+	wagon := &testWagon{
+		Name:   "Pullman",
+		Cars:   5,
+		Load:   testLoad{Goods: "coal", Weight: 20},
+		Labels: map[string]string{"line": "north", "class": "first"},
+		Secret: "hidden",
+	}
+	mustSave(t, state, req, wagon)
+	return wagon
+}
+
+func TestPatch(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		wagon := mustSaveWagon(t, state, req)
+
+		// Named fields are written even if zero, the others are kept.
+		patched := &testWagon{Id: wagon.Id}
+		expectCode(t, state.Patch(req, patched, []string{"Cars"}), 0)
+		if patched.Cars != 0 || patched.Name != "Pullman" || patched.Secret != "hidden" {
+			t.Fatalf("expected only the cars to change, got %#v", patched)
+		}
+		if patched.Version != 2 {
+			t.Fatalf("expected the version to be incremented, got %d", patched.Version)
+		}
+
+		tests := []struct {
+			name   string
+			record *testWagon
+			fields []string
+			code   int
+		}{
+			{"invalid result", &testWagon{Id: wagon.Id}, []string{"Name"}, 422},
+			{"unknown field", &testWagon{Id: wagon.Id}, []string{"Wheels"}, 400},
+			{"missing record", &testWagon{Id: "missing"}, []string{"Cars"}, 404},
+			{"no id", &testWagon{}, []string{"Cars"}, 404},
+			{"stale version", &testWagon{Id: wagon.Id, Version: 1}, []string{"Cars"}, 409},
+			{"current version", &testWagon{Id: wagon.Id, Version: 2}, []string{"Cars"}, 0},
+		}
+		for _, test := range tests {
+			if err := state.Patch(req, test.record, test.fields); test.code != 0 && ErrorCode(err) != test.code ||
+				test.code == 0 && err != nil {
+				t.Errorf("%s: expected %d, got %v", test.name, test.code, err)
+			}
+		}
+	})
+}
+
+func TestPatchJson(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		wagon := mustSaveWagon(t, state, req)
+
+		// Objects are merged, null resets, other values replace.
+		patched := &testWagon{Id: wagon.Id}
+		doc := `{"name":"Orient","cars":7,"load":{"Weight":null},"labels":{"class":null,"gauge":"standard"}}`
+		expectCode(t, state.PatchJson(req, patched, []byte(doc)), 0)
+		if patched.Name != "Orient" || patched.Cars != 7 || patched.Load.Goods != "coal" || patched.Load.Weight != 0 ||
+			len(patched.Labels) != 2 || patched.Labels["line"] != "north" || patched.Labels["gauge"] != "standard" ||
+			patched.Secret != "hidden" {
+			t.Fatalf("expected the document to be merged, got %#v", patched)
+		}
+
+		for _, doc := range []string{`{"Secret":"shown"}`, `{"cars":"many"}`, `[]`, `null`, `{`} {
+			err := state.PatchJson(req, &testWagon{Id: wagon.Id}, []byte(doc))
+			if ErrorCode(err) != 400 {
+				t.Errorf("%s: expected 400, got %v", doc, err)
+			}
+		}
+	})
+}
+
+func TestPatchTracked(t *testing.T) {
+	forEachStore(t, Config{Audit: NewAuditKind()}, func(t *testing.T, state State, req *http.Request) {
+		wagon := mustSaveWagon(t, state, req)
+
+		events := []ChangeEvent{}
+		defer state.Subscribe("Wagon", func(_ *http.Request, event ChangeEvent) {
+			events = append(events, event)
+		})()
+
+		expectCode(t, state.PatchJson(req, &testWagon{Id: wagon.Id}, []byte(`{"cars":6}`)), 0)
+
+		// The patch is published as an update.
+		if len(events) != 1 || events[0].Op != CodeUpdate || events[0].Record.(*testWagon).Cars != 6 {
+			t.Fatalf("expected one update event, got %#v", events)
+		}
+
+		// And audited with its changes.
+		entries, err := state.History(req, &testWagon{Id: wagon.Id})
+		expectCode(t, err, 0)
+		if len(entries) != 2 || entries[1].Op != CodeUpdate {
+			t.Fatalf("expected a create and an update entry, got %#v", entries)
+		}
+		changes := map[string]bool{}
+		for _, change := range entries[1].Changes {
+			changes[change.Field] = true
+		}
+		if len(changes) != 2 || !changes["Cars"] || !changes["Version"] {
+			t.Fatalf("expected the cars and the version to change, got %#v", entries[1].Changes)
+		}
+	})
+}
@@ -1,84 +1,392 @@
 package dsadapter
 
-// Database populate utilities.
+// Database populate utilities: seed sets upserted by id.
 
 import (
 	// Standard
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
-// Returns the map of Datastore kind strings to populate funcs registered with
-// RegisterForPopulate. Creates the map if it's nil.
-func (this *stateInstance) PopulateFuncs() map[string]func(*http.Request) {
-	if this.populateFuncs == nil {
-		this.populateFuncs = map[string]func(*http.Request){}
+/********************************* Constants *********************************/
+
+// Seed change operations. See SeedChange.
+const (
+	SeedCreate = "create"
+	SeedUpdate = "update"
+	SeedDelete = "delete"
+)
+
+/********************************* Seed Sets *********************************/
+
+/**
+ * SeedSet is a collection of records that Populate writes to the store. Every
+ * record must have an id, which identifies it across runs: records that don't
+ * exist are created, records that differ from the stored ones are updated, and
+ * records that are already stored as given are left alone, so populating twice
+ * changes nothing. Example:
+ *
+ *   dsa.RegisterSeeds(dsadapter.SeedSet{
+ *     Name:    "engines",
+ *     Version: 2,
+ *     Records: []*Engine{{Id: "steam", Name: "Steam"}, {Id: "diesel", Name: "Diesel"}},
+ *     Prune:   true,
+ *   })
+ */
+type SeedSet struct {
+	// Unique name of the set. If omitted, the kind of the records.
+	Name string
+	// If positive, Populate applies the set once per version: a set whose
+	// version was already applied is skipped. Bump it when the records change.
+	// If zero, the set is applied on every Populate.
+	Version int
+	// Collection of records with ids, all of one kind.
+	Records interface{}
+	// If true, records of the kind that aren't in the set are deleted.
+	Prune bool
+}
+
+// SeedChange is one write that Populate makes, or would make, for a seed set.
+type SeedChange struct {
+	// Name of the seed set.
+	Set  string
+	Kind string
+	Id   string
+	// One of the SeedX constants.
+	Op string
+	// For SeedUpdate, the stored properties that differ.
+	Fields []FieldChange
+}
+
+// FieldChange is a stored property that a seed record changes.
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// SeedErrors holds the errors of the seed sets that failed, by set name.
+type SeedErrors map[string]error
+
+// Error method. Lists the sets and their errors, sorted by name.
+func (this SeedErrors) Error() string {
+	names := make([]string, 0, len(this))
+	for name := range this {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, "seed set "+name+": "+this[name].Error())
 	}
-	return this.populateFuncs
+	return strings.Join(msgs, "; ")
 }
 
-// Loops over each registered populate func and calls it. The App Engine library
-// panics if we do this asynchronously with goroutines, thus the synchrony. We
-// could probably get around this by passing around the same GAE context.
-func (this *stateInstance) Populate(req *http.Request) {
-	for _, fn := range this.PopulateFuncs() {
-		fn(req)
+// Registers a seed set for Populate. Panics if the records are missing, lack
+// ids or have different kinds, or if a set with the same name is already
+// registered.
+func (this *stateInstance) RegisterSeeds(set SeedSet) {
+	records := ToRecords(set.Records)
+	if len(records) == 0 {
+		panic("dsadapter: a seed set needs records")
+	}
+	kind := records[0].Kind()
+	for _, record := range records {
+		if record.GetId() == "" {
+			panic("dsadapter: every record in a seed set needs an id")
+		}
+		if record.Kind() != kind {
+			panic("dsadapter: the records in a seed set must have one kind")
+		}
+	}
+
+	if set.Name == "" {
+		set.Name = kind
+	}
+	for _, other := range this.seeds {
+		if other.Name == set.Name {
+			panic("dsadapter: duplicate seed set " + set.Name)
+		}
 	}
+	this.seeds = append(this.seeds, set)
 }
 
-// Registers the given records for populate.
+// Registers the given records as a seed set named after their kind, applied
+// on every Populate. Ignores an empty collection. See RegisterSeeds.
 func (this *stateInstance) RegisterForPopulate(values interface{}) {
-	// Convert to the []Record type.
-	records := ToRecords(values)
-
-	// Make sure we have at least one record.
-	if len(records) == 0 {
+	if len(ToRecords(values)) == 0 {
 		return
 	}
+	this.RegisterSeeds(SeedSet{Records: values})
+}
 
-	// Ignore if there's already a function under this collection's kind.
-	kind := records[0].Kind()
-	if this.PopulateFuncs()[kind] != nil {
-		return
+// Returns the registered seed sets, in the order they were registered.
+func (this *stateInstance) SeedSets() []SeedSet {
+	return append([]SeedSet{}, this.seeds...)
+}
+
+/********************************* Populate **********************************/
+
+// Applies the registered seed sets in the order they were registered. Records
+// are written with SaveMulti and pruned with DeleteMulti, so permissions,
+// hooks and validation apply as usual. A set that fails doesn't stop the
+// others. Returns SeedErrors with the error of each failed set.
+func (this *stateInstance) Populate(req *http.Request) error {
+	if err := this.syncSchemaOf(req, &seedRecord{}); err != nil {
+		return err
 	}
 
-	// Register a populate func.
-	this.PopulateFuncs()[kind] = func(req *http.Request) {
-		this.log(req, "   populating kind:", kind)
+	errs := SeedErrors{}
+	for _, set := range this.seeds {
+		this.log(req, "   populating seed set:", set.Name)
+		if err := this.populate(req, set); err != nil {
+			this.log(req, "!! failed to populate seed set:", set.Name, err)
+			errs[set.Name] = err
+			continue
+		}
+		this.log(req, "++ populated seed set:", set.Name)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Returns the changes that Populate would make, without making them. Returns
+// SeedErrors for the sets that couldn't be compared with the store.
+func (this *stateInstance) SeedChanges(req *http.Request) ([]SeedChange, error) {
+	if err := this.syncSchemaOf(req, &seedRecord{}); err != nil {
+		return nil, err
+	}
 
-		// Retrieve all existing records of this kind to delete them.
-		oldRecs := this.SliceOf(records[0])
-		err := this.FindAll(req, oldRecs, nil)
+	changes := []SeedChange{}
+	errs := SeedErrors{}
+	for _, set := range this.seeds {
+		plan, err := this.planSeeds(req, set)
 		if err != nil {
-			this.log(req, "!! unexpected error when retrieving old records during populate:", err)
-		}
-
-		// Loop over and call the Delete method of each old record.
-		func() {
-			for _, rec := range ToRecords(oldRecs) {
-				// Try to delete; abort the sequence if this fails.
-				err := rec.Delete(req)
-				if err != nil {
-					this.log(req, "!! unexpected error when trying to delete an old record during populate:", err)
-					return
-				}
+			errs[set.Name] = err
+			continue
+		}
+		changes = append(changes, plan.changes...)
+	}
+
+	if len(errs) > 0 {
+		return changes, errs
+	}
+	return changes, nil
+}
+
+/**
+ * Writes the changes that Populate would make to the given writer, without
+ * making them. Example output:
+ *
+ *   seed set engines:
+ *     + Engine steam
+ *     ~ Engine diesel
+ *         Name: "Disel" -> "Diesel"
+ *     - Engine electric
+ *
+ * Returns the errors of SeedChanges.
+ */
+func (this *stateInstance) DryRunPopulate(req *http.Request, out io.Writer) error {
+	changes, err := this.SeedChanges(req)
+
+	set := ""
+	for _, change := range changes {
+		if change.Set != set {
+			set = change.Set
+			fmt.Fprintf(out, "seed set %s:\n", set)
+		}
+
+		switch change.Op {
+		case SeedCreate:
+			fmt.Fprintf(out, "  + %s %s\n", change.Kind, change.Id)
+		case SeedUpdate:
+			fmt.Fprintf(out, "  ~ %s %s\n", change.Kind, change.Id)
+			for _, field := range change.Fields {
+				fmt.Fprintf(out, "      %s: %#v -> %#v\n", field.Field, field.Old, field.New)
+			}
+		case SeedDelete:
+			fmt.Fprintf(out, "  - %s %s\n", change.Kind, change.Id)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "no seed changes")
+	}
+
+	return err
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Kind of the entities that record the applied seed set versions.
+const seedMetaKind = "DsaSeed"
+
+// A stored seed set version.
+type seedRecord struct {
+	// Name of the seed set.
+	Id        string
+	Version   int
+	AppliedAt time.Time
+}
+
+// Record methods. Seed records are managed by the state.
+func (this *seedRecord) Validate(*http.Request) map[string]string { return nil }
+func (this *seedRecord) Compute()                                 {}
+func (this *seedRecord) Can(*http.Request, int) bool              { return true }
+func (this *seedRecord) Save(*http.Request) error                 { return errSeed }
+func (this *seedRecord) Read(*http.Request) error                 { return errSeed }
+func (this *seedRecord) Delete(*http.Request) error               { return errSeed }
+func (this *seedRecord) GetId() string                            { return this.Id }
+func (this *seedRecord) SetId(id string)                          { this.Id = id }
+func (this *seedRecord) Kind() string                             { return seedMetaKind }
+
+// The writes planned for a seed set.
+type seedPlan struct {
+	changes []SeedChange
+	// Records to save and to delete. The saves are copies of the seed records,
+	// and those in creates don't exist yet.
+	saves   []Record
+	creates map[int]bool
+	deletes []Record
+	// False if this version of the set was already applied.
+	pending bool
+}
+
+// Applies one seed set.
+func (this *stateInstance) populate(req *http.Request, set SeedSet) error {
+	plan, err := this.planSeeds(req, set)
+	if err != nil || !plan.pending {
+		return err
+	}
+
+	if len(plan.saves) > 0 {
+		if err := this.saveMulti(req, plan.saves, plan.creates); err != nil {
+			return err
+		}
+	}
+	if len(plan.deletes) > 0 {
+		if err := this.DeleteMulti(req, plan.deletes); err != nil {
+			return err
+		}
+	}
+
+	// Record the version, so it's not applied again.
+	if set.Version > 0 {
+		meta := &seedRecord{Id: set.Name, Version: set.Version, AppliedAt: now()}
+		return this.Store().Put(req, meta)
+	}
+	return nil
+}
+
+// Compares a seed set with the store. Plans to save copies of the seed records,
+// so the set itself isn't changed and may be planned again, concurrently too.
+// Aligns the version and the timestamps of the copies with their stored
+// copies, so they don't count as changes.
+func (this *stateInstance) planSeeds(req *http.Request, set SeedSet) (seedPlan, error) {
+	plan := seedPlan{creates: map[int]bool{}}
+
+	// Skip a version that was already applied.
+	if set.Version > 0 {
+		meta := &seedRecord{Id: set.Name}
+		err := this.Store().Get(req, meta)
+		if err != nil && ErrorCode(err) != 404 {
+			return plan, err
+		}
+		if err == nil && meta.Version >= set.Version {
+			return plan, nil
+		}
+	}
+	plan.pending = true
+
+	// Copy the seed records and read their stored copies.
+	records := ToRecords(set.Records)
+	stored := make([]Record, len(records))
+	errs := make(MultiError, len(records))
+	for i, seed := range records {
+		records[i] = newRecordLike(seed)
+		copyFields(refValue(records[i]), refValue(seed))
+		stored[i] = newRecordLike(seed)
+	}
+	if err := this.multi(req, stored, errs, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return plan, err
+	}
+
+	// Compute the seed records, like records decoded from json, then compare
+	// them.
+	ids := map[string]bool{}
+	for i, record := range records {
+		this.Compute(record)
+		ids[record.GetId()] = true
+		change := SeedChange{Set: set.Name, Kind: record.Kind(), Id: record.GetId()}
+
+		if errs[i] != nil && ErrorCode(errs[i]) != 404 {
+			return plan, errs[i]
+		}
+		if errs[i] != nil {
+			if versioned, ok := record.(Versioned); ok {
+				versioned.SetVersion(0)
+			}
+			plan.creates[len(plan.saves)] = true
+			change.Op = SeedCreate
+		} else {
+			alignSeed(record, stored[i])
+			change.Op = SeedUpdate
+			change.Fields = diffProperties(stored[i], record)
+			if len(change.Fields) == 0 {
+				continue
 			}
-			this.log(req, "-- deleted all records of kind:", kind)
-		}()
-
-		// Loop over records and save them.
-		func() {
-			for _, record := range records {
-				// This point in a record's lifecycle is equivalent to it being created
-				// from json or read from a database, so we must call its Compute method.
-				this.Compute(record)
-				// Try to save it and abort the sequence if this fails.
-				if err := record.Save(req); err != nil {
-					this.log(req, "!! failed to save record during populate:", err)
-					this.log(req, "!! aborting populate of kind:", kind)
-					return
-				}
+		}
+
+		plan.changes = append(plan.changes, change)
+		plan.saves = append(plan.saves, record)
+	}
+
+	// Find the records to prune.
+	if set.Prune {
+		collection := this.SliceOf(records[0])
+		if _, err := this.Find(req, collection, Query{}); err != nil {
+			return plan, err
+		}
+		for _, record := range ToRecords(collection) {
+			if ids[record.GetId()] {
+				continue
 			}
-			this.log(req, "++ successfully populated all records of kind:", kind)
-		}()
+			plan.changes = append(plan.changes, SeedChange{Set: set.Name, Kind: record.Kind(), Id: record.GetId(), Op: SeedDelete})
+			plan.deletes = append(plan.deletes, record)
+		}
+	}
+
+	return plan, nil
+}
+
+// Copies the state that the adapter manages from the stored record into the
+// seed record: the version and the timestamps.
+func alignSeed(seed, stored Record) {
+	if versioned, ok := seed.(Versioned); ok {
+		versioned.SetVersion(stored.(Versioned).GetVersion())
+	}
+	if timestamped, ok := seed.(Timestamped); ok {
+		timestamped.SetTimestamps(stored.(Timestamped).GetTimestamps())
+	}
+}
+
+// Returns the stored properties whose values differ between two records of
+// the same type.
+func diffProperties(stored, seed Record) []FieldChange {
+	storedVal, seedVal := refValue(stored), refValue(seed)
+	changes := []FieldChange{}
+	for _, prop := range propertiesOf(storedVal.Type()) {
+		one, other := prop.value(storedVal), prop.value(seedVal)
+		if !equalValues(one, other) {
+			changes = append(changes, FieldChange{Field: prop.name, Old: one.Interface(), New: other.Interface()})
+		}
 	}
+	return changes
 }
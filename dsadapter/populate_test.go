@@ -0,0 +1,145 @@
+package dsadapter
+
+import (
+	// Standard
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A seeded record with its own timestamp fields and a computed property.
+// Refuses creates for requests with a "Forbid" header.
+type testDepot struct {
+	TestRecord
+	Id      string
+	Name    string
+	Code    string
+	Created time.Time
+	Updated time.Time
+	Version int64
+}
+
+func (this *testDepot) Validate(*http.Request) map[string]string {
+	if this.Name == "" {
+		return map[string]string{"Name": "required"}
+	}
+	return nil
+}
+func (this *testDepot) Compute() { this.Code = strings.ToUpper(this.Name) }
+func (this *testDepot) Can(req *http.Request, code int) bool {
+	return code != CodeCreate || req.Header.Get("Forbid") == ""
+}
+func (this *testDepot) GetId() string                         { return this.Id }
+func (this *testDepot) SetId(id string)                       { this.Id = id }
+func (this *testDepot) Kind() string                          { return "Depot" }
+func (this *testDepot) GetVersion() int64                     { return this.Version }
+func (this *testDepot) SetVersion(version int64)              { this.Version = version }
+func (this *testDepot) GetTimestamps() (time.Time, time.Time) { return this.Created, this.Updated }
+func (this *testDepot) SetTimestamps(created, updated time.Time) {
+	this.Created, this.Updated = created, updated
+}
+
+func TestPopulate(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testDepot{Id: "one", Name: "old"}, &testDepot{Id: "extra", Name: "extra"})
+
+		state.RegisterSeeds(SeedSet{
+			Name:    "depots",
+			Records: []*testDepot{{Id: "one", Name: "north"}, {Id: "two", Name: "south"}},
+			Prune:   true,
+		})
+
+		// A dry run lists the changes and writes nothing.
+		out := &bytes.Buffer{}
+		expectCode(t, state.DryRunPopulate(req, out), 0)
+		for _, line := range []string{"~ Depot one", "+ Depot two", "- Depot extra", `Name: "old" -> "north"`} {
+			if !strings.Contains(out.String(), line) {
+				t.Fatalf("expected %q in the dry run, got:\n%s", line, out)
+			}
+		}
+		if strings.Contains(out.String(), "Created") || strings.Contains(out.String(), "Version") {
+			t.Fatalf("expected the managed fields to be left out, got:\n%s", out)
+		}
+		expectCode(t, state.Read(req, &testDepot{Id: "extra"}), 0)
+
+		// Populate applies them, computing the seed records.
+		expectCode(t, state.Populate(req), 0)
+		one := &testDepot{Id: "one"}
+		expectCode(t, state.Store().Get(req, one), 0)
+		if one.Name != "north" || one.Code != "NORTH" || one.Version != 2 {
+			t.Fatalf("expected the computed update, got %#v", one)
+		}
+		expectCode(t, state.Read(req, &testDepot{Id: "extra"}), 404)
+
+		// Populating again changes nothing.
+		changes, err := state.SeedChanges(req)
+		expectCode(t, err, 0)
+		if len(changes) != 0 {
+			t.Fatalf("expected no changes, got %#v", changes)
+		}
+		expectCode(t, state.Populate(req), 0)
+		again := &testDepot{Id: "one"}
+		expectCode(t, state.Store().Get(req, again), 0)
+		if again.Version != 2 || !again.Updated.Equal(one.Updated) {
+			t.Fatalf("expected the record to be left alone, got %#v", again)
+		}
+	})
+}
+
+func TestPopulateCopies(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testDepot{Id: "one", Name: "old"})
+		seeds := []*testDepot{{Id: "one", Name: "north"}, {Id: "two", Name: "south"}}
+		state.RegisterSeeds(SeedSet{Name: "depots", Records: seeds})
+
+		// Missing seeds are created, so they need the create permission.
+		forbidden := testRequest("POST", "/")
+		forbidden.Header.Set("Forbid", "true")
+		err := state.Populate(forbidden)
+		if seedErrs, _ := err.(SeedErrors); ErrorCode(seedErrs["depots"]) != 403 {
+			t.Fatalf("expected the create to be forbidden, got %v", err)
+		}
+
+		// The seed records themselves are left as they were.
+		_, err = state.SeedChanges(req)
+		expectCode(t, err, 0)
+		expectCode(t, state.Populate(req), 0)
+		if seeds[0].Code != "" || seeds[0].Version != 0 || !seeds[0].Updated.IsZero() || seeds[1].Version != 0 {
+			t.Fatalf("expected the seeds to be unchanged, got %#v and %#v", seeds[0], seeds[1])
+		}
+	})
+}
+
+func TestPopulateVersions(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		state.RegisterSeeds(SeedSet{Name: "versioned", Version: 1, Records: []*testDepot{{Id: "one", Name: "north"}}})
+		state.RegisterSeeds(SeedSet{Name: "invalid", Records: []*testDepot{{Id: "two"}}})
+
+		// Failing sets are reported by name, and don't stop the others.
+		err := state.Populate(req)
+		seedErrs, _ := err.(SeedErrors)
+		if len(seedErrs) != 1 || seedErrs["invalid"] == nil {
+			t.Fatalf("expected only the invalid set to fail, got %v", err)
+		}
+
+		// An applied version isn't applied again.
+		mustSave(t, state, req, &testDepot{Id: "one", Name: "changed", Version: 1})
+		changes, err := state.SeedChanges(req)
+		expectCode(t, err, 0)
+		for _, change := range changes {
+			if change.Set == "versioned" {
+				t.Fatalf("expected the applied version to be skipped, got %#v", change)
+			}
+		}
+
+		// Sets must have unique names.
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic for a duplicate name")
+			}
+		}()
+		state.RegisterSeeds(SeedSet{Name: "versioned", Records: []*testDepot{{Id: "three", Name: "east"}}})
+	})
+}
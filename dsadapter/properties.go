@@ -0,0 +1,326 @@
+package dsadapter
+
+// Reflection utilities for reading and writing record properties. Used by
+// stores that don't have their own serialisation.
+
+import (
+	// Standard
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************* Property **********************************/
+
+// Describes one stored property of a record type.
+type property struct {
+	// Stored name. Taken from the `datastore` tag if present, otherwise the
+	// field name.
+	name string
+	// Index sequence for reflect.Value.FieldByIndex.
+	index []int
+	// Field type.
+	typ reflect.Type
+}
+
+// Cache of property lists by struct type.
+var propertyCache sync.Map
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Returns the stored properties of the given struct type. Follows the
+// Datastore conventions: unexported fields and fields tagged `datastore:"-"`
+// are skipped, and the first part of the `datastore` tag overrides the name.
+// Fields of exported embedded structs are treated as if they belonged to the
+// outer struct.
+func propertiesOf(typ reflect.Type) []property {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if cached, ok := propertyCache.Load(typ); ok {
+		return cached.([]property)
+	}
+
+	props := []property{}
+	if typ.Kind() == reflect.Struct {
+		props = appendProperties(props, typ, nil)
+	}
+
+	propertyCache.Store(typ, props)
+	return props
+}
+
+// Appends the properties of the given struct type, prefixing each field index
+// with the given index sequence.
+func appendProperties(props []property, typ reflect.Type, prefix []int) []property {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		index := append(append([]int{}, prefix...), i)
+
+		// Skip unexported fields.
+		if field.PkgPath != "" {
+			continue
+		}
+
+		// Flatten embedded structs.
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			props = appendProperties(props, field.Type, index)
+			continue
+		}
+
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("datastore"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		props = append(props, property{name: name, index: index, typ: field.Type})
+	}
+	return props
+}
+
+// Finds a property of the given struct type by its stored name.
+func propertyByName(typ reflect.Type, name string) (property, bool) {
+	for _, prop := range propertiesOf(typ) {
+		if prop.name == name {
+			return prop, true
+		}
+	}
+	return property{}, false
+}
+
+// Returns the value of the property in the given struct value.
+func (this property) value(val reflect.Value) reflect.Value {
+	return val.FieldByIndex(this.index)
+}
+
+/********************************** Values ***********************************/
+
+// Parses a string into a value of the given type. Supports strings, booleans,
+// numbers and RFC 3339 times.
+func parseValue(str string, typ reflect.Type) (reflect.Value, error) {
+	val := reflect.New(typ).Elem()
+
+	if typ == timeType {
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return val, err
+		}
+		val.Set(reflect.ValueOf(t))
+		return val, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		val.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return val, err
+		}
+		val.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, typ.Bits())
+		if err != nil {
+			return val, err
+		}
+		val.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 10, typ.Bits())
+		if err != nil {
+			return val, err
+		}
+		val.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, typ.Bits())
+		if err != nil {
+			return val, err
+		}
+		val.SetFloat(f)
+	default:
+		return val, utils.Error("can't parse a value of type " + typ.String())
+	}
+
+	return val, nil
+}
+
+// Checks two values for equality. Times are compared as instants.
+func equalValues(one, other reflect.Value) bool {
+	if one.Type() == timeType && other.Type() == timeType {
+		return one.Interface().(time.Time).Equal(other.Interface().(time.Time))
+	}
+	return reflect.DeepEqual(one.Interface(), other.Interface())
+}
+
+/********************************** Copying **********************************/
+
+// Copies the exported fields of one struct value into another struct value of
+// the same type, deeply, so the two values don't share any memory. The
+// destination must be settable. Unexported fields of the destination are left
+// untouched, just like when a record is loaded from the Datastore.
+func copyFields(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		// Preserve the unexported fields of embedded structs too.
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			copyFields(dst.Field(i), src.Field(i))
+			continue
+		}
+		dst.Field(i).Set(deepCopy(src.Field(i)))
+	}
+}
+
+// Returns a copy of the given value that doesn't share memory with it.
+func deepCopy(src reflect.Value) reflect.Value {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.New(src.Type().Elem())
+		dst.Elem().Set(deepCopy(src.Elem()))
+		return dst
+
+	case reflect.Slice:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(deepCopy(src.Index(i)))
+		}
+		return dst
+
+	case reflect.Array:
+		dst := reflect.New(src.Type()).Elem()
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(deepCopy(src.Index(i)))
+		}
+		return dst
+
+	case reflect.Map:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.MakeMap(src.Type())
+		for _, key := range src.MapKeys() {
+			dst.SetMapIndex(key, deepCopy(src.MapIndex(key)))
+		}
+		return dst
+
+	case reflect.Interface:
+		if src.IsNil() {
+			return src
+		}
+		dst := reflect.New(src.Type()).Elem()
+		dst.Set(deepCopy(src.Elem()))
+		return dst
+
+	case reflect.Struct:
+		// Copy everything, including unexported fields such as the insides of
+		// time.Time, then replace exported fields with deep copies.
+		dst := reflect.New(src.Type()).Elem()
+		dst.Set(src)
+		copyFields(dst, src)
+		return dst
+	}
+
+	return src
+}
+
+// Converts a query value into a value of the given type. Strings are parsed
+// as with parseValue; other values are converted if their types allow it.
+func convertValue(value interface{}, typ reflect.Type) (reflect.Value, error) {
+	if str, ok := value.(string); ok && typ.Kind() != reflect.String {
+		return parseValue(str, typ)
+	}
+
+	val := reflect.ValueOf(value)
+	if !val.IsValid() {
+		return reflect.Zero(typ), nil
+	}
+	if val.Type() == typ {
+		return val, nil
+	}
+
+	// Refuse conversions that change the meaning of the value, like int to
+	// string.
+	if typ.Kind() == reflect.String && val.Kind() != reflect.String {
+		return val, utils.Error("can't use " + val.Type().String() + " as " + typ.String())
+	}
+	if !val.Type().ConvertibleTo(typ) {
+		return val, utils.Error("can't use " + val.Type().String() + " as " + typ.String())
+	}
+	return val.Convert(typ), nil
+}
+
+// Compares two values of the same type. Returns -1, 0 or 1, and false if the
+// values are not ordered, like slices or structs other than time.Time.
+func compareValues(one, other reflect.Value) (int, bool) {
+	if one.Type() == timeType && other.Type() == timeType {
+		a, b := one.Interface().(time.Time), other.Interface().(time.Time)
+		switch {
+		case a.Before(b):
+			return -1, true
+		case a.After(b):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch one.Kind() {
+	case reflect.String:
+		return strings.Compare(one.String(), other.String()), true
+
+	case reflect.Bool:
+		a, b := one.Bool(), other.Bool()
+		switch {
+		case a == b:
+			return 0, true
+		case !a:
+			return -1, true
+		}
+		return 1, true
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		a, b := one.Int(), other.Int()
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		a, b := one.Uint(), other.Uint()
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+
+	case reflect.Float32, reflect.Float64:
+		a, b := one.Float(), other.Float()
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,453 @@
+package dsadapter
+
+// Query type passed to Find and to stores.
+
+import (
+	// Standard
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/********************************* Constants *********************************/
+
+// Filter operators.
+const (
+	OpEq  = "="
+	OpNe  = "!="
+	OpLt  = "<"
+	OpLte = "<="
+	OpGt  = ">"
+	OpGte = ">="
+	// Matches any value in a slice.
+	OpIn = "in"
+)
+
+// Map of operator suffixes used in URL queries to operators. See ParseQuery.
+var urlOps = map[string]string{
+	"eq":  OpEq,
+	"ne":  OpNe,
+	"lt":  OpLt,
+	"lte": OpLte,
+	"gt":  OpGt,
+	"gte": OpGte,
+	"in":  OpIn,
+}
+
+/*********************************** Query ***********************************/
+
+// Query describes which records of a kind to find and in what order. Field
+// names are stored property names (see the `datastore` tag). The zero value
+// finds all records, ordered by id.
+type Query struct {
+	// Conditions that every record must satisfy.
+	Filters []Filter
+	// Property names to order by. A "-" prefix means descending order.
+	Orders []string
+	// Maximum number of records to find. Zero or negative means no limit.
+	Limit int
+	// Number of records to skip.
+	Offset int
+	// Opaque position to resume from, returned by an earlier Find.
+	Cursor string
+	// Property names to load. If empty, all properties are loaded. Other
+	// properties are left zero.
+	Fields []string
+	// Include soft-deleted records, which Find leaves out by default. See
+	// SoftDeletable.
+	WithDeleted bool
+	// Relations to load with the records, like "author" or "comments.author".
+	// See Related and Include.
+	Includes []string
+}
+
+// Filter is one condition in a query.
+type Filter struct {
+	// Property name.
+	Field string
+	// One of the OpX constants.
+	Op string
+	// Value to compare with. For OpIn, a slice of values.
+	Value interface{}
+}
+
+// Makes a query with an equality filter for each param, in the order of param
+// names.
+func NewQuery(params map[string]string) Query {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	query := Query{}
+	for _, name := range names {
+		query = query.Filter(name, OpEq, params[name])
+	}
+	return query
+}
+
+// Returns a copy of the query with an added filter.
+func (this Query) Filter(field, op string, value interface{}) Query {
+	this.Filters = append(this.Filters[:len(this.Filters):len(this.Filters)], Filter{Field: field, Op: op, Value: value})
+	return this
+}
+
+// Returns a copy of the query with an added order. Prefix the field with "-"
+// for descending order.
+func (this Query) Order(field string) Query {
+	this.Orders = append(this.Orders[:len(this.Orders):len(this.Orders)], field)
+	return this
+}
+
+// Returns a copy of the query that loads the named relations with the found
+// records. See Related.
+func (this Query) Include(names ...string) Query {
+	this.Includes = append(this.Includes[:len(this.Includes):len(this.Includes)], names...)
+	return this
+}
+
+/******************************** URL Queries ********************************/
+
+/**
+ * Makes a query for records of the given type from URL query params. Syntax:
+ *
+ *   ?Name=Zugelgeheiner       equality
+ *   ?age__gte=18              operators: eq, ne, lt, lte, gt, gte
+ *   ?kind__in=diesel,steam    comma-separated list for `in`
+ *   ?order=-created,name      order; "-" means descending
+ *   ?limit=20&offset=40       limit and offset
+ *   ?fields=name,age          load only these fields
+ *   ?include=author,tags      load relations; see Related
+ *
+ * Field names are matched to properties case-insensitively, and values are
+ * parsed into the property types. To filter on a property called "order",
+ * "limit", "offset", "cursor", "fields" or "include", use the explicit `__eq`
+ * suffix. Unknown fields and malformed values produce 400 errors.
+ *
+ * URLs can't reach soft-deleted records: the deletion mark of a SoftDeletable
+ * record counts as an unknown field. Set WithDeleted or filter on the mark in
+ * code instead.
+ */
+func ParseQuery(record Record, values url.Values) (Query, error) {
+	typ := reflect.TypeOf(record)
+	query := Query{}
+
+	// Sort the keys for a predictable filter order.
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if len(values[key]) == 0 {
+			continue
+		}
+		value := values[key][0]
+
+		switch key {
+		case "order":
+			for _, value := range values[key] {
+				for _, name := range splitList(value) {
+					desc := strings.HasPrefix(name, "-")
+					prop, ok := findProperty(typ, strings.TrimPrefix(name, "-"))
+					if !ok {
+						return query, errUnknownField(name)
+					}
+					if desc {
+						query = query.Order("-" + prop.name)
+					} else {
+						query = query.Order(prop.name)
+					}
+				}
+			}
+			continue
+
+		case "fields":
+			for _, name := range splitList(value) {
+				prop, ok := findProperty(typ, name)
+				if !ok {
+					return query, errUnknownField(name)
+				}
+				query.Fields = append(query.Fields, prop.name)
+			}
+			continue
+
+		case "limit", "offset":
+			num, err := strconv.Atoi(value)
+			if err != nil || num < 0 {
+				return query, errQuery.WithDetails(map[string]interface{}{key: value})
+			}
+			if key == "limit" {
+				query.Limit = num
+			} else {
+				query.Offset = num
+			}
+			continue
+
+		case "cursor":
+			query.Cursor = value
+			continue
+
+		case "include":
+			for _, value := range values[key] {
+				query = query.Include(splitList(value)...)
+			}
+			continue
+		}
+
+		// Split off the operator suffix, if any.
+		name, op := key, OpEq
+		if index := strings.LastIndex(key, "__"); index >= 0 {
+			if urlOp, ok := urlOps[key[index+2:]]; ok {
+				name, op = key[:index], urlOp
+			}
+		}
+
+		prop, ok := findProperty(typ, name)
+		if !ok || isDeletionMark(record, prop) {
+			return query, errUnknownField(name)
+		}
+
+		// Parse the value or values.
+		if op == OpIn {
+			list := reflect.MakeSlice(reflect.SliceOf(prop.typ), 0, 0)
+			for _, str := range splitList(value) {
+				val, err := parseValue(str, prop.typ)
+				if err != nil {
+					return query, errMalformedValue(name, str)
+				}
+				list = reflect.Append(list, val)
+			}
+			query = query.Filter(prop.name, op, list.Interface())
+		} else {
+			val, err := parseValue(value, prop.typ)
+			if err != nil {
+				return query, errMalformedValue(name, value)
+			}
+			query = query.Filter(prop.name, op, val.Interface())
+		}
+	}
+
+	return query, nil
+}
+
+/********************************* Utilities *********************************/
+
+// Encodes a position in query results as an opaque URL-safe cursor.
+func encodeCursor(position int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(position)))
+}
+
+// Decodes a cursor made by encodeCursor. An empty cursor means the start.
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errCursor
+	}
+	position, err := strconv.Atoi(string(bytes))
+	if err != nil || position < 0 {
+		return 0, errCursor
+	}
+	return position, nil
+}
+
+// Finds a property by its stored name, falling back on a case-insensitive
+// match.
+func findProperty(typ reflect.Type, name string) (property, bool) {
+	if prop, ok := propertyByName(typ, name); ok {
+		return prop, true
+	}
+	for _, prop := range propertiesOf(typ) {
+		if strings.EqualFold(prop.name, name) {
+			return prop, true
+		}
+	}
+	return property{}, false
+}
+
+// Splits a comma-separated list, dropping empty strings.
+func splitList(str string) []string {
+	return compact(strings.Split(str, ","))
+}
+
+// Clears a slice of strings from empty strings.
+func compact(values []string) []string {
+	result := []string{}
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+/******************************* Compiled Query ******************************/
+
+// Query checked against a struct type, with field names resolved to
+// properties and values converted to property types. Used by stores that
+// evaluate queries themselves.
+type compiledQuery struct {
+	filters []compiledFilter
+	orders  []compiledOrder
+	// Properties to load, or nil for all.
+	fields []property
+	// Number of records to skip, combining the cursor and the offset.
+	start int
+	limit int
+}
+
+type compiledFilter struct {
+	prop property
+	op   string
+	// One value, or several for OpIn.
+	values []reflect.Value
+}
+
+type compiledOrder struct {
+	prop property
+	desc bool
+}
+
+// Checks the query against the given struct type. Returns a 400 error for
+// unknown fields, operators and values that don't fit the property types.
+func compileQuery(typ reflect.Type, query Query) (compiledQuery, error) {
+	result := compiledQuery{limit: query.Limit}
+
+	start, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return result, err
+	}
+	if query.Offset > 0 {
+		start += query.Offset
+	}
+	result.start = start
+
+	for _, filter := range query.Filters {
+		prop, ok := propertyByName(typ, filter.Field)
+		if !ok {
+			return result, errUnknownField(filter.Field)
+		}
+
+		compiled := compiledFilter{prop: prop, op: filter.Op}
+
+		switch filter.Op {
+		case OpEq, OpNe, OpLt, OpLte, OpGt, OpGte:
+			val, err := convertValue(filter.Value, prop.typ)
+			if err != nil {
+				return result, errMalformedValue(filter.Field, err.Error())
+			}
+			compiled.values = []reflect.Value{val}
+
+		case OpIn:
+			list := reflect.ValueOf(filter.Value)
+			if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+				return result, errMalformedValue(filter.Field, "the value for `in` must be a slice")
+			}
+			for i := 0; i < list.Len(); i++ {
+				val, err := convertValue(list.Index(i).Interface(), prop.typ)
+				if err != nil {
+					return result, errMalformedValue(filter.Field, err.Error())
+				}
+				compiled.values = append(compiled.values, val)
+			}
+
+		default:
+			return result, errOperator.WithDetails(map[string]interface{}{"operator": filter.Op})
+		}
+
+		result.filters = append(result.filters, compiled)
+	}
+
+	for _, name := range query.Orders {
+		desc := strings.HasPrefix(name, "-")
+		prop, ok := propertyByName(typ, strings.TrimPrefix(name, "-"))
+		if !ok {
+			return result, errUnknownField(name)
+		}
+		result.orders = append(result.orders, compiledOrder{prop: prop, desc: desc})
+	}
+
+	for _, name := range query.Fields {
+		prop, ok := propertyByName(typ, name)
+		if !ok {
+			return result, errUnknownField(name)
+		}
+		result.fields = append(result.fields, prop)
+	}
+
+	return result, nil
+}
+
+// Checks if the given struct value satisfies all filters.
+func (this compiledQuery) match(val reflect.Value) bool {
+	for _, filter := range this.filters {
+		field := filter.prop.value(val)
+
+		if filter.op == OpIn {
+			found := false
+			for _, value := range filter.values {
+				if equalValues(field, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+
+		order, ok := compareValues(field, filter.values[0])
+		if !ok && filter.op != OpEq && filter.op != OpNe {
+			return false
+		}
+		if !ok {
+			order = 1
+			if equalValues(field, filter.values[0]) {
+				order = 0
+			}
+		}
+
+		switch filter.op {
+		case OpEq:
+			ok = order == 0
+		case OpNe:
+			ok = order != 0
+		case OpLt:
+			ok = order < 0
+		case OpLte:
+			ok = order <= 0
+		case OpGt:
+			ok = order > 0
+		case OpGte:
+			ok = order >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if one struct value goes before another according to the orders.
+func (this compiledQuery) less(one, other reflect.Value) bool {
+	for _, order := range this.orders {
+		result, _ := compareValues(order.prop.value(one), order.prop.value(other))
+		if result == 0 {
+			continue
+		}
+		if order.desc {
+			return result > 0
+		}
+		return result < 0
+	}
+	return false
+}
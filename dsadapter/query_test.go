@@ -0,0 +1,65 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		params string
+		query  Query
+	}{
+		{"", Query{}},
+		{"name=one", Query{}.Filter("Name", OpEq, "one")},
+		{"cars__gte=2&cars__lt=5", Query{}.Filter("Cars", OpGte, 2).Filter("Cars", OpLt, 5)},
+		{"cars__in=1,3", Query{}.Filter("Cars", OpIn, []int{1, 3})},
+		{"order=-cars,name&limit=2&offset=4", Query{Orders: []string{"-Cars", "Name"}, Limit: 2, Offset: 4}},
+		{"fields=name&cursor=abc", Query{Fields: []string{"Name"}, Cursor: "abc"}},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.params)
+		query, err := ParseQuery(&testEngine{}, values)
+		if err != nil || !reflect.DeepEqual(query, test.query) {
+			t.Errorf("%q: expected %#v, got %#v and %v", test.params, test.query, query, err)
+		}
+	}
+
+	// Unknown fields and malformed values are rejected.
+	for _, params := range []string{"wheels=1", "cars=many", "cars__in=1,x", "limit=-1", "order=wheels"} {
+		values, _ := url.ParseQuery(params)
+		if _, err := ParseQuery(&testEngine{}, values); ErrorCode(err) != 400 {
+			t.Errorf("%q: expected 400, got %v", params, err)
+		}
+	}
+}
+
+func TestFindByQuery(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		for i, name := range []string{"c", "a", "b", "d"} {
+			mustSave(t, state, req, &testEngine{Name: name, Cars: i})
+		}
+
+		engines := []*testEngine{}
+		_, err := state.FindByQuery(testRequest("GET", "/?cars__gte=1&order=-name&limit=2"), &engines)
+		expectCode(t, err, 0)
+		if len(engines) != 2 || engines[0].Name != "d" || engines[1].Name != "b" {
+			t.Fatalf("expected d and b, got %#v", engines)
+		}
+
+		// Projections leave the other fields zero.
+		engines = nil
+		_, err = state.FindByQuery(testRequest("GET", "/?name__in=a,d&fields=cars&order=cars"), &engines)
+		expectCode(t, err, 0)
+		if cars := engineCars(engines); !equalInts(cars, []int{1, 3}) || engines[0].Name != "" || engines[0].Id == "" {
+			t.Fatalf("expected the ids and cars of a and d, got %#v", engines)
+		}
+
+		engines = nil
+		_, err = state.FindByQuery(testRequest("GET", "/?wheels=4"), &engines)
+		expectCode(t, err, 400)
+	})
+}
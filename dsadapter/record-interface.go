@@ -28,27 +28,19 @@ type Record interface {
 
 	/*--------------------------------- CRUD ----------------------------------*/
 
-	// Side effect: must save self to the Datastore under the Datastore key
-	// identified by own id.
+	// Side effect: must save self to the store under own kind and id.
 	Save(*http.Request) error
 
-	// Side effect: must read a record by own id from the Datastore into self.
+	// Side effect: must read a record by own id from the store into self.
 	Read(*http.Request) error
 
-	// Side effect: must delete self by id from the Datastore.
+	// Side effect: must delete self by id from the store.
 	Delete(*http.Request) error
 
-	// ToDo: consider adding a Patch method that would combine Read() and
-	// Save() to update an existing record without deleting missing fields.
-	// Step 1: create a clone of self with the same id and Read() it.
-	// Step 2: for each zero field on self, copy that field from the clone.
-	// Step 3: Save() self.
-	// End result: the old record has been updated with non-zero-value fields
-	// from the new record. Zero value fields on the new record have been ignored.
-	//
-	// Leaning towards rejecting the idea because it would add complexity and
-	// might lead to programmer errors like using Patch() in situations when
-	// writing empty fields is actually intended (e.g. set some text field to "").
+	// There's no Patch method. Merging non-zero fields would make it impossible
+	// to write empty fields on purpose (e.g. set some text field to ""). To
+	// update some fields of a stored record, use State#Patch with an explicit
+	// list of fields, or State#PatchJson with a JSON merge patch.
 
 	/*------------------------------- Utilities -------------------------------*/
 
@@ -58,10 +50,22 @@ type Record interface {
 	// Side effect: must set own id to the given string.
 	SetId(string)
 
-	// Returns own Datastore kind.
+	// Returns own kind. Records of one kind are stored together, like a table.
 	Kind() string
 }
 
+// Versioned is an optional interface for records that use optimistic
+// concurrency control. Save, SaveMulti and Patch compare the record's version
+// with the stored one, fail with a 409 error if they differ, and increment it
+// on every write. See `version.go`.
+type Versioned interface {
+	// Returns own version. Zero means the record has never been saved.
+	GetVersion() int64
+
+	// Side effect: must set own version to the given number.
+	SetVersion(int64)
+}
+
 /**
  * Generic collection definition.
  *
@@ -75,7 +79,7 @@ type Record interface {
  * pass matching values.
  *
  * Take note that []Record is NOT the same type and does not satisfy the
- * definition. We need an underlying struct type for Datastore queries.
+ * definition. We need an underlying struct type for store queries.
  *
  * Also take note that this type is not used directly in any function in this
  * package (we use interface{} instead). It's for reference purposes only.
@@ -87,11 +91,17 @@ type Record interface {
  *     sequence fails if validation fails) || read from database || created
  *     from mock data
  *   * its Compute method is called to calculate derived properties
+ *   * if it was read, its AfterRead hook is called (see `hooks.go`)
  *   * the user does something with it
  *   * the user calls its Save method
+ *     * the BeforeSave hook is called; the sequence fails if it fails
  *     * the Validate method is called; the sequence fails if validation fails
  *     * if the record doesn't have an id, a new random id is generated
+ *     * if the record is Versioned, its version is checked against the stored
+ *       one and incremented
  *     * record is saved to database
+ *     * the AfterSave hook is called
  *   * the user calls its Delete method
+ *     * the BeforeDelete hook is called; the sequence fails if it fails
  *     * record is deleted from database
  */
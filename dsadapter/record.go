@@ -7,10 +7,6 @@ import (
 	"net/http"
 	"reflect"
 
-	// App Engine
-	"appengine"
-	"appengine/datastore"
-
 	// Third party
 	"github.com/Mitranim/gotools/utils"
 )
@@ -18,15 +14,16 @@ import (
 /******************************* Query Methods *******************************/
 
 // Takes a pointer to a record and tries to find one record of the matching
-// type, filtered by the given params. If a record is successfully found, it's
+// type that satisfies the given query. If a record is successfully found, it's
 // written to the destination, which must be a pointer. If not, an error if
-// returned.
-func (this *stateInstance) FindOne(req *http.Request, destination Record, params map[string]string) error {
+// returned. The query's limit is ignored.
+func (this *stateInstance) FindOne(req *http.Request, destination Record, query Query) error {
 	// Make a matching collection.
 	collection := this.SliceOf(destination)
 
 	// Try to find one of that type.
-	err := this.Find(req, collection, params, 1)
+	query.Limit = 1
+	_, err := this.Find(req, collection, query)
 	if err != nil {
 		return err
 	}
@@ -54,34 +51,45 @@ func (this *stateInstance) FindOne(req *http.Request, destination Record, params
 
 /************************** Record Method Adapters ***************************/
 
-// Returns a datastore key for the given record.
-func (this *stateInstance) Key(req *http.Request, record Record) *datastore.Key {
-	gc := appengine.NewContext(req)
-	return datastore.NewKey(gc, record.Kind(), record.GetId(), 0, nil)
-}
-
-// Reads the given record from the Datastore.
+// Reads the given record from the store, then runs its AfterRead hook. See
+// `hooks.go`. Returns 404 if the record is soft-deleted or out of the
+// request's scope.
 func (this *stateInstance) Read(req *http.Request, record Record) error {
 	// Check for read permission.
 	if !record.Can(req, CodeRead) {
 		return err403
 	}
 
-	// Read from the Datastore.
-	gc := appengine.NewContext(req)
-	err := datastore.Get(gc, this.Key(req, record), record)
-
-	// Compute properties.
-	this.Compute(record)
+	// Read from the store.
+	err := this.Store().Get(req, record)
 
-	// If the record is not found, return a 404 error, otherwise nil.
+	// If the record is not found or soft-deleted, return a 404 error.
 	if err != nil {
+		return notFound(err)
+	}
+	if isDeleted(record) {
 		return err404
 	}
-	return nil
+
+	// Hide a record out of the request's scope, see `scope.go`.
+	if err := checkScope(req, record); err != nil {
+		return err
+	}
+
+	// Compute properties.
+	this.Compute(record)
+
+	// Run the AfterRead hook.
+	return this.afterRead(req, record)
 }
 
-// Saves the given record to the Datastore.
+// Saves the given record to the store. If the record is Versioned, its version
+// must match the stored one, or Save fails with a 409 error; it is incremented
+// on success. See `version.go`. If the record is Indexed, its values in unique
+// indexes must be free, or Save fails with ErrDuplicate. See `index.go`. A new
+// record gets an id from the config's RndId, created only if it's free when the
+// store supports it; see `ids.go`. Runs the BeforeSave and AfterSave hooks,
+// see `hooks.go`.
 func (this *stateInstance) Save(req *http.Request, record Record) error {
 	// If the record is new, check the `create` permission.
 	if record.GetId() == "" && !record.Can(req, CodeCreate) {
@@ -92,36 +100,71 @@ func (this *stateInstance) Save(req *http.Request, record Record) error {
 		return err403
 	}
 
+	// Run the BeforeSave hook.
+	if err := this.beforeSave(req, record); err != nil {
+		return err
+	}
+
 	// Validate before saving.
-	if len(record.Validate(req)) != 0 {
-		return err422
+	if errs := record.Validate(req); len(errs) != 0 {
+		return ValidationError(errs)
 	}
 
 	// If the id is missing, set a random id.
+	fresh := map[int]bool{}
 	if record.GetId() == "" {
 		record.SetId(this.RndId())
+		fresh[0] = record.GetId() != ""
+	}
+
+	// Save to the store, setting the timestamps, checking the version and the
+	// unique values, retrying with a new id if the generated one is taken,
+	// recording the change in the audit log and publishing it.
+	errs := make(MultiError, 1)
+	if err := this.putTracked(req, []Record{record}, errs, fresh, fresh); err != nil {
+		return err
+	}
+	if errs[0] != nil {
+		return errs[0]
 	}
 
-	// Save to the Datastore.
-	gc := appengine.NewContext(req)
-	_, err := datastore.Put(gc, this.Key(req, record), record)
-	return err
+	// Run the AfterSave hook.
+	return this.afterSave(req, record)
 }
 
-// Deletes the given record from the Datastore.
+// Deletes the given record from the store, after its BeforeDelete hook. See
+// `hooks.go`. A SoftDeletable record is marked as deleted instead, and 404 is
+// returned if it already is. See `softdelete.go`.
 func (this *stateInstance) Delete(req *http.Request, record Record) error {
+	return this.delete(req, record, false)
+}
+
+// Deletes the record, or marks it as deleted if it's SoftDeletable and purge
+// is false.
+func (this *stateInstance) delete(req *http.Request, record Record, purge bool) error {
 	// Check for delete permission.
 	if !record.Can(req, CodeDelete) {
 		return err403
 	}
 
-	// Delete from the Datastore.
-	gc := appengine.NewContext(req)
-	err := datastore.Delete(gc, this.Key(req, record))
+	// Run the BeforeDelete hook.
+	if err := this.beforeDelete(req, record); err != nil {
+		return err
+	}
 
-	// If deletion fails, assume the record didn't exist and return 404.
-	if err != nil {
-		return err404
+	// Mark a soft-deletable record as deleted.
+	if _, ok := record.(SoftDeletable); ok && !purge {
+		errs := make(MultiError, 1)
+		if err := this.softDeleteMulti(req, []Record{record}, errs); err != nil {
+			return err
+		}
+		return errs[0]
 	}
-	return nil
+
+	// Delete from the store.
+	errs := make(MultiError, 1)
+	if err := this.removeMulti(req, []Record{record}, errs); err != nil {
+		return err
+	}
+	return errs[0]
 }
@@ -0,0 +1,296 @@
+package dsadapter
+
+// Relations between kinds and eager loading of related records.
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************* Constants *********************************/
+
+// Relation types.
+const (
+	// The record holds the id of one related record.
+	RelBelongsTo = iota
+	// Many related records hold the id of the record.
+	RelHasMany
+)
+
+/********************************* Relations *********************************/
+
+// Relation describes how records of one type refer to records of another.
+type Relation struct {
+	// One of the RelX constants.
+	Type int
+	// Stored property that holds the id: on this record for RelBelongsTo, on
+	// the related records for RelHasMany. Must be a string.
+	Key string
+	// Name of the struct field that receives the related records: a pointer to
+	// the related record type for RelBelongsTo, a slice of such pointers for
+	// RelHasMany. The related type is taken from the field. The field must not
+	// be stored; tag it with `datastore:"-"`.
+	Field string
+}
+
+/**
+ * Related is an optional interface for records that refer to records of other
+ * kinds. The map keys are relation names, used with Query.Include and Include:
+ *
+ *   type Post struct {
+ *     Id       string
+ *     AuthorId string
+ *     Author   *User      `datastore:"-" json:",omitempty"`
+ *     Comments []*Comment `datastore:"-" json:",omitempty"`
+ *   }
+ *
+ *   func (this *Post) Relations() map[string]dsa.Relation {
+ *     return map[string]dsa.Relation{
+ *       "author":   {Type: dsa.RelBelongsTo, Key: "AuthorId", Field: "Author"},
+ *       "comments": {Type: dsa.RelHasMany, Key: "PostId", Field: "Comments"},
+ *     }
+ *   }
+ */
+type Related interface {
+	Relations() map[string]Relation
+}
+
+/******************************* Eager Loading *******************************/
+
+// Loads the named relations of a record or a collection and attaches the
+// related records to their fields, with one batch read or query per relation
+// rather than one per record. Names may be paths through relations of related
+// records, like "comments.author". The related records are read like with
+// ReadMulti and Find: permissions are checked, they're computed, their hooks
+// run, and soft-deleted ones are left out. A RelBelongsTo field whose record
+// doesn't exist is set to nil. Find and FindOne do the same for the relations
+// in Query.Includes, before computing the found records.
+//
+// Returns a 400 error for unknown relation names.
+func (this *stateInstance) Include(req *http.Request, value interface{}, names ...string) error {
+	records := ToRecords(value)
+	if record, ok := value.(Record); ok {
+		records = []Record{record}
+	}
+	return this.include(req, records, names)
+}
+
+// Loads the relations at the given paths for the records.
+func (this *stateInstance) include(req *http.Request, records []Record, paths []string) error {
+	if len(records) == 0 || len(paths) == 0 {
+		return nil
+	}
+
+	// Group the paths by their first relation. The rest is loaded with the
+	// related records.
+	nested := map[string][]string{}
+	for _, path := range paths {
+		parts := strings.SplitN(path, ".", 2)
+		if len(parts) == 2 {
+			nested[parts[0]] = append(nested[parts[0]], parts[1])
+		} else if _, ok := nested[parts[0]]; !ok {
+			nested[parts[0]] = nil
+		}
+	}
+
+	// Sort the names for a predictable order.
+	names := make([]string, 0, len(nested))
+	for name := range nested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		relation, field, err := relationOf(records[0], name)
+		if err != nil {
+			return err
+		}
+
+		switch relation.Type {
+		case RelBelongsTo:
+			err = this.includeBelongsTo(req, records, relation, field, nested[name])
+		case RelHasMany:
+			err = this.includeHasMany(req, records, relation, field, nested[name])
+		default:
+			err = errRelation(records[0], name, "unknown relation type")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the records whose ids are held by the records, and sets each record's
+// field to its related record, or nil.
+func (this *stateInstance) includeBelongsTo(req *http.Request, records []Record, relation Relation, field reflect.StructField, nested []string) error {
+	// Make a related record for each distinct id.
+	related := []Record{}
+	seen := map[string]bool{}
+	for _, record := range records {
+		id, err := keyOf(record, relation.Key)
+		if err != nil {
+			return err
+		}
+		if id != "" && !seen[id] {
+			seen[id] = true
+			rec := reflect.New(field.Type.Elem()).Interface().(Record)
+			rec.SetId(id)
+			related = append(related, rec)
+		}
+	}
+
+	// Read them. Missing records are left out.
+	byId := map[string]Record{}
+	if err := this.readMulti(req, related, nested); err != nil {
+		multiErr, ok := err.(MultiError)
+		if !ok {
+			return err
+		}
+		for i, err := range multiErr {
+			if err != nil && ErrorCode(err) != 404 {
+				return err
+			} else if err != nil {
+				related[i] = nil
+			}
+		}
+	}
+	for _, rec := range related {
+		if rec != nil {
+			byId[rec.GetId()] = rec
+		}
+	}
+
+	// Attach them.
+	for _, record := range records {
+		id, _ := keyOf(record, relation.Key)
+		dst := refValue(record).FieldByIndex(field.Index)
+		if rec, ok := byId[id]; ok {
+			dst.Set(reflect.ValueOf(rec))
+		} else {
+			dst.Set(reflect.Zero(field.Type))
+		}
+	}
+	return nil
+}
+
+// Finds the related records that hold the ids of the records, and sets each
+// record's field to its related records.
+func (this *stateInstance) includeHasMany(req *http.Request, records []Record, relation Relation, field reflect.StructField, nested []string) error {
+	// Collect the distinct ids.
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, record := range records {
+		if id := record.GetId(); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	// Find the related records with one query. Stores that can't run `in`
+	// queries get one query per id.
+	collection := reflect.New(field.Type)
+	if len(ids) > 0 {
+		query := Query{Includes: nested}
+		_, err := this.Find(req, collection.Interface(), query.Filter(relation.Key, OpIn, ids))
+		if errors.Is(err, errOperator) {
+			collection = reflect.New(field.Type)
+			for _, id := range ids {
+				if _, err = this.Find(req, collection.Interface(), query.Filter(relation.Key, OpEq, id)); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Group them by the id they hold.
+	groups := map[string]reflect.Value{}
+	for _, rec := range ToRecords(collection.Interface()) {
+		id, err := keyOf(rec, relation.Key)
+		if err != nil {
+			return err
+		}
+		group, ok := groups[id]
+		if !ok {
+			group = reflect.MakeSlice(field.Type, 0, 1)
+		}
+		groups[id] = reflect.Append(group, reflect.ValueOf(rec))
+	}
+
+	// Attach them, with empty slices for records without related records.
+	for _, record := range records {
+		group, ok := groups[record.GetId()]
+		if !ok {
+			group = reflect.MakeSlice(field.Type, 0, 0)
+		}
+		refValue(record).FieldByIndex(field.Index).Set(group)
+	}
+	return nil
+}
+
+/********************************* Utilities *********************************/
+
+// Finds the named relation of the record and its field, checking that the
+// field has the right type.
+func relationOf(record Record, name string) (Relation, reflect.StructField, error) {
+	related, ok := record.(Related)
+	if !ok {
+		return Relation{}, reflect.StructField{}, errUnknownRelation(name)
+	}
+	relation, ok := related.Relations()[name]
+	if !ok {
+		return Relation{}, reflect.StructField{}, errUnknownRelation(name)
+	}
+
+	field, ok := refValue(record).Type().FieldByName(relation.Field)
+	if !ok {
+		return relation, field, errRelation(record, name, "no field "+relation.Field)
+	}
+
+	// Check the field type: *T for belongs-to, []*T for has-many.
+	typ := field.Type
+	if relation.Type == RelHasMany {
+		if typ.Kind() != reflect.Slice {
+			return relation, field, errRelation(record, name, "the field must be a slice")
+		}
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct || !typ.Implements(recordType) {
+		return relation, field, errRelation(record, name, "the field must hold record pointers")
+	}
+	return relation, field, nil
+}
+
+// Returns the string value of the stored property of the record.
+func keyOf(record Record, name string) (string, error) {
+	val := refValue(record)
+	prop, ok := propertyByName(val.Type(), name)
+	if !ok || prop.typ.Kind() != reflect.String {
+		return "", utils.Error("relation key " + name + " of " + record.Kind() + " must be a string property")
+	}
+	return prop.value(val).String(), nil
+}
+
+// The Record interface type.
+var recordType = reflect.TypeOf((*Record)(nil)).Elem()
+
+// Makes the error for an unknown relation name.
+func errUnknownRelation(name string) error {
+	return utils.NewHTTPError(400, "unknown_relation", "unknown relation: "+name).
+		WithDetails(map[string]interface{}{"relation": name})
+}
+
+// Makes the error for a relation that is declared wrong.
+func errRelation(record Record, name, msg string) error {
+	return utils.Error("relation " + name + " of " + record.Kind() + ": " + msg)
+}
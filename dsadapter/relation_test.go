@@ -0,0 +1,140 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Has many posts. Counts them in Compute.
+type testAuthor struct {
+	TestRecord
+	Id        string
+	Name      string
+	Posts     []*testPost `datastore:"-"`
+	PostCount int         `datastore:"-"`
+}
+
+func (this *testAuthor) Compute()        { this.PostCount = len(this.Posts) }
+func (this *testAuthor) GetId() string   { return this.Id }
+func (this *testAuthor) SetId(id string) { this.Id = id }
+func (this *testAuthor) Kind() string    { return "Author" }
+func (this *testAuthor) Relations() map[string]Relation {
+	return map[string]Relation{"posts": {Type: RelHasMany, Key: "AuthorId", Field: "Posts"}}
+}
+
+// Belongs to an author. Copies the author's name in Compute.
+type testPost struct {
+	TestRecord
+	Id       string
+	AuthorId string
+	Title    string
+	Author   *testAuthor `datastore:"-"`
+	Byline   string      `datastore:"-"`
+}
+
+func (this *testPost) GetId() string   { return this.Id }
+func (this *testPost) SetId(id string) { this.Id = id }
+func (this *testPost) Kind() string    { return "Post" }
+func (this *testPost) Relations() map[string]Relation {
+	return map[string]Relation{"author": {Type: RelBelongsTo, Key: "AuthorId", Field: "Author"}}
+}
+
+func (this *testPost) Compute() {
+	if this.Author != nil {
+		this.Byline = "by " + this.Author.Name
+	}
+}
+
+// Saves two authors with posts, and a post whose author doesn't exist.
+func mustSaveAuthors(t *testing.T, state State, req *http.Request) (*testAuthor, *testAuthor) {
+	t.Helper()
+	one, two := &testAuthor{Name: "one"}, &testAuthor{Name: "two"}
+	mustSave(t, state, req, one, two)
+	mustSave(t, state, req,
+		&testPost{AuthorId: one.Id, Title: "first"},
+		&testPost{AuthorId: one.Id, Title: "second"},
+		&testPost{AuthorId: two.Id, Title: "third"},
+		&testPost{AuthorId: "missing", Title: "orphan"},
+	)
+	return one, two
+}
+
+func TestInclude(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		one, two := mustSaveAuthors(t, state, req)
+
+		// Nested relations are loaded before computing the records.
+		posts := []*testPost{}
+		_, err := state.Find(req, &posts, Query{}.Include("author.posts"))
+		expectCode(t, err, 0)
+		if len(posts) != 4 {
+			t.Fatalf("expected 4 posts, got %d", len(posts))
+		}
+		counts := map[string]int{one.Id: 2, two.Id: 1}
+		for _, post := range posts {
+			if post.AuthorId == "missing" {
+				if post.Author != nil {
+					t.Fatalf("expected no author for %q, got %#v", post.Title, post.Author)
+				}
+				continue
+			}
+			if post.Author == nil || post.Author.Id != post.AuthorId || post.Byline != "by "+post.Author.Name {
+				t.Fatalf("expected the author of %q to be loaded first, got %#v", post.Title, post)
+			}
+			if post.Author.PostCount != counts[post.AuthorId] {
+				t.Fatalf("expected %d posts of %s, got %d", counts[post.AuthorId], post.AuthorId, post.Author.PostCount)
+			}
+		}
+
+		// Include loads them into records that were already read.
+		author := &testAuthor{Id: one.Id}
+		expectCode(t, state.Read(req, author), 0)
+		expectCode(t, state.Include(req, author, "posts"), 0)
+		if len(author.Posts) != 2 {
+			t.Fatalf("expected 2 posts, got %d", len(author.Posts))
+		}
+
+		// A record without related ones gets an empty list.
+		lonely := &testAuthor{Name: "lonely"}
+		mustSave(t, state, req, lonely)
+		expectCode(t, state.Include(req, lonely, "posts"), 0)
+		if lonely.Posts == nil || len(lonely.Posts) != 0 {
+			t.Fatalf("expected an empty list, got %#v", lonely.Posts)
+		}
+
+		expectCode(t, state.Include(req, lonely, "comments"), 400)
+	})
+}
+
+func TestHandlerInclude(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		one, _ := mustSaveAuthors(t, state, req)
+		handler := state.Handler("/api")
+
+		// Lists and single records load them before computing.
+		rw := testServe(handler, "GET", "/api/posts?include=author&Title=first", "")
+		posts := []*testPost{}
+		decodeBody(t, rw, &posts)
+		if len(posts) != 1 || posts[0].Byline != "by one" {
+			t.Fatalf("expected the computed byline, got %s", rw.Body)
+		}
+
+		rw = testServe(handler, "GET", "/api/authors/"+one.Id+"?include=posts", "")
+		author := &testAuthor{}
+		decodeBody(t, rw, author)
+		if len(author.Posts) != 2 || author.PostCount != 2 {
+			t.Fatalf("expected 2 computed posts, got %s", rw.Body)
+		}
+
+		rw = testServe(handler, "GET", "/api/authors/"+one.Id+"?include=comments", "")
+		if rw.Code != 400 || !strings.Contains(rw.Body.String(), "unknown_relation") {
+			t.Fatalf("expected 400, got %d: %s", rw.Code, rw.Body)
+		}
+		rw = testServe(handler, "GET", "/api/authors/missing?include=posts", "")
+		if rw.Code != 404 {
+			t.Fatalf("expected 404, got %d: %s", rw.Code, rw.Body)
+		}
+	})
+}
@@ -5,9 +5,6 @@ package dsadapter
 import (
 	// Standard
 	"reflect"
-
-	// Third party
-	"github.com/Mitranim/gotools/utils"
 )
 
 /**
@@ -64,7 +61,7 @@ func (this *stateInstance) SliceOf(value interface{}) interface{} {
 // SliceOf for the (roughly) opposite effect.
 func (this *stateInstance) NewRecordFromCollection(collection interface{}) (Record, error) {
 	// We're going to return this error if anything goes wrong.
-	err := utils.Error("a collection must be a slice of a struct pointer type that implements Record")
+	err := errCollection
 
 	val := reflect.ValueOf(collection)
 
@@ -91,8 +88,12 @@ func (this *stateInstance) NewRecordFromCollection(collection interface{}) (Reco
 		return nil, err
 	}
 
-	// Make an example Record.
+	// Make an example Record. For pointer types, point it to a zero struct, so
+	// its methods may use embedded structs.
 	rec := reflect.New(elemType).Elem().Interface()
+	if elemType.Kind() == reflect.Ptr {
+		rec = reflect.New(elemType.Elem()).Interface()
+	}
 
 	// Make sure it implements the Record interface.
 	record, ok := rec.(Record)
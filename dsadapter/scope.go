@@ -0,0 +1,133 @@
+package dsadapter
+
+// Row-level permissions: queries and writes limited to the records a request
+// may see.
+
+import (
+	// Standard
+	"net/http"
+	"reflect"
+)
+
+/********************************** Scoper ***********************************/
+
+/**
+ * Scoper is an optional interface for records whose visibility depends on the
+ * request, like posts that only their authors may see. Scope returns the
+ * filters that every query of the kind must satisfy for the request. The query
+ * is passed to look at, not to change: the filters are added to it, so they
+ * can only narrow it down. Example:
+ *
+ *   func (this *Post) Scope(req *http.Request, query dsa.Query) ([]dsa.Filter, error) {
+ *     user := currentUser(req)
+ *     if user == nil {
+ *       return nil, errUnauthorized
+ *     }
+ *     if user.Admin {
+ *       return nil, nil
+ *     }
+ *     return []dsa.Filter{{Field: "AuthorId", Op: dsa.OpEq, Value: user.Id}}, nil
+ *   }
+ *
+ * Find, and so FindOne, FindAll, FindByQuery, Export and the has-many
+ * relations of Include, only return records in the scope. An error from Scope
+ * fails the query. Read and ReadMulti return 404 for records out of the scope,
+ * as if they didn't exist, by checking the filters in memory. So do the writes
+ * of stored records: Save, SaveMulti, Patch, PatchJson, Delete, DeleteMulti,
+ * Restore and Purge check the stored copy, in the same transaction as the
+ * write if the store supports them. Save, SaveMulti, Patch and PatchJson also
+ * check the values being written, new records included, and return 403 for
+ * those out of the scope, so a request can't write records it couldn't see.
+ *
+ * Scope is called on a zero record of the kind, like Can in Find, so it
+ * mustn't depend on the record's fields. It must return the same filters for
+ * every page of a query, or the cursors won't line up.
+ */
+type Scoper interface {
+	Scope(*http.Request, Query) ([]Filter, error)
+}
+
+/********************************* Utilities *********************************/
+
+// Returns the query with the filters of the record's scope added, if it's a
+// Scoper. Asks a zero record of the type for the scope, so the record may be a
+// nil pointer, like the one made from a collection.
+func scopeQuery(req *http.Request, record Record, query Query) (Query, error) {
+	if _, ok := record.(Scoper); !ok {
+		return query, nil
+	}
+	zero := reflect.New(reflect.TypeOf(record).Elem()).Interface().(Scoper)
+	filters, err := zero.Scope(req, query)
+	if err != nil {
+		return query, err
+	}
+	for _, filter := range filters {
+		query = query.Filter(filter.Field, filter.Op, filter.Value)
+	}
+	return query, nil
+}
+
+// Returns 404 if the record is a Scoper and its values don't satisfy the
+// filters of its scope.
+func checkScope(req *http.Request, record Record) error {
+	ok, err := inScope(req, record)
+	if err == nil && !ok {
+		return err404
+	}
+	return err
+}
+
+// Returns true if the record isn't a Scoper, or if its values satisfy the
+// filters of its scope.
+func inScope(req *http.Request, record Record) (bool, error) {
+	if _, ok := record.(Scoper); !ok {
+		return true, nil
+	}
+	query, err := scopeQuery(req, record, Query{})
+	if err != nil || len(query.Filters) == 0 {
+		return err == nil, err
+	}
+
+	val := refValue(record)
+	compiled, err := compileQuery(val.Type(), query)
+	if err != nil {
+		return false, err
+	}
+	return compiled.match(val), nil
+}
+
+// Checks the scopes of the stored copies of records, see checkScope, writing
+// the failures into errs. Skips nil copies and records that already failed.
+func checkScopes(req *http.Request, stored []Record, errs MultiError) {
+	for i, record := range stored {
+		if record != nil && errs[i] == nil {
+			errs[i] = checkScope(req, record)
+		}
+	}
+}
+
+// Checks the scopes of records about to be written, writing 403 into errs for
+// those whose values are out of their scope, and other failures as they are.
+// Skips records that already failed.
+func checkWriteScopes(req *http.Request, records []Record, errs MultiError) {
+	for i, record := range records {
+		if errs[i] != nil {
+			continue
+		}
+		ok, err := inScope(req, record)
+		if err == nil && !ok {
+			err = err403
+		}
+		errs[i] = err
+	}
+}
+
+// Returns true if any of the records is a Scoper.
+func hasScope(records []Record) bool {
+	for _, record := range records {
+		if _, ok := record.(Scoper); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"testing"
+)
+
+// Scoped to the tickets of the user in the "User" header; requests without
+// the header see every ticket. Soft-deletable, to cover both deletions. The
+// label is computed.
+type testTicket struct {
+	TestRecord
+	SoftDelete
+	Id    string
+	Owner string
+	Text  string
+	Label string
+}
+
+func (this *testTicket) Compute()        { this.Label = this.Owner + ": " + this.Text }
+func (this *testTicket) GetId() string   { return this.Id }
+func (this *testTicket) SetId(id string) { this.Id = id }
+func (this *testTicket) Kind() string    { return "Ticket" }
+
+func (this *testTicket) Scope(req *http.Request, _ Query) ([]Filter, error) {
+	if user := req.Header.Get("User"); user != "" {
+		return []Filter{{Field: "Owner", Op: OpEq, Value: user}}, nil
+	}
+	return nil, nil
+}
+
+// Returns a request made by the given user.
+func testUserRequest(method, url, user string) *http.Request {
+	req := testRequest(method, url)
+	req.Header.Set("User", user)
+	return req
+}
+
+func TestScopeReads(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testTicket{Id: "1", Owner: "ann"}, &testTicket{Id: "2", Owner: "bob"})
+		ann := testUserRequest("GET", "/", "ann")
+
+		tickets := []*testTicket{}
+		expectCode(t, state.FindAll(ann, &tickets, nil), 0)
+		if len(tickets) != 1 || tickets[0].Id != "1" {
+			t.Fatalf("expected only the ticket of ann, got %#v", tickets)
+		}
+		expectCode(t, state.Read(ann, &testTicket{Id: "1"}), 0)
+
+		// Hidden records aren't computed.
+		hidden := &testTicket{Id: "2"}
+		expectCode(t, state.Read(ann, hidden), 404)
+		if hidden.Label != "" {
+			t.Fatalf("expected the hidden record not to be computed, got %#v", hidden)
+		}
+
+		err := state.ReadMulti(ann, []*testTicket{{Id: "1"}, {Id: "2"}})
+		multiErr, _ := err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || ErrorCode(multiErr[1]) != 404 {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+	})
+}
+
+func TestScopeWrites(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testTicket{Id: "1", Owner: "ann"}, &testTicket{Id: "2", Owner: "bob"})
+		ann := testUserRequest("GET", "/", "ann")
+
+		tests := []struct {
+			name string
+			err  error
+		}{
+			{"save", state.Save(ann, &testTicket{Id: "2", Owner: "ann"})},
+			{"patch", state.Patch(ann, &testTicket{Id: "2", Text: "mine"}, []string{"Text"})},
+			{"delete", state.Delete(ann, &testTicket{Id: "2"})},
+			{"purge", state.Purge(ann, &testTicket{Id: "2"})},
+			{"restore", state.Restore(ann, &testTicket{Id: "2"})},
+		}
+		for _, test := range tests {
+			if ErrorCode(test.err) != 404 {
+				t.Errorf("%s: expected 404, got %v", test.name, test.err)
+			}
+		}
+
+		// Only the records out of the scope fail in batches.
+		for name, err := range map[string]error{
+			"save multi":   state.SaveMulti(ann, []*testTicket{{Id: "1", Owner: "ann"}, {Id: "2", Owner: "ann"}}),
+			"delete multi": state.DeleteMulti(ann, []*testTicket{{Id: "1"}, {Id: "2"}}),
+		} {
+			multiErr, _ := err.(MultiError)
+			if len(multiErr) != 2 || multiErr[0] != nil || ErrorCode(multiErr[1]) != 404 {
+				t.Errorf("%s: expected only the ticket of bob to fail, got %v", name, err)
+			}
+		}
+
+		// The ticket of bob is untouched.
+		read := &testTicket{Id: "2"}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Owner != "bob" || read.Text != "" || read.Deleted {
+			t.Fatalf("expected the ticket of bob to be untouched, got %#v", read)
+		}
+	})
+}
+
+func TestScopeWrittenValues(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testTicket{Id: "1", Owner: "ann"})
+		ann := testUserRequest("GET", "/", "ann")
+
+		// Records can't be written out of the scope, new or stored.
+		tests := []struct {
+			name string
+			err  error
+		}{
+			{"create", state.Save(ann, &testTicket{Owner: "bob"})},
+			{"save", state.Save(ann, &testTicket{Id: "1", Owner: "bob"})},
+			{"patch", state.Patch(ann, &testTicket{Id: "1", Owner: "bob"}, []string{"Owner"})},
+		}
+		for _, test := range tests {
+			if ErrorCode(test.err) != 403 {
+				t.Errorf("%s: expected 403, got %v", test.name, test.err)
+			}
+		}
+		err := state.SaveMulti(ann, []*testTicket{{Owner: "ann"}, {Owner: "bob"}})
+		multiErr, _ := err.(MultiError)
+		if len(multiErr) != 2 || multiErr[0] != nil || ErrorCode(multiErr[1]) != 403 {
+			t.Errorf("expected only the ticket of bob to fail, got %v", err)
+		}
+
+		tickets := []*testTicket{}
+		expectCode(t, state.FindAll(req, &tickets, map[string]string{"Owner": "bob"}), 0)
+		if len(tickets) != 0 {
+			t.Fatalf("expected no tickets of bob, got %#v", tickets)
+		}
+	})
+}
+
+func TestHandlerScopes(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testTicket{Id: "1", Owner: "ann"}, &testTicket{Id: "2", Owner: "bob"})
+		handler := state.Handler("/api")
+
+		tests := []struct {
+			method string
+			body   string
+		}{
+			{"GET", ""},
+			{"PUT", `{"Owner":"ann"}`},
+			{"PATCH", `{"Text":"mine"}`},
+			{"DELETE", ""},
+		}
+		for _, test := range tests {
+			rw := testServe(handler, test.method, "/api/tickets/2", test.body, "User", "ann")
+			if rw.Code != 404 {
+				t.Errorf("%s: expected 404, got %d: %s", test.method, rw.Code, rw.Body)
+			}
+		}
+
+		read := &testTicket{Id: "2"}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Owner != "bob" || read.Text != "" {
+			t.Fatalf("expected the ticket of bob to be untouched, got %#v", read)
+		}
+	})
+}
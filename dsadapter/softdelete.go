@@ -0,0 +1,204 @@
+package dsadapter
+
+// Soft deletion: records marked as deleted instead of removed.
+
+import (
+	// Standard
+	"net/http"
+	"time"
+)
+
+/******************************** Soft Delete ********************************/
+
+// Name of the stored property that holds the deletion mark.
+const softDeleteProperty = "Deleted"
+
+// SoftDeletable is an optional interface for records that are marked as
+// deleted instead of removed from the store, so they can be recovered. For
+// these records, Delete and DeleteMulti write the mark, Read, ReadMulti, Save,
+// SaveMulti, Patch and PatchJson treat marked records as missing (404), and
+// Find and FindOne leave them out unless Query.WithDeleted is set. Restore
+// brings them back. Embed SoftDelete to implement it.
+//
+// The mark must be stored in a bool property named "Deleted", which Find
+// filters on. Records stored before the type became soft-deletable lack the
+// property, and stores may leave them out of Find results until they're saved
+// again.
+type SoftDeletable interface {
+	// Returns true if the record is marked as deleted.
+	IsDeleted() bool
+
+	// Side effect: must mark self as deleted at the given time, or as not
+	// deleted if the time is zero.
+	SetDeleted(time.Time)
+}
+
+/**
+ * SoftDelete implements SoftDeletable. Embed it in a record type:
+ *
+ *   type Engine struct {
+ *     dsadapter.SoftDelete
+ *     Id   string
+ *     Name string
+ *   }
+ */
+type SoftDelete struct {
+	Deleted   bool
+	DeletedAt time.Time
+}
+
+// IsDeleted method.
+func (this *SoftDelete) IsDeleted() bool {
+	return this.Deleted
+}
+
+// SetDeleted method. Sets both fields.
+func (this *SoftDelete) SetDeleted(at time.Time) {
+	this.Deleted = !at.IsZero()
+	this.DeletedAt = at
+}
+
+/********************************* Recovery **********************************/
+
+// Clears the deletion mark of a soft-deleted record and saves it, reading the
+// record from the store into the given one. The save is a regular Save: it
+// checks CodeUpdate, runs the hooks and validates the record. Does nothing if
+// the record isn't deleted. Returns 404 if the record doesn't exist.
+func (this *stateInstance) Restore(req *http.Request, record Record) error {
+	deletable, ok := record.(SoftDeletable)
+	if !ok {
+		return errNotSoft
+	}
+
+	return this.atomically(req, func(state *stateInstance) error {
+		// Read the record, including the mark, hiding it if it's out of the
+		// request's scope.
+		if err := state.Store().Get(req, record); err != nil {
+			return notFound(err)
+		}
+		if err := checkScope(req, record); err != nil {
+			return err
+		}
+		state.Compute(record)
+		if !deletable.IsDeleted() {
+			return nil
+		}
+
+		// Clear the mark and save, with a state that may write over the
+		// soft-deleted copy.
+		deletable.SetDeleted(time.Time{})
+		restorer := *state
+		restorer.writesDeleted = true
+		return restorer.Save(req, record)
+	})
+}
+
+// Deletes the given record from the store for good, even if it's
+// SoftDeletable. Otherwise behaves like Delete.
+func (this *stateInstance) Purge(req *http.Request, record Record) error {
+	return this.delete(req, record, true)
+}
+
+/********************************* Utilities *********************************/
+
+// Returns true if the record is SoftDeletable and marked as deleted.
+func isDeleted(record Record) bool {
+	deletable, ok := record.(SoftDeletable)
+	return ok && deletable.IsDeleted()
+}
+
+// Returns true if the record is SoftDeletable and the property is its
+// deletion mark.
+func isDeletionMark(record Record, prop property) bool {
+	_, ok := record.(SoftDeletable)
+	return ok && prop.name == softDeleteProperty
+}
+
+// Returns true if Find should leave soft-deleted records out of the query:
+// the records are SoftDeletable, the query doesn't ask for deleted records,
+// and it doesn't filter on the mark itself.
+func hidesDeleted(record Record, query Query) bool {
+	if _, ok := record.(SoftDeletable); !ok || query.WithDeleted {
+		return false
+	}
+	for _, filter := range query.Filters {
+		if filter.Field == softDeleteProperty {
+			return false
+		}
+	}
+	return true
+}
+
+// Marks the records that don't have an error in errs yet as deleted, writing
+// the failures into errs. The stored copies are read and written back with the
+// mark, so the caller's records may hold just the ids. Records that are missing
+// or already deleted get 404. Versions are incremented and timestamps touched
+// like on Save, and the deletions are recorded in the audit log and published.
+// The read and the write run in a transaction if the store supports them, and
+// big batches are split into several, see `transaction.go`. Returns an error
+// only if the whole batch failed.
+func (this *stateInstance) softDeleteMulti(req *http.Request, records []Record, errs MultiError) error {
+	at := now()
+	return this.inChunks(records, func(start, end int) error {
+		return this.softDeleteChunk(req, records[start:end], errs[start:end], at)
+	})
+}
+
+// Marks the records for softDeleteMulti, in one transaction if possible.
+func (this *stateInstance) softDeleteChunk(req *http.Request, records []Record, errs MultiError, at time.Time) error {
+	initial := append(MultiError{}, errs...)
+
+	return this.atomically(req, func(state *stateInstance) error {
+		// A transaction may run more than once, so start over each time.
+		copy(errs, initial)
+
+		// Read the stored copies.
+		stored := make([]Record, len(records))
+		for i, record := range records {
+			stored[i] = newRecordLike(record)
+		}
+		if err := state.multi(req, stored, errs, BatchStore.GetMulti, Store.Get, notFound); err != nil {
+			return err
+		}
+
+		// Keep copies for the audit log.
+		var befores []Record
+		if state.audits() {
+			befores = make([]Record, len(stored))
+			for i, record := range stored {
+				befores[i] = newRecordLike(record)
+				copyFields(refValue(befores[i]), refValue(record))
+			}
+		}
+
+		// Mark them.
+		for i, record := range stored {
+			if errs[i] != nil {
+				continue
+			}
+			if isDeleted(record) {
+				errs[i] = err404
+				continue
+			}
+			if errs[i] = checkScope(req, record); errs[i] != nil {
+				continue
+			}
+			record.(SoftDeletable).SetDeleted(at)
+			if versioned, ok := record.(Versioned); ok {
+				versioned.SetVersion(versioned.GetVersion() + 1)
+			}
+			touch(record, nil, at)
+		}
+
+		// Write them back.
+		if err := state.multi(req, stored, errs, BatchStore.PutMulti, Store.Put, nil); err != nil {
+			return err
+		}
+		if befores != nil {
+			if err := state.audit(req, befores, stored, errs); err != nil {
+				return err
+			}
+		}
+		return state.publish(req, changeEvents(CodeDelete, stored, nil, errs, false))
+	})
+}
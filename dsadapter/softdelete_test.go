@@ -0,0 +1,86 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestSoftDelete(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		one, two := &testNote{Text: "one"}, &testNote{Text: "two"}
+		mustSave(t, state, req, one, two)
+
+		// Deleted records are hidden, but kept.
+		expectCode(t, state.Delete(req, &testNote{Id: one.Id}), 0)
+		expectCode(t, state.Delete(req, &testNote{Id: one.Id}), 404)
+		expectCode(t, state.Read(req, &testNote{Id: one.Id}), 404)
+		expectCode(t, state.Patch(req, &testNote{Id: one.Id}, []string{"Text"}), 404)
+		expectCode(t, state.FindOne(req, &testNote{}, NewQuery(map[string]string{"Text": "one"})), 404)
+		rw := testServe(state.Handler("/api"), "PUT", "/api/notes/"+one.Id, `{"Text":"back"}`)
+		if rw.Code != 404 {
+			t.Fatalf("expected 404 for a PUT, got %d: %s", rw.Code, rw.Body)
+		}
+
+		notes := []*testNote{}
+		expectCode(t, state.FindAll(req, &notes, nil), 0)
+		if len(notes) != 1 {
+			t.Fatalf("expected 1 visible record, got %d", len(notes))
+		}
+		notes = nil
+		_, err := state.Find(req, &notes, Query{WithDeleted: true})
+		expectCode(t, err, 0)
+		if len(notes) != 2 {
+			t.Fatalf("expected 2 records with the deleted ones, got %d", len(notes))
+		}
+
+		// They can be found by the mark, but not through URLs. Deleting bumps
+		// the version.
+		for _, key := range []string{"deleted", "deleted__eq", "Deleted__ne"} {
+			_, err := ParseQuery(&testNote{}, url.Values{key: {"true"}})
+			expectCode(t, err, 400)
+		}
+		notes = nil
+		_, err = state.Find(req, &notes, Query{}.Filter("Deleted", OpEq, true))
+		expectCode(t, err, 0)
+		if len(notes) != 1 || notes[0].Id != one.Id || notes[0].DeletedAt.IsZero() || notes[0].Version != 2 {
+			t.Fatalf("expected the deleted record, got %#v", notes)
+		}
+
+		// A save of a copy read before the deletion doesn't bring it back.
+		stale := &testNote{Id: two.Id}
+		expectCode(t, state.Read(req, stale), 0)
+		expectCode(t, state.Delete(req, &testNote{Id: two.Id}), 0)
+		expectCode(t, state.Save(req, stale), 404)
+		stale.Version = 0
+		expectCode(t, state.Save(req, stale), 404)
+
+		// Restored records are visible again.
+		restored := &testNote{Id: one.Id}
+		expectCode(t, state.Restore(req, restored), 0)
+		if restored.Deleted || restored.Text != "one" {
+			t.Fatalf("expected the restored record, got %#v", restored)
+		}
+		expectCode(t, state.Read(req, &testNote{Id: one.Id}), 0)
+
+		// Restoring them again does nothing.
+		expectCode(t, state.Restore(req, &testNote{Id: one.Id}), 0)
+
+		// Batches report deleted records per index.
+		err = state.DeleteMulti(req, []*testNote{{Id: one.Id}, {Id: two.Id}})
+		multiErr, _ := err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || ErrorCode(multiErr[1]) != 404 {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+
+		// Purged records are gone.
+		expectCode(t, state.Purge(req, &testNote{Id: one.Id}), 0)
+		notes = nil
+		_, err = state.Find(req, &notes, Query{WithDeleted: true})
+		expectCode(t, err, 0)
+		if len(notes) != 1 {
+			t.Fatalf("expected 1 record left, got %d", len(notes))
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	// Standard
 	"net/http"
 	"reflect"
+	"sort"
 )
 
 // If the given value is non-nil and has a computer interface, this calls its
@@ -47,8 +48,54 @@ func (this *stateInstance) RndId() string {
 	return RndId()
 }
 
+// Returns the storage backend used by this state.
+func (this *stateInstance) Store() Store {
+	return this.config.Store
+}
+
+// If the store keeps a schema for each kind (see SchemaStore), this creates or
+// updates the schema for every registered resource, for the audit log if the
+// config's Audit sink is an AuditKind, and for the outbox if the Publisher is
+// an Outbox. Otherwise this is a no-op. Call it once on startup, after
+// registering resources.
+func (this *stateInstance) SyncSchema(req *http.Request) error {
+	store, ok := this.Store().(SchemaStore)
+	if !ok {
+		return nil
+	}
+
+	// Sort the resource names for a predictable order.
+	names := make([]string, 0, len(this.Resources()))
+	for name := range this.Resources() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]Record, 0, len(names))
+	for _, name := range names {
+		records = append(records, this.NewRecordByResource(name))
+	}
+	if _, ok := this.config.Audit.(*AuditKind); ok {
+		records = append(records, &auditRecord{})
+	}
+	if _, ok := this.config.Publisher.(*Outbox); ok {
+		records = append(records, &outboxRecord{})
+	}
+
+	return store.SyncSchema(req, records)
+}
+
 /*--------------------------------- Private ---------------------------------*/
 
+// Creates or updates the schema of the given internal records in stores that
+// keep one, like SyncSchema does for resources.
+func (this *stateInstance) syncSchemaOf(req *http.Request, records ...Record) error {
+	if store, ok := this.Store().(SchemaStore); ok {
+		return store.SyncSchema(req, records)
+	}
+	return nil
+}
+
 // Logs using the passed or the default logger.
 func (this *stateInstance) log(req *http.Request, values ...interface{}) {
 	if this.config.Logger != nil {
@@ -6,10 +6,8 @@ package dsadapter
 
 import (
 	// Standard
+	"io"
 	"net/http"
-
-	// App Engine
-	"appengine/datastore"
 )
 
 /****************************** State Interface ******************************/
@@ -22,23 +20,57 @@ type State interface {
 
 	// See `record.go`.
 
-	Key(*http.Request, Record) *datastore.Key
-
 	// CRUD
 	Read(*http.Request, Record) error
 	Save(*http.Request, Record) error
 	Delete(*http.Request, Record) error
 
+	// Partial updates, see `patch.go`.
+	Patch(*http.Request, Record, []string) error
+	PatchJson(*http.Request, Record, []byte) error
+
 	// Query
-	FindOne(*http.Request, Record, map[string]string) error
+	FindOne(*http.Request, Record, Query) error
+
+	// Eager loading of a record's or a collection's relations, see
+	// `relation.go`.
+	Include(*http.Request, interface{}, ...string) error
+
+	// Soft deletion, see `softdelete.go`.
+	Restore(*http.Request, Record) error
+	Purge(*http.Request, Record) error
+
+	// Field permissions, see `fields.go`.
+	Readable(*http.Request, interface{}) interface{}
+	CheckWrites(*http.Request, Record, Record) error
+
+	// Audit log, see `audit.go`.
+	History(*http.Request, Record) ([]AuditEntry, error)
+
+	// Change events, see `events.go`.
+	Subscribe(string, func(*http.Request, ChangeEvent)) func()
 
 	/*------------------------- Collection Operations -------------------------*/
 
 	// See `collection.go`.
 
-	Find(*http.Request, interface{}, map[string]string, int) error
+	Find(*http.Request, interface{}, Query) (string, error)
 	FindAll(*http.Request, interface{}, map[string]string) error
-	FindByQuery(*http.Request, interface{}) error
+	FindByQuery(*http.Request, interface{}) (string, error)
+
+	/*--------------------------- Batch Operations ----------------------------*/
+
+	// See `batch.go`.
+
+	ReadMulti(*http.Request, interface{}) error
+	SaveMulti(*http.Request, interface{}) error
+	DeleteMulti(*http.Request, interface{}) error
+
+	/*----------------------------- Transactions ------------------------------*/
+
+	// See `transaction.go`.
+
+	RunInTransaction(*http.Request, func(State) error) error
 
 	/*------------------------------- Resources -------------------------------*/
 
@@ -50,13 +82,44 @@ type State interface {
 	SliceOf(interface{}) interface{}
 	NewRecordFromCollection(interface{}) (Record, error)
 
+	/*--------------------------------- HTTP ----------------------------------*/
+
+	// See `handler.go`.
+
+	Handler(string) http.Handler
+
 	/*------------------------------- Populate --------------------------------*/
 
 	// See `populate.go`.
 
-	PopulateFuncs() map[string]func(*http.Request)
+	RegisterSeeds(SeedSet)
 	RegisterForPopulate(interface{})
-	Populate(*http.Request)
+	SeedSets() []SeedSet
+	Populate(*http.Request) error
+	SeedChanges(*http.Request) ([]SeedChange, error)
+	DryRunPopulate(*http.Request, io.Writer) error
+
+	// See `fixtures.go`.
+
+	ReadFixtures(string) (map[string]interface{}, error)
+	LoadFixtures(string) error
+
+	/*---------------------------- Export / Import ----------------------------*/
+
+	// See `export.go`.
+
+	Export(*http.Request, string, io.Writer) error
+	Import(*http.Request, string, io.Reader, ImportOptions) (ImportResult, error)
+
+	/*------------------------------ Migrations -------------------------------*/
+
+	// See `migration.go`.
+
+	RegisterMigration(Migration)
+	Migrations() []Migration
+	MigrationStatuses(*http.Request) ([]MigrationStatus, error)
+	Migrate(*http.Request, func(MigrationStatus)) error
+	MigrationHandler() http.Handler
 
 	/*------------------------------- Utilities -------------------------------*/
 
@@ -64,13 +127,23 @@ type State interface {
 
 	Compute(interface{})
 	RndId() string
+	Store() Store
+	SyncSchema(*http.Request) error
 }
 
 /******************************* stateInstance *******************************/
 
 // A type that implements State.
 type stateInstance struct {
-	resources     map[string]Record
-	populateFuncs map[string]func(*http.Request)
-	config        Config
+	resources  map[string]Record
+	seeds      []SeedSet
+	migrations []Migration
+	config     Config
+	// True for the state passed to a RunInTransaction callback.
+	inTransaction bool
+	// Change events to publish after the transaction commits.
+	pending *[]ChangeEvent
+	// True for the states that Restore and Import save with, which may write
+	// over soft-deleted records.
+	writesDeleted bool
 }
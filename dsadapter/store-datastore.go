@@ -0,0 +1,288 @@
+//go:build appengine
+// +build appengine
+
+package dsadapter
+
+// Store implementation backed by the App Engine Datastore.
+
+import (
+	// Standard
+	"net/http"
+	"reflect"
+
+	// App Engine
+	"appengine"
+	"appengine/datastore"
+)
+
+/********************************* Datastore *********************************/
+
+// Datastore is a Store that keeps records in the App Engine Datastore. Each
+// record is saved under a key made of its kind and string id. This is the
+// default store on App Engine.
+type Datastore struct {
+	// Transaction context, if any. See RunInTransaction.
+	tc appengine.Context
+}
+
+// Returns a datastore key for the given record. The numeric id is always 0 and
+// the parent key is always nil.
+func (this Datastore) Key(req *http.Request, record Record) *datastore.Key {
+	gc := this.context(req)
+	return datastore.NewKey(gc, record.Kind(), record.GetId(), 0, nil)
+}
+
+// Reads the given record from the Datastore.
+func (this Datastore) Get(req *http.Request, record Record) error {
+	gc := this.context(req)
+	return missing(datastore.Get(gc, this.Key(req, record), record))
+}
+
+// Saves the given record to the Datastore.
+func (this Datastore) Put(req *http.Request, record Record) error {
+	gc := this.context(req)
+	_, err := datastore.Put(gc, this.Key(req, record), record)
+	return err
+}
+
+// Saves the given record to the Datastore unless its key is taken, checking
+// and writing in one transaction. Returns ErrExists if the key is taken.
+func (this Datastore) Create(req *http.Request, record Record) error {
+	return this.RunInTransaction(req, func(store Store) error {
+		tx := store.(Datastore)
+		gc := tx.context(req)
+		key := tx.Key(req, record)
+
+		err := datastore.Get(gc, key, &datastore.PropertyList{})
+		if err == nil {
+			return ErrExists
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(gc, key, record)
+		return err
+	})
+}
+
+// Deletes the given record from the Datastore.
+func (this Datastore) Delete(req *http.Request, record Record) error {
+	gc := this.context(req)
+	return datastore.Delete(gc, this.Key(req, record))
+}
+
+// Reads the records with datastore.GetMulti, up to datastoreBatchSize at a
+// time.
+func (this Datastore) GetMulti(req *http.Request, records []Record) error {
+	gc := this.context(req)
+	keys := this.keys(req, records)
+	return this.multi(len(records), func(start, end int) error {
+		return datastore.GetMulti(gc, keys[start:end], records[start:end])
+	})
+}
+
+// Saves the records with datastore.PutMulti, up to datastoreBatchSize at a
+// time.
+func (this Datastore) PutMulti(req *http.Request, records []Record) error {
+	gc := this.context(req)
+	keys := this.keys(req, records)
+	return this.multi(len(records), func(start, end int) error {
+		_, err := datastore.PutMulti(gc, keys[start:end], records[start:end])
+		return err
+	})
+}
+
+// Deletes the records with datastore.DeleteMulti, up to datastoreBatchSize at
+// a time.
+func (this Datastore) DeleteMulti(req *http.Request, records []Record) error {
+	gc := this.context(req)
+	keys := this.keys(req, records)
+	return this.multi(len(records), func(start, end int) error {
+		return datastore.DeleteMulti(gc, keys[start:end])
+	})
+}
+
+// Runs the function with a Datastore whose operations use a cross-group
+// transaction. The transaction is tried once; if it fails because of
+// concurrent changes, returns ErrTransactionConflict so the State can run it
+// again. Datastore transactions only allow ancestor queries, so Find and
+// GetAll fail inside them unless you run your own ancestor queries. Inside a
+// transaction, calls the function with the same store.
+func (this Datastore) RunInTransaction(req *http.Request, fn func(Store) error) error {
+	if this.tc != nil {
+		return fn(this)
+	}
+
+	gc := appengine.NewContext(req)
+	err := datastore.RunInTransaction(gc, func(tc appengine.Context) error {
+		return fn(Datastore{tc: tc})
+	}, &datastore.TransactionOptions{XG: true, Attempts: 1})
+
+	if err == datastore.ErrConcurrentTransaction {
+		return ErrTransactionConflict.Wrap(err)
+	}
+	return err
+}
+
+// Runs a query of the given kind, writing the results to the collection. The
+// Datastore doesn't support the OpNe and OpIn operators; queries using them
+// fail with a 400 error. Other restrictions of Datastore queries apply, such
+// as needing composite indexes.
+//
+// When the query has a limit and the limit is reached, returns the Datastore
+// cursor after the last result. The next page may turn out to be empty.
+func (this Datastore) GetAll(req *http.Request, kind string, collection interface{}, query Query) (string, error) {
+	gc := this.context(req)
+
+	col := reflect.ValueOf(collection)
+	if col.Kind() != reflect.Ptr || col.Elem().Kind() != reflect.Slice {
+		return "", errCollection
+	}
+	col = col.Elem()
+
+	// Figure out the element type and the underlying struct type.
+	elemType := col.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	q, err := this.query(kind, query)
+	if err != nil {
+		return "", err
+	}
+
+	// Run the query, appending to the collection. Like Query.GetAll, treat
+	// field mismatches as non-fatal and return the first one.
+	var mismatch error
+	count := 0
+	iter := q.Run(gc)
+	for {
+		elem := reflect.New(structType)
+		key, err := iter.Next(elem.Interface())
+		if err == datastore.Done {
+			break
+		}
+		if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+			if mismatch == nil {
+				mismatch = err
+			}
+		} else if err != nil {
+			return "", err
+		}
+
+		// Make sure the id is set even if it's not stored as a property.
+		if record, ok := elem.Interface().(Record); ok {
+			record.SetId(key.StringID())
+		}
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		col.Set(reflect.Append(col, elem))
+		count++
+	}
+
+	// Only return a cursor if there may be more results.
+	if query.Limit <= 0 || count < query.Limit {
+		return "", mismatch
+	}
+	cursor, err := iter.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return cursor.String(), mismatch
+}
+
+// Converts a Query into a Datastore query of the given kind.
+func (Datastore) query(kind string, query Query) (*datastore.Query, error) {
+	q := datastore.NewQuery(kind)
+
+	for _, filter := range query.Filters {
+		switch filter.Op {
+		case OpEq, OpLt, OpLte, OpGt, OpGte:
+			q = q.Filter(filter.Field+" "+filter.Op, filter.Value)
+		default:
+			return nil, errOperator.WithDetails(map[string]interface{}{"operator": filter.Op})
+		}
+	}
+
+	for _, order := range query.Orders {
+		q = q.Order(order)
+	}
+
+	if len(query.Fields) > 0 {
+		q = q.Project(query.Fields...)
+	}
+
+	if query.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(query.Cursor)
+		if err != nil {
+			return nil, errCursor
+		}
+		q = q.Start(cursor)
+	}
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	// Zero or negative means no limit.
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+
+	return q, nil
+}
+
+// Returns the transaction context, if any, or a new App Engine context for the
+// request.
+func (this Datastore) context(req *http.Request) appengine.Context {
+	if this.tc != nil {
+		return this.tc
+	}
+	return appengine.NewContext(req)
+}
+
+// Largest number of entities in one Datastore batch call.
+const datastoreBatchSize = 500
+
+// Returns the keys of the given records.
+func (this Datastore) keys(req *http.Request, records []Record) []*datastore.Key {
+	keys := make([]*datastore.Key, len(records))
+	for i, record := range records {
+		keys[i] = this.Key(req, record)
+	}
+	return keys
+}
+
+// Calls the given function with consecutive ranges of up to
+// datastoreBatchSize records, and converts an appengine.MultiError from each
+// call into entries of one MultiError, with missing entities as err404.
+func (this Datastore) multi(count int, fn func(start, end int) error) error {
+	errs := make(MultiError, count)
+	for start := 0; start < count; start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > count {
+			end = count
+		}
+
+		err := fn(start, end)
+		if multiErr, ok := err.(appengine.MultiError); ok {
+			for i, err := range multiErr {
+				errs[start+i] = missing(err)
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return errs.orNil()
+}
+
+// Converts datastore.ErrNoSuchEntity to err404, keeping it as the cause. Other
+// errors are returned as-is.
+func missing(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return err404.Wrap(err)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package dsadapter
+
+// Storage backend interface. A State delegates all persistence to a Store
+// passed in the config, which lets the package run against any database.
+
+import (
+	// Standard
+	"net/http"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/****************************** Store Interface ******************************/
+
+// Store is a storage backend used by a State. Records are identified by their
+// kind and id. Permission checks, validation and computed properties are
+// handled by the State; a Store only moves data.
+type Store interface {
+
+	// Must read the record identified by its kind and id into the record. Must
+	// return an error with a 404 status (see ErrorCode) if the record doesn't
+	// exist.
+	Get(*http.Request, Record) error
+
+	// Must write the record under its kind and id, overwriting any existing
+	// record with the same key.
+	Put(*http.Request, Record) error
+
+	// Must delete the record identified by its kind and id.
+	Delete(*http.Request, Record) error
+
+	// Takes a kind, a pointer to a Collection and a query. Must find records of
+	// the given kind that satisfy the query and append them to the collection.
+	// Must return a 400 error for queries it can't run. If there may be more
+	// results after the last one, must return an opaque URL-safe cursor that
+	// resumes the same query when passed in Query.Cursor. Otherwise must return
+	// an empty cursor.
+	GetAll(*http.Request, string, interface{}, Query) (string, error)
+}
+
+/**************************** Optional Interfaces ****************************/
+
+// SchemaStore is implemented by stores that keep a schema for each kind, such
+// as SQL databases. See State.SyncSchema.
+type SchemaStore interface {
+	// Must create or update the storage for the kind of each record, using the
+	// record's type as the schema.
+	SyncSchema(*http.Request, []Record) error
+}
+
+// IndexStore is implemented by stores that enforce the unique indexes of
+// Indexed records themselves, such as SQL databases with unique constraints.
+// The State keeps index entities for other stores. See Indexed.
+type IndexStore interface {
+	// Must return true if Put and PutMulti fail with an error matching
+	// ErrDuplicate when a write would break a unique index.
+	EnforcesUnique() bool
+}
+
+// CreateStore is implemented by stores that can write a record only if its id
+// is free, in one step. Save and SaveMulti use it for records with generated
+// ids, so a taken id is detected instead of overwriting another record. See
+// `ids.go`.
+type CreateStore interface {
+	// Must write the record like Put, unless the kind already has a record with
+	// its id. Then must write nothing and return an error matching ErrExists.
+	Create(*http.Request, Record) error
+}
+
+// BatchStore is implemented by stores that can read, write and delete many
+// records in fewer round trips than one per record. See State.ReadMulti,
+// SaveMulti and DeleteMulti. Stores that don't implement it are called once
+// per record.
+//
+// If some records fail, each method must return a MultiError with one entry
+// per record, in the same order. Any other error means the whole batch failed.
+type BatchStore interface {
+	GetMulti(*http.Request, []Record) error
+	PutMulti(*http.Request, []Record) error
+	DeleteMulti(*http.Request, []Record) error
+}
+
+// TransactionStore is implemented by stores that can run several operations
+// atomically. See State.RunInTransaction.
+type TransactionStore interface {
+	// Must call the function with a store whose operations run in one
+	// transaction. Must commit if the function returns nil and roll back
+	// otherwise, returning the function's error. If the transaction fails
+	// because of concurrent changes and may succeed if run again, must return
+	// an error that matches ErrTransactionConflict with errors.Is.
+	RunInTransaction(*http.Request, func(Store) error) error
+}
+
+// Returned by transactions that failed because of concurrent changes. State's
+// RunInTransaction runs the transaction again when it gets this error. Stores
+// should wrap their own errors with ErrTransactionConflict.Wrap(err).
+var ErrTransactionConflict = utils.NewHTTPError(409, "transaction_conflict", "transaction failed because of concurrent changes")
+
+// Returned when a write would give a record the same values in a unique index
+// as another record of the kind. See Indexed. Stores that implement IndexStore
+// should wrap their own errors with ErrDuplicate.Wrap(err).
+var ErrDuplicate = utils.NewHTTPError(409, "duplicate", "conflict: another record has the same unique values")
+
+// Returned when a record to create has the id of a stored record of the kind.
+// Stores that implement CreateStore should return it, or wrap their own errors
+// with ErrExists.Wrap(err).
+var ErrExists = utils.NewHTTPError(409, "exists", "conflict: a record with this id already exists")
+
+/********************************** noStore **********************************/
+
+// Placeholder used when no store was configured and the runtime doesn't
+// provide a default one. Every operation fails with a 500 error.
+type noStore struct{}
+
+func (noStore) Get(*http.Request, Record) error    { return errNoStore }
+func (noStore) Put(*http.Request, Record) error    { return errNoStore }
+func (noStore) Delete(*http.Request, Record) error { return errNoStore }
+
+func (noStore) GetAll(*http.Request, string, interface{}, Query) (string, error) {
+	return "", errNoStore
+}
@@ -0,0 +1,494 @@
+package dsadapter
+
+// In-memory store implementation. Useful for tests and local development.
+
+import (
+	// Standard
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/******************************** MemoryStore ********************************/
+
+// MemoryStore is a Store that keeps records in process memory. Records are
+// copied on every read and write, so callers never share memory with the
+// store. It's safe for concurrent use. The zero value is ready to use, but
+// NewMemoryStore is the conventional way to make one.
+type MemoryStore struct {
+	mutex sync.RWMutex
+	// Map of kinds to maps of ids to stored struct values.
+	kinds map[string]map[string]reflect.Value
+	// Write counter. Every write takes the next number as its version.
+	clock uint64
+	// Versions of the last write to each record and each kind. Transactions
+	// compare them to find concurrent changes.
+	versions     map[memoryKey]uint64
+	kindVersions map[string]uint64
+}
+
+// Makes a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{kinds: map[string]map[string]reflect.Value{}}
+}
+
+// Reads the record identified by its kind and id into the record. Returns a
+// 404 error if there's no such record.
+func (this *MemoryStore) Get(req *http.Request, record Record) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.get(record)
+}
+
+// Stores a copy of the record under its kind and id.
+func (this *MemoryStore) Put(req *http.Request, record Record) error {
+	// Copy outside the lock.
+	val, err := copyRecord(record)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.put(memoryKeyOf(record), val)
+	return nil
+}
+
+// Stores a copy of the record like Put, unless its kind already has a record
+// with its id. Then returns ErrExists.
+func (this *MemoryStore) Create(req *http.Request, record Record) error {
+	// Copy outside the lock.
+	val, err := copyRecord(record)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	key := memoryKeyOf(record)
+	if _, ok := this.kinds[key.kind][key.id]; ok {
+		return ErrExists
+	}
+	this.put(key, val)
+	return nil
+}
+
+// Deletes the record identified by its kind and id. Returns a 404 error if
+// there's no such record.
+func (this *MemoryStore) Delete(req *http.Request, record Record) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.delete(record)
+}
+
+// Reads the records like Get, holding the lock once for the whole batch.
+func (this *MemoryStore) GetMulti(req *http.Request, records []Record) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	errs := make(MultiError, len(records))
+	for i, record := range records {
+		errs[i] = this.get(record)
+	}
+	return errs.orNil()
+}
+
+// Stores copies of the records like Put, holding the lock once for the whole
+// batch.
+func (this *MemoryStore) PutMulti(req *http.Request, records []Record) error {
+	// Copy outside the lock.
+	errs := make(MultiError, len(records))
+	vals := make([]reflect.Value, len(records))
+	for i, record := range records {
+		vals[i], errs[i] = copyRecord(record)
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i, record := range records {
+		if errs[i] == nil {
+			this.put(memoryKeyOf(record), vals[i])
+		}
+	}
+	return errs.orNil()
+}
+
+// Deletes the records like Delete, holding the lock once for the whole batch.
+func (this *MemoryStore) DeleteMulti(req *http.Request, records []Record) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	errs := make(MultiError, len(records))
+	for i, record := range records {
+		errs[i] = this.delete(record)
+	}
+	return errs.orNil()
+}
+
+// Finds records of the given kind that satisfy the query and appends copies of
+// them to the collection. Supports every operator, ordering, offsets, cursors
+// and projections. Returns a cursor only if there are more results. Cursors
+// are positions in the results, so records saved between pages may shift
+// them. Records are ordered by id, like Datastore keys, unless the
+// query says otherwise. Filter values are converted into the property types,
+// so "18" matches an int property equal to 18.
+func (this *MemoryStore) GetAll(req *http.Request, kind string, collection interface{}, query Query) (string, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return queryEntries(this.kinds[kind], collection, query)
+}
+
+/******************************** Transactions *******************************/
+
+// Runs the function with a store whose writes are kept aside until the
+// function returns nil, then applied at once. Transactions are optimistic:
+// they don't lock anything while running, and if a record they read, or a kind
+// they queried, was changed by someone else in the meantime, they fail with
+// ErrTransactionConflict without applying anything. If the function returns an
+// error, nothing is applied.
+func (this *MemoryStore) RunInTransaction(req *http.Request, fn func(Store) error) error {
+	tx := &memoryTx{
+		store:  this,
+		reads:  map[memoryKey]uint64{},
+		kinds:  map[string]uint64{},
+		writes: map[memoryKey]memoryWrite{},
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Store used inside a MemoryStore transaction. Not safe for concurrent use.
+type memoryTx struct {
+	store *MemoryStore
+	// Versions of the records and kinds as first seen by the transaction.
+	reads map[memoryKey]uint64
+	kinds map[string]uint64
+	// Pending writes.
+	writes map[memoryKey]memoryWrite
+}
+
+// A pending write in a transaction: a value to store, or a deletion.
+type memoryWrite struct {
+	val     reflect.Value
+	deleted bool
+}
+
+// Reads the record, seeing the transaction's own writes.
+func (this *memoryTx) Get(req *http.Request, record Record) error {
+	dst, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	if write, ok := this.writes[memoryKeyOf(record)]; ok {
+		if write.deleted || write.val.Type() != dst.Type() {
+			return err404
+		}
+		copyFields(dst, write.val)
+		return nil
+	}
+
+	this.store.mutex.RLock()
+	defer this.store.mutex.RUnlock()
+	this.observe(record)
+	return this.store.get(record)
+}
+
+// Keeps a copy of the record to store on commit.
+func (this *memoryTx) Put(req *http.Request, record Record) error {
+	val, err := copyRecord(record)
+	if err != nil {
+		return err
+	}
+	this.writes[memoryKeyOf(record)] = memoryWrite{val: val}
+	return nil
+}
+
+// Keeps a copy of the record to store on commit, unless its kind already has a
+// record with its id, seeing the transaction's own writes. Then returns
+// ErrExists. A record created by someone else before the commit fails the
+// transaction with ErrTransactionConflict.
+func (this *memoryTx) Create(req *http.Request, record Record) error {
+	key := memoryKeyOf(record)
+
+	if write, ok := this.writes[key]; ok && !write.deleted {
+		return ErrExists
+	} else if !ok {
+		this.store.mutex.RLock()
+		this.observe(record)
+		_, exists := this.store.kinds[key.kind][key.id]
+		this.store.mutex.RUnlock()
+		if exists {
+			return ErrExists
+		}
+	}
+
+	return this.Put(req, record)
+}
+
+// Marks the record for deletion on commit. Returns a 404 error if there's no
+// such record.
+func (this *memoryTx) Delete(req *http.Request, record Record) error {
+	key := memoryKeyOf(record)
+
+	if write, ok := this.writes[key]; ok && write.deleted {
+		return err404
+	} else if !ok {
+		this.store.mutex.RLock()
+		this.observe(record)
+		_, exists := this.store.kinds[key.kind][key.id]
+		this.store.mutex.RUnlock()
+		if !exists {
+			return err404
+		}
+	}
+
+	this.writes[key] = memoryWrite{deleted: true}
+	return nil
+}
+
+// Queries the stored records merged with the transaction's own writes.
+func (this *memoryTx) GetAll(req *http.Request, kind string, collection interface{}, query Query) (string, error) {
+	this.store.mutex.RLock()
+	defer this.store.mutex.RUnlock()
+
+	// Remember the kind's version to detect records added or removed by others.
+	if _, ok := this.kinds[kind]; !ok {
+		this.kinds[kind] = this.store.kindVersions[kind]
+	}
+
+	entries := map[string]reflect.Value{}
+	for id, val := range this.store.kinds[kind] {
+		entries[id] = val
+	}
+	for key, write := range this.writes {
+		if key.kind != kind {
+			continue
+		}
+		if write.deleted {
+			delete(entries, key.id)
+		} else {
+			entries[key.id] = write.val
+		}
+	}
+
+	return queryEntries(entries, collection, query)
+}
+
+// Remembers the version of the record the first time the transaction sees it.
+// The caller must hold the store lock.
+func (this *memoryTx) observe(record Record) {
+	key := memoryKeyOf(record)
+	if _, ok := this.reads[key]; !ok {
+		this.reads[key] = this.store.versions[key]
+	}
+}
+
+// Applies the pending writes if nothing the transaction has seen has changed.
+func (this *memoryTx) commit() error {
+	this.store.mutex.Lock()
+	defer this.store.mutex.Unlock()
+
+	for key, version := range this.reads {
+		if this.store.versions[key] != version {
+			return ErrTransactionConflict
+		}
+	}
+	for kind, version := range this.kinds {
+		if this.store.kindVersions[kind] != version {
+			return ErrTransactionConflict
+		}
+	}
+
+	for key, write := range this.writes {
+		if write.deleted {
+			// The record may be gone already; that's fine for a delete.
+			if _, ok := this.store.kinds[key.kind][key.id]; ok {
+				delete(this.store.kinds[key.kind], key.id)
+				this.store.touch(key)
+			}
+		} else {
+			this.store.put(key, write.val)
+		}
+	}
+	return nil
+}
+
+/********************************* Utilities *********************************/
+
+// Identifies a record in a MemoryStore.
+type memoryKey struct {
+	kind string
+	id   string
+}
+
+func memoryKeyOf(record Record) memoryKey {
+	return memoryKey{kind: record.Kind(), id: record.GetId()}
+}
+
+// A stored value with its id.
+type memoryEntry struct {
+	id  string
+	val reflect.Value
+}
+
+// Finds the values in the given map of ids to struct values that satisfy the
+// query and appends copies of them to the collection. Used by MemoryStore and
+// its transactions.
+func queryEntries(entries map[string]reflect.Value, collection interface{}, query Query) (string, error) {
+	col := reflect.ValueOf(collection)
+	if col.Kind() != reflect.Ptr || col.Elem().Kind() != reflect.Slice {
+		return "", errCollection
+	}
+	col = col.Elem()
+
+	// Figure out the element type and the underlying struct type.
+	elemType := col.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	compiled, err := compileQuery(structType, query)
+	if err != nil {
+		return "", err
+	}
+
+	// Sort the ids for a stable order.
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Find the matching values.
+	matches := []memoryEntry{}
+	for _, id := range ids {
+		src := entries[id]
+		if src.Type() == structType && compiled.match(src) {
+			matches = append(matches, memoryEntry{id: id, val: src})
+		}
+	}
+
+	// Apply the orders. The sort is stable, so ties stay ordered by id.
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compiled.less(matches[i].val, matches[j].val)
+	})
+
+	// Skip to the cursor and offset.
+	if compiled.start >= len(matches) {
+		matches = nil
+	} else {
+		matches = matches[compiled.start:]
+	}
+
+	// Respect the limit. Zero or negative means no limit. If there are more
+	// matches than the limit, make a cursor for the rest.
+	cursor := ""
+	if compiled.limit > 0 && len(matches) > compiled.limit {
+		matches = matches[:compiled.limit]
+		cursor = encodeCursor(compiled.start + compiled.limit)
+	}
+
+	// Append copies.
+	for _, match := range matches {
+		elem := reflect.New(structType)
+		if compiled.fields == nil {
+			copyFields(elem.Elem(), match.val)
+		} else {
+			// Only copy the projected fields, but always keep the id.
+			for _, prop := range compiled.fields {
+				prop.value(elem.Elem()).Set(deepCopy(prop.value(match.val)))
+			}
+			if record, ok := elem.Interface().(Record); ok {
+				record.SetId(match.id)
+			}
+		}
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		col.Set(reflect.Append(col, elem))
+	}
+
+	return cursor, nil
+}
+
+// Reads a record. The caller must hold the lock.
+func (this *MemoryStore) get(record Record) error {
+	dst, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+
+	src, ok := this.kinds[record.Kind()][record.GetId()]
+	if !ok || src.Type() != dst.Type() {
+		return err404
+	}
+
+	copyFields(dst, src)
+	return nil
+}
+
+// Stores a copy made with copyRecord under the given key. The caller must hold
+// the write lock.
+func (this *MemoryStore) put(key memoryKey, val reflect.Value) {
+	if this.kinds == nil {
+		this.kinds = map[string]map[string]reflect.Value{}
+	}
+	if this.kinds[key.kind] == nil {
+		this.kinds[key.kind] = map[string]reflect.Value{}
+	}
+	this.kinds[key.kind][key.id] = val
+	this.touch(key)
+}
+
+// Deletes a record. The caller must hold the write lock.
+func (this *MemoryStore) delete(record Record) error {
+	if _, ok := this.kinds[record.Kind()][record.GetId()]; !ok {
+		return err404
+	}
+	delete(this.kinds[record.Kind()], record.GetId())
+	this.touch(memoryKeyOf(record))
+	return nil
+}
+
+// Bumps the versions of the record and its kind. The caller must hold the
+// write lock.
+func (this *MemoryStore) touch(key memoryKey) {
+	if this.versions == nil {
+		this.versions = map[memoryKey]uint64{}
+		this.kindVersions = map[string]uint64{}
+	}
+	this.clock++
+	this.versions[key] = this.clock
+	this.kindVersions[key.kind] = this.clock
+}
+
+// Returns a copy of the struct value referenced by the record that doesn't
+// share memory with it.
+func copyRecord(record Record) (reflect.Value, error) {
+	src, err := recordStruct(record)
+	if err != nil {
+		return src, err
+	}
+	dst := reflect.New(src.Type()).Elem()
+	copyFields(dst, src)
+	return dst, nil
+}
+
+// Returns the struct value referenced by the record, which must be a struct
+// pointer.
+func recordStruct(record Record) (reflect.Value, error) {
+	val := reflect.ValueOf(record)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return val, utils.Error("a record must be a non-nil struct pointer")
+	}
+	return val.Elem(), nil
+}
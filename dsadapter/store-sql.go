@@ -0,0 +1,1050 @@
+package dsadapter
+
+// Store implementation backed by an SQL database through database/sql.
+
+import (
+	// Standard
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/******************************** SQLDialect *********************************/
+
+// SQLDialect describes the differences between SQL databases that matter to
+// SQLStore. Use one of the predefined dialects or make your own.
+type SQLDialect struct {
+	// Returns the placeholder for the nth query argument, starting at 1.
+	Placeholder func(int) string
+	// Returns the column type for values of the given SQL kind. See the
+	// SQLKindX constants.
+	ColumnType func(int) string
+	// Reports whether the error means that a transaction failed because of
+	// concurrent changes and may succeed if run again. Optional.
+	Conflict func(error) bool
+	// Reports whether the error means that a write broke a unique index.
+	// Optional.
+	Unique func(error) bool
+}
+
+// SQL kinds. Each field type is stored as one of these.
+const (
+	SQLKindText = iota
+	SQLKindInt
+	SQLKindFloat
+	SQLKindBool
+	SQLKindBytes
+	SQLKindTime
+	// Slices, maps, structs and other composite values, stored as JSON text.
+	SQLKindJson
+)
+
+// Dialect for SQLite 3.35 or later.
+var SQLite = SQLDialect{
+	Placeholder: func(int) string { return "?" },
+	ColumnType: func(kind int) string {
+		switch kind {
+		case SQLKindInt, SQLKindBool:
+			return "INTEGER"
+		case SQLKindFloat:
+			return "REAL"
+		case SQLKindBytes:
+			return "BLOB"
+		case SQLKindTime:
+			return "TIMESTAMP"
+		default:
+			return "TEXT"
+		}
+	},
+	// SQLite locks the whole database for writing. Another writer makes
+	// statements fail with SQLITE_BUSY.
+	Conflict: func(err error) bool {
+		msg := err.Error()
+		return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+	},
+	Unique: func(err error) bool {
+		return strings.Contains(err.Error(), "UNIQUE constraint failed")
+	},
+}
+
+// Dialect for PostgreSQL 9.5 or later.
+var Postgres = SQLDialect{
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	ColumnType: func(kind int) string {
+		switch kind {
+		case SQLKindInt:
+			return "BIGINT"
+		case SQLKindFloat:
+			return "DOUBLE PRECISION"
+		case SQLKindBool:
+			return "BOOLEAN"
+		case SQLKindBytes:
+			return "BYTEA"
+		case SQLKindTime:
+			return "TIMESTAMPTZ"
+		default:
+			return "TEXT"
+		}
+	},
+	// Serialization failures (40001) and deadlocks (40P01). Drivers format
+	// errors differently, so look for both the codes and the messages.
+	Conflict: func(err error) bool {
+		msg := err.Error()
+		for _, str := range []string{"40001", "40P01", "could not serialize", "deadlock detected"} {
+			if strings.Contains(msg, str) {
+				return true
+			}
+		}
+		return false
+	},
+	// Unique violations (23505).
+	Unique: func(err error) bool {
+		msg := err.Error()
+		return strings.Contains(msg, "23505") || strings.Contains(msg, "duplicate key value")
+	},
+}
+
+/********************************* SQLStore **********************************/
+
+// SQLStore is a Store that keeps records in an SQL database. Each kind is a
+// table named after the kind, and each stored property is a column named
+// after the property, following the same rules as the Datastore: exported
+// fields, with names overridden by `datastore:"name"` tags. The record id is
+// kept in the primary key column "Id"; if the record type has an "Id"
+// property, that property is the primary key. Composite values are stored as
+// JSON text.
+//
+// Tables are made with State.SyncSchema.
+type SQLStore struct {
+	db      sqlQuerier
+	dialect SQLDialect
+}
+
+// Methods shared by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// Makes a new SQLStore that uses the given database and dialect.
+func NewSQLStore(db *sql.DB, dialect SQLDialect) *SQLStore {
+	return &SQLStore{db: db, dialect: dialect}
+}
+
+// Reads the record identified by its kind and id into the record. Returns a
+// 404 error if there's no such row.
+func (this *SQLStore) Get(req *http.Request, record Record) error {
+	dst, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+	table := sqlTableOf(record.Kind(), dst.Type())
+
+	query := "SELECT " + table.columnList() + " FROM " + quote(table.name) +
+		" WHERE " + quote(sqlIdColumn) + " = " + this.dialect.Placeholder(1)
+
+	rows, err := this.db.QueryContext(requestContext(req), query, record.GetId())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return err404
+	}
+	if _, err := table.scan(rows, dst); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// Inserts or replaces the row with the record's id.
+func (this *SQLStore) Put(req *http.Request, record Record) error {
+	src, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+	table := sqlTableOf(record.Kind(), src.Type())
+
+	args, err := table.values(record.GetId(), src)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.db.ExecContext(requestContext(req), this.upsert(table, 1), args...)
+	return this.duplicate(err)
+}
+
+// Inserts a row with the record's id, unless there already is one. Then
+// returns ErrExists. Other unique violations are wrapped in ErrDuplicate.
+func (this *SQLStore) Create(req *http.Request, record Record) error {
+	src, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+	table := sqlTableOf(record.Kind(), src.Type())
+
+	args, err := table.values(record.GetId(), src)
+	if err != nil {
+		return err
+	}
+
+	statement := "INSERT INTO " + quote(table.name) + " (" + table.columnList() + ")" +
+		" VALUES (" + this.placeholders(1, len(args)) + ")" +
+		" ON CONFLICT (" + quote(sqlIdColumn) + ") DO NOTHING"
+
+	result, err := this.db.ExecContext(requestContext(req), statement, args...)
+	if err != nil {
+		return this.duplicate(err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+// Deletes the row with the record's id. Returns a 404 error if there's no such
+// row.
+func (this *SQLStore) Delete(req *http.Request, record Record) error {
+	src, err := recordStruct(record)
+	if err != nil {
+		return err
+	}
+	table := sqlTableOf(record.Kind(), src.Type())
+
+	query := "DELETE FROM " + quote(table.name) +
+		" WHERE " + quote(sqlIdColumn) + " = " + this.dialect.Placeholder(1)
+
+	result, err := this.db.ExecContext(requestContext(req), query, record.GetId())
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return err404
+	}
+	return nil
+}
+
+// Reads the records like Get, selecting the rows of each kind with one query
+// per up to sqlMaxArgs ids.
+func (this *SQLStore) GetMulti(req *http.Request, records []Record) error {
+	groups, errs := sqlGroupsOf(records)
+
+	for _, group := range groups {
+		for _, chunk := range sqlChunks(group.indexes, sqlMaxArgs) {
+			ids := make([]interface{}, len(chunk))
+			for i, index := range chunk {
+				ids[i] = records[index].GetId()
+			}
+
+			statement := "SELECT " + group.table.columnList() + " FROM " + quote(group.table.name) +
+				" WHERE " + quote(sqlIdColumn) + " IN (" + this.placeholders(1, len(ids)) + ")"
+
+			found, err := this.selectRows(req, group, statement, ids)
+			if err != nil {
+				return err
+			}
+
+			for _, index := range chunk {
+				val, ok := found[records[index].GetId()]
+				if !ok {
+					errs[index] = err404
+					continue
+				}
+				dst, _ := recordStruct(records[index])
+				copyFields(dst, val)
+			}
+		}
+	}
+
+	return errs.orNil()
+}
+
+// Inserts or replaces the rows like Put, with one statement per group of rows
+// that fits in sqlMaxArgs arguments. A unique violation fails the whole
+// statement, so its rows are then written one by one, and those that break an
+// index get ErrDuplicate in the MultiError. Batches aren't atomic: if a
+// statement fails for another reason, the rows written by earlier statements
+// stay.
+func (this *SQLStore) PutMulti(req *http.Request, records []Record) error {
+	groups, errs := sqlGroupsOf(records)
+
+	for _, group := range groups {
+		columns := len(group.table.props) + 1
+
+		// Collect the values. Records that can't be converted fail alone.
+		indexes := []int{}
+		values := map[int][]interface{}{}
+		for _, index := range group.indexes {
+			src, _ := recordStruct(records[index])
+			args, err := group.table.values(records[index].GetId(), src)
+			if err != nil {
+				errs[index] = err
+				continue
+			}
+			indexes = append(indexes, index)
+			values[index] = args
+		}
+
+		// An upsert can't touch the same row twice, so a repeated id starts a new
+		// statement.
+		for len(indexes) > 0 {
+			args := []interface{}{}
+			ids := map[string]bool{}
+			count := 0
+			for count < len(indexes) {
+				id := records[indexes[count]].GetId()
+				if ids[id] || (count > 0 && (count+1)*columns > sqlMaxArgs) {
+					break
+				}
+				ids[id] = true
+				args = append(args, values[indexes[count]]...)
+				count++
+			}
+
+			chunk := indexes[:count]
+			indexes = indexes[count:]
+			_, err := this.execSavepoint(req, this.upsert(group.table, count), args...)
+			if err == nil {
+				continue
+			}
+
+			// Find the rows that break an index.
+			if err := this.duplicate(err); !errors.Is(err, ErrDuplicate) {
+				return err
+			}
+			for _, index := range chunk {
+				_, err := this.execSavepoint(req, this.upsert(group.table, 1), values[index]...)
+				errs[index] = this.duplicate(err)
+			}
+		}
+	}
+
+	return errs.orNil()
+}
+
+// Deletes the rows like Delete, with one statement per kind and up to
+// sqlMaxArgs ids. Uses DELETE ... RETURNING to find which rows existed.
+func (this *SQLStore) DeleteMulti(req *http.Request, records []Record) error {
+	groups, errs := sqlGroupsOf(records)
+
+	for _, group := range groups {
+		for _, chunk := range sqlChunks(group.indexes, sqlMaxArgs) {
+			ids := make([]interface{}, len(chunk))
+			for i, index := range chunk {
+				ids[i] = records[index].GetId()
+			}
+
+			statement := "DELETE FROM " + quote(group.table.name) +
+				" WHERE " + quote(sqlIdColumn) + " IN (" + this.placeholders(1, len(ids)) + ")" +
+				" RETURNING " + quote(sqlIdColumn)
+
+			deleted, err := this.selectIds(req, statement, ids)
+			if err != nil {
+				return err
+			}
+
+			for _, index := range chunk {
+				if !deleted[records[index].GetId()] {
+					errs[index] = err404
+				}
+			}
+		}
+	}
+
+	return errs.orNil()
+}
+
+// Selects rows of the given kind that satisfy the query and appends them to
+// the collection. Supports every operator, ordering, offsets, cursors and
+// projections. Returns a cursor only if there are more results. Cursors are
+// offsets, so rows saved between pages may shift them. Rows are ordered by id
+// unless the query says otherwise. Filter values are converted into the
+// property types.
+func (this *SQLStore) GetAll(req *http.Request, kind string, collection interface{}, query Query) (string, error) {
+	col := reflect.ValueOf(collection)
+	if col.Kind() != reflect.Ptr || col.Elem().Kind() != reflect.Slice {
+		return "", errCollection
+	}
+	col = col.Elem()
+
+	elemType := col.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	compiled, err := compileQuery(structType, query)
+	if err != nil {
+		return "", err
+	}
+
+	// Select only the projected columns, if any.
+	table := sqlTableOf(kind, structType)
+	if compiled.fields != nil {
+		table = table.project(compiled.fields)
+	}
+
+	// Build the where clause.
+	conditions := []string{}
+	args := []interface{}{}
+	for _, filter := range compiled.filters {
+		placeholders := []string{}
+		for _, value := range filter.values {
+			arg, err := sqlValue(value)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, arg)
+			placeholders = append(placeholders, this.dialect.Placeholder(len(args)))
+		}
+
+		column := quote(filter.prop.name)
+		switch filter.op {
+		case OpIn:
+			if len(placeholders) == 0 {
+				conditions = append(conditions, "1 = 0")
+			} else {
+				conditions = append(conditions, column+" IN ("+strings.Join(placeholders, ", ")+")")
+			}
+		case OpNe:
+			conditions = append(conditions, column+" <> "+placeholders[0])
+		default:
+			conditions = append(conditions, column+" "+filter.op+" "+placeholders[0])
+		}
+	}
+
+	// Build the order clause, ending with the id to break ties.
+	orders := []string{}
+	for _, order := range compiled.orders {
+		if order.desc {
+			orders = append(orders, quote(order.prop.name)+" DESC")
+		} else {
+			orders = append(orders, quote(order.prop.name))
+		}
+	}
+	orders = append(orders, quote(sqlIdColumn))
+
+	statement := "SELECT " + table.columnList() + " FROM " + quote(table.name)
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + strings.Join(orders, ", ")
+
+	// Select one row past the limit to find out if there are more. SQLite
+	// doesn't allow an offset without a limit, so use the largest one.
+	if compiled.limit > 0 {
+		statement += " LIMIT " + strconv.Itoa(compiled.limit+1)
+	} else if compiled.start > 0 {
+		statement += " LIMIT " + strconv.FormatInt(math.MaxInt64, 10)
+	}
+	if compiled.start > 0 {
+		statement += " OFFSET " + strconv.Itoa(compiled.start)
+	}
+
+	rows, err := this.db.QueryContext(requestContext(req), statement, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		// The extra row means there are more results.
+		if compiled.limit > 0 && count == compiled.limit {
+			return encodeCursor(compiled.start + count), rows.Err()
+		}
+		count++
+
+		elem := reflect.New(structType)
+		id, err := table.scan(rows, elem.Elem())
+		if err != nil {
+			return "", err
+		}
+		if record, ok := elem.Interface().(Record); ok {
+			record.SetId(id)
+		}
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		col.Set(reflect.Append(col, elem))
+	}
+	return "", rows.Err()
+}
+
+// Creates a table for each record's kind if it doesn't exist, and adds the
+// columns missing from existing tables. Columns are never dropped or altered,
+// so renaming a field leaves the old column in place.
+func (this *SQLStore) SyncSchema(req *http.Request, records []Record) error {
+	ctx := requestContext(req)
+
+	for _, record := range records {
+		table := sqlTableOf(record.Kind(), reflect.TypeOf(record))
+
+		// Make the table if needed.
+		defs := []string{quote(sqlIdColumn) + " " + this.dialect.ColumnType(SQLKindText) + " PRIMARY KEY"}
+		for _, prop := range table.props {
+			defs = append(defs, quote(prop.name)+" "+this.dialect.ColumnType(sqlKindOf(prop.typ)))
+		}
+		query := "CREATE TABLE IF NOT EXISTS " + quote(table.name) + " (" + strings.Join(defs, ", ") + ")"
+		if _, err := this.db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+
+		// Find existing columns.
+		existing, err := this.columns(ctx, table.name)
+		if err != nil {
+			return err
+		}
+
+		// Add missing columns.
+		for _, prop := range table.props {
+			if existing[strings.ToLower(prop.name)] {
+				continue
+			}
+			query := "ALTER TABLE " + quote(table.name) + " ADD COLUMN " +
+				quote(prop.name) + " " + this.dialect.ColumnType(sqlKindOf(prop.typ))
+			if _, err := this.db.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+
+		// Make the declared indexes if needed.
+		if indexed, ok := record.(Indexed); ok {
+			for _, index := range indexed.Indexes() {
+				query, err := table.createIndex(index)
+				if err != nil {
+					return err
+				}
+				if _, err := this.db.ExecContext(ctx, query); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Unique indexes of Indexed records are unique constraints, so the State
+// doesn't keep index entities for this store.
+func (this *SQLStore) EnforcesUnique() bool {
+	return true
+}
+
+// Runs the function with a store whose statements run in one SQL transaction
+// at the serializable isolation level. Commits if the function returns nil
+// and rolls back otherwise. Errors that the dialect reports as conflicts,
+// including on commit, are wrapped in ErrTransactionConflict. Inside a
+// transaction, calls the function with the same store.
+func (this *SQLStore) RunInTransaction(req *http.Request, fn func(Store) error) error {
+	db, ok := this.db.(*sql.DB)
+	if !ok {
+		return fn(this)
+	}
+
+	tx, err := db.BeginTx(requestContext(req), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return this.conflict(err)
+	}
+
+	// Roll back on errors and panics.
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(&SQLStore{db: tx, dialect: this.dialect}); err != nil {
+		return this.conflict(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return this.conflict(err)
+	}
+	committed = true
+	return nil
+}
+
+// Wraps the error in ErrTransactionConflict if the dialect says it's a
+// conflict.
+func (this *SQLStore) conflict(err error) error {
+	if this.dialect.Conflict != nil && !errors.Is(err, ErrTransactionConflict) && this.dialect.Conflict(err) {
+		return ErrTransactionConflict.Wrap(err)
+	}
+	return err
+}
+
+// Wraps errors that the dialect reports as unique violations in ErrDuplicate.
+func (this *SQLStore) duplicate(err error) error {
+	if err != nil && this.dialect.Unique != nil && this.dialect.Unique(err) {
+		return ErrDuplicate.Wrap(err)
+	}
+	return err
+}
+
+/*--------------------------------- Private ---------------------------------*/
+
+// Runs the statement like ExecContext. Inside a transaction, runs it in a
+// savepoint: databases like Postgres abort the whole transaction when a
+// statement fails, and PutMulti goes on after unique violations.
+func (this *SQLStore) execSavepoint(req *http.Request, statement string, args ...interface{}) (sql.Result, error) {
+	ctx := requestContext(req)
+	if _, ok := this.db.(*sql.Tx); !ok {
+		return this.db.ExecContext(ctx, statement, args...)
+	}
+
+	if _, err := this.db.ExecContext(ctx, "SAVEPOINT dsa_exec"); err != nil {
+		return nil, err
+	}
+	result, err := this.db.ExecContext(ctx, statement, args...)
+	if err != nil {
+		if _, rollbackErr := this.db.ExecContext(ctx, "ROLLBACK TO SAVEPOINT dsa_exec"); rollbackErr != nil {
+			return nil, rollbackErr
+		}
+		return nil, err
+	}
+	_, err = this.db.ExecContext(ctx, "RELEASE SAVEPOINT dsa_exec")
+	return result, err
+}
+
+// Returns the set of lowercased column names of the given table.
+func (this *SQLStore) columns(ctx context.Context, table string) (map[string]bool, error) {
+	rows, err := this.db.QueryContext(ctx, "SELECT * FROM "+quote(table)+" WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]bool{}
+	for _, name := range names {
+		result[strings.ToLower(name)] = true
+	}
+	return result, nil
+}
+
+// Returns a comma-separated list of placeholders for arguments from the nth
+// to the (n+count-1)th.
+func (this *SQLStore) placeholders(n, count int) string {
+	list := make([]string, 0, count)
+	for i := n; i < n+count; i++ {
+		list = append(list, this.dialect.Placeholder(i))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Makes a statement that inserts or replaces the given number of rows.
+func (this *SQLStore) upsert(table sqlTable, count int) string {
+	columns := len(table.props) + 1
+	rows := make([]string, count)
+	for i := range rows {
+		rows[i] = "(" + this.placeholders(i*columns+1, columns) + ")"
+	}
+
+	updates := make([]string, 0, len(table.props))
+	for _, prop := range table.props {
+		updates = append(updates, quote(prop.name)+" = excluded."+quote(prop.name))
+	}
+
+	statement := "INSERT INTO " + quote(table.name) + " (" + table.columnList() + ")" +
+		" VALUES " + strings.Join(rows, ", ") +
+		" ON CONFLICT (" + quote(sqlIdColumn) + ") DO "
+	if len(updates) == 0 {
+		statement += "NOTHING"
+	} else {
+		statement += "UPDATE SET " + strings.Join(updates, ", ")
+	}
+	return statement
+}
+
+// Runs a select statement and returns the rows as struct values by id.
+func (this *SQLStore) selectRows(req *http.Request, group sqlGroup, statement string, args []interface{}) (map[string]reflect.Value, error) {
+	rows, err := this.db.QueryContext(requestContext(req), statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[string]reflect.Value{}
+	for rows.Next() {
+		val := reflect.New(group.typ).Elem()
+		id, err := group.table.scan(rows, val)
+		if err != nil {
+			return nil, err
+		}
+		found[id] = val
+	}
+	return found, rows.Err()
+}
+
+// Runs a statement that returns one id column and returns the set of ids.
+func (this *SQLStore) selectIds(req *http.Request, statement string, args []interface{}) (map[string]bool, error) {
+	rows, err := this.db.QueryContext(requestContext(req), statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]bool{}
+	for rows.Next() {
+		var raw interface{}
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		id := reflect.New(reflect.TypeOf("")).Elem()
+		if err := setSqlValue(id, raw); err != nil {
+			return nil, err
+		}
+		ids[id.String()] = true
+	}
+	return ids, rows.Err()
+}
+
+/********************************* sqlTable **********************************/
+
+// Name of the primary key column.
+const sqlIdColumn = "Id"
+
+// Maximum number of arguments in one batch statement. Older SQLite versions
+// don't allow more than 999.
+const sqlMaxArgs = 999
+
+// Records of one kind and type in a batch, by their indexes in the batch.
+type sqlGroup struct {
+	table   sqlTable
+	typ     reflect.Type
+	indexes []int
+}
+
+type sqlGroupKey struct {
+	kind string
+	typ  reflect.Type
+}
+
+// Groups the records of a batch by kind and type, in the order of their first
+// appearance. Records that aren't struct pointers get errors in the returned
+// MultiError.
+func sqlGroupsOf(records []Record) ([]sqlGroup, MultiError) {
+	errs := make(MultiError, len(records))
+	groups := []sqlGroup{}
+	positions := map[sqlGroupKey]int{}
+
+	for i, record := range records {
+		val, err := recordStruct(record)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		key := sqlGroupKey{record.Kind(), val.Type()}
+		position, ok := positions[key]
+		if !ok {
+			position = len(groups)
+			positions[key] = position
+			groups = append(groups, sqlGroup{table: sqlTableOf(record.Kind(), val.Type()), typ: val.Type()})
+		}
+		groups[position].indexes = append(groups[position].indexes, i)
+	}
+
+	return groups, errs
+}
+
+// Splits a list of indexes into chunks of up to the given size.
+func sqlChunks(indexes []int, size int) [][]int {
+	chunks := [][]int{}
+	for len(indexes) > size {
+		chunks = append(chunks, indexes[:size])
+		indexes = indexes[size:]
+	}
+	if len(indexes) > 0 {
+		chunks = append(chunks, indexes)
+	}
+	return chunks
+}
+
+// Maps a record type to a table.
+type sqlTable struct {
+	name string
+	// Index of the property stored in the id column, or nil if there's none.
+	idIndex []int
+	// Properties stored in other columns.
+	props []property
+}
+
+// Describes the table for the given kind and record type.
+func sqlTableOf(kind string, typ reflect.Type) sqlTable {
+	table := sqlTable{name: kind}
+	for _, prop := range propertiesOf(typ) {
+		if strings.EqualFold(prop.name, sqlIdColumn) {
+			table.idIndex = prop.index
+			continue
+		}
+		table.props = append(table.props, prop)
+	}
+	return table
+}
+
+// Returns the quoted column names, starting with the id column.
+func (this sqlTable) columnList() string {
+	names := []string{quote(sqlIdColumn)}
+	for _, prop := range this.props {
+		names = append(names, quote(prop.name))
+	}
+	return strings.Join(names, ", ")
+}
+
+// Returns the column values of the given struct value, in the same order as
+// columnList.
+func (this sqlTable) values(id string, val reflect.Value) ([]interface{}, error) {
+	args := []interface{}{id}
+	for _, prop := range this.props {
+		arg, err := sqlValue(prop.value(val))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// Scans the current row into the given struct value and returns the id. The
+// row must have the columns from columnList.
+func (this sqlTable) scan(rows *sql.Rows, val reflect.Value) (string, error) {
+	raw := make([]interface{}, len(this.props)+1)
+	ptrs := make([]interface{}, len(raw))
+	for i := range raw {
+		ptrs[i] = &raw[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return "", err
+	}
+
+	id := reflect.New(reflect.TypeOf("")).Elem()
+	if err := setSqlValue(id, raw[0]); err != nil {
+		return "", err
+	}
+	if this.idIndex != nil {
+		if err := setSqlValue(val.FieldByIndex(this.idIndex), raw[0]); err != nil {
+			return "", err
+		}
+	}
+
+	for i, prop := range this.props {
+		if err := setSqlValue(prop.value(val), raw[i+1]); err != nil {
+			return "", utils.Error("can't load column " + prop.name + ": " + err.Error())
+		}
+	}
+	return id.String(), nil
+}
+
+// Returns a copy of the table description limited to the given properties.
+func (this sqlTable) project(props []property) sqlTable {
+	result := sqlTable{name: this.name, idIndex: this.idIndex}
+	for _, prop := range props {
+		if !strings.EqualFold(prop.name, sqlIdColumn) {
+			result.props = append(result.props, prop)
+		}
+	}
+	return result
+}
+
+// Returns the statement that makes the given index if it doesn't exist. The
+// index is named after the table and the fields.
+func (this sqlTable) createIndex(index Index) (string, error) {
+	columns := make([]string, len(index.Fields))
+	for i, name := range index.Fields {
+		found := strings.EqualFold(name, sqlIdColumn)
+		for _, prop := range this.props {
+			found = found || prop.name == name
+		}
+		if !found {
+			return "", errIndexField(this.name, name)
+		}
+		columns[i] = quote(name)
+	}
+
+	unique, suffix := "", "idx"
+	if index.Unique {
+		unique, suffix = "UNIQUE ", "key"
+	}
+	name := this.name + "_" + strings.Join(index.Fields, "_") + "_" + suffix
+	return "CREATE " + unique + "INDEX IF NOT EXISTS " + quote(name) +
+		" ON " + quote(this.name) + " (" + strings.Join(columns, ", ") + ")", nil
+}
+
+/********************************* Utilities *********************************/
+
+// Returns the SQL kind used to store values of the given type.
+func sqlKindOf(typ reflect.Type) int {
+	if typ == timeType {
+		return SQLKindTime
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return SQLKindText
+	case reflect.Bool:
+		return SQLKindBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return SQLKindInt
+	case reflect.Float32, reflect.Float64:
+		return SQLKindFloat
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return SQLKindBytes
+		}
+	}
+	return SQLKindJson
+}
+
+// Converts a field value into a database/sql argument.
+func sqlValue(val reflect.Value) (interface{}, error) {
+	switch sqlKindOf(val.Type()) {
+	case SQLKindText:
+		return val.String(), nil
+	case SQLKindBool:
+		return val.Bool(), nil
+	case SQLKindInt:
+		if val.Kind() >= reflect.Uint && val.Kind() <= reflect.Uint64 {
+			// SQL integers are signed.
+			if val.Uint() > math.MaxInt64 {
+				return nil, utils.Error("value " + strconv.FormatUint(val.Uint(), 10) + " is out of range for an SQL integer")
+			}
+			return int64(val.Uint()), nil
+		}
+		return val.Int(), nil
+	case SQLKindFloat:
+		return val.Float(), nil
+	case SQLKindBytes:
+		return val.Bytes(), nil
+	case SQLKindTime:
+		return val.Interface().(time.Time), nil
+	}
+	bytes, err := json.Marshal(val.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return string(bytes), nil
+}
+
+// Time layouts that SQL drivers may use when returning times as text.
+var sqlTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Writes a value scanned from a database into a field. NULL becomes the zero
+// value.
+func setSqlValue(field reflect.Value, raw interface{}) error {
+	if raw == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	// Drivers return text as either string or []byte.
+	text, isText := raw.(string)
+	if bytes, ok := raw.([]byte); ok {
+		text, isText = string(bytes), true
+	}
+
+	switch sqlKindOf(field.Type()) {
+	case SQLKindBytes:
+		if bytes, ok := raw.([]byte); ok {
+			field.SetBytes(append([]byte{}, bytes...))
+			return nil
+		}
+	case SQLKindTime:
+		if t, ok := raw.(time.Time); ok {
+			field.Set(reflect.ValueOf(t))
+			return nil
+		}
+		if isText {
+			for _, layout := range sqlTimeLayouts {
+				if t, err := time.Parse(layout, text); err == nil {
+					field.Set(reflect.ValueOf(t))
+					return nil
+				}
+			}
+		}
+	case SQLKindJson:
+		if isText {
+			ptr := reflect.New(field.Type())
+			if err := json.Unmarshal([]byte(text), ptr.Interface()); err != nil {
+				return err
+			}
+			field.Set(ptr.Elem())
+			return nil
+		}
+	default:
+		if isText {
+			val, err := parseValue(text, field.Type())
+			if err != nil {
+				return err
+			}
+			field.Set(val)
+			return nil
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(fmt.Sprint(raw))
+			return nil
+		}
+		val := reflect.ValueOf(raw)
+		// Some databases store booleans as integers.
+		if field.Kind() == reflect.Bool && val.Kind() == reflect.Int64 {
+			field.SetBool(val.Int() != 0)
+			return nil
+		}
+		if val.Type().ConvertibleTo(field.Type()) {
+			field.Set(val.Convert(field.Type()))
+			return nil
+		}
+	}
+
+	return utils.Error("unsupported value " + reflect.TypeOf(raw).String() + " for type " + field.Type().String())
+}
+
+// Quotes an SQL identifier.
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Returns the request's context, or an empty context if there's no request.
+func requestContext(req *http.Request) context.Context {
+	if req == nil {
+		return context.Background()
+	}
+	return req.Context()
+}
@@ -0,0 +1,128 @@
+package dsadapter
+
+import (
+	// Standard
+	"database/sql"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// A record with a property of each column type.
+type testCarriage struct {
+	TestRecord
+	Id     string
+	Built  time.Time
+	Seats  int
+	Open   bool
+	Weight float64
+	Tags   []string
+	Mass   uint64
+}
+
+func (this *testCarriage) GetId() string   { return this.Id }
+func (this *testCarriage) SetId(id string) { this.Id = id }
+func (this *testCarriage) Kind() string    { return "Carriage" }
+
+// Returns an SQLStore over a new in-memory SQLite database, with the schema of
+// the carriages synced.
+func testSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	store := NewSQLStore(db, SQLite)
+	req := testRequest("GET", "/")
+	// Syncing again changes nothing.
+	for i := 0; i < 2; i++ {
+		if err := store.SyncSchema(req, []Record{&testCarriage{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestSQLColumns(t *testing.T) {
+	store := testSQLStore(t)
+	req := testRequest("GET", "/")
+
+	built := time.Date(1925, 5, 1, 12, 0, 0, 0, time.UTC)
+	carriage := &testCarriage{
+		Id:     "one",
+		Built:  built,
+		Seats:  64,
+		Open:   true,
+		Weight: 41.5,
+		Tags:   []string{"sleeper"},
+	}
+	expectCode(t, store.Put(req, carriage), 0)
+
+	read := &testCarriage{Id: "one"}
+	expectCode(t, store.Get(req, read), 0)
+	if !read.Built.Equal(built) || read.Seats != 64 || !read.Open || read.Weight != 41.5 ||
+		len(read.Tags) != 1 || read.Tags[0] != "sleeper" {
+		t.Fatalf("expected %#v, got %#v", carriage, read)
+	}
+}
+
+func TestSQLMissingRows(t *testing.T) {
+	store := testSQLStore(t)
+	req := testRequest("GET", "/")
+
+	// Create refuses existing rows.
+	expectCode(t, store.Create(req, &testCarriage{Id: "one"}), 0)
+	if err := store.Create(req, &testCarriage{Id: "one"}); err != ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	// Delete reports missing rows.
+	expectCode(t, store.Delete(req, &testCarriage{Id: "one"}), 0)
+	expectCode(t, store.Delete(req, &testCarriage{Id: "one"}), 404)
+	expectCode(t, store.Get(req, &testCarriage{Id: "one"}), 404)
+
+	// So does DeleteMulti, per record.
+	expectCode(t, store.Put(req, &testCarriage{Id: "two"}), 0)
+	err := store.DeleteMulti(req, []Record{&testCarriage{Id: "one"}, &testCarriage{Id: "two"}})
+	multiErr, _ := err.(MultiError)
+	if multiErr == nil || ErrorCode(multiErr[0]) != 404 || multiErr[1] != nil {
+		t.Fatalf("expected only the first record to fail, got %v", err)
+	}
+}
+
+func TestSQLPutMulti(t *testing.T) {
+	store := testSQLStore(t)
+	req := testRequest("GET", "/")
+	_, err := store.db.ExecContext(requestContext(req), `CREATE UNIQUE INDEX "CarriageSeats" ON "Carriage" ("Seats")`)
+	expectCode(t, err, 0)
+
+	// Rows that break an index fail alone, in and out of transactions.
+	put := func(store Store) error {
+		return store.(BatchStore).PutMulti(req, []Record{
+			&testCarriage{Id: "one", Seats: 1},
+			&testCarriage{Id: "two", Seats: 1},
+			&testCarriage{Id: "three", Seats: 3, Mass: math.MaxUint64},
+			&testCarriage{Id: "four", Seats: 4},
+		})
+	}
+	check := func(err error) {
+		t.Helper()
+		multiErr, _ := err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || !errors.Is(multiErr[1], ErrDuplicate) || multiErr[2] == nil || multiErr[3] != nil {
+			t.Fatalf("expected the second and third rows to fail, got %v", err)
+		}
+	}
+	check(put(store))
+	expectCode(t, store.Get(req, &testCarriage{Id: "four"}), 0)
+	expectCode(t, store.Get(req, &testCarriage{Id: "two"}), 404)
+
+	expectCode(t, store.DeleteMulti(req, []Record{&testCarriage{Id: "one"}, &testCarriage{Id: "four"}}), 0)
+	expectCode(t, store.RunInTransaction(req, func(tx Store) error {
+		check(put(tx))
+		return nil
+	}), 0)
+	expectCode(t, store.Get(req, &testCarriage{Id: "four"}), 0)
+}
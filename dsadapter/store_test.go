@@ -0,0 +1,459 @@
+package dsadapter
+
+// Test suite shared by the store-backed tests. Every test that needs a store
+// runs once per store in testStores, so the stores must behave the same.
+
+import (
+	// Standard
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+	_ "modernc.org/sqlite"
+)
+
+/******************************* Test Records ********************************/
+
+// Returned by the CRUD methods of test records, which the tests don't call.
+var errTestMethod = utils.Error("test records are saved through the state")
+
+// Embedded in the test records for the Record methods they don't customize.
+// Exported because only exported embedded structs are flattened into
+// properties; it has no fields, so it adds none.
+type TestRecord struct{}
+
+func (this *TestRecord) Validate(*http.Request) map[string]string { return nil }
+func (this *TestRecord) Compute()                                 {}
+func (this *TestRecord) Can(*http.Request, int) bool              { return true }
+func (this *TestRecord) Save(*http.Request) error                 { return errTestMethod }
+func (this *TestRecord) Read(*http.Request) error                 { return errTestMethod }
+func (this *TestRecord) Delete(*http.Request) error               { return errTestMethod }
+
+// A plain record. Requires a name, and refuses requests with a "Forbid"
+// header, or only creates if the header is "create".
+type testEngine struct {
+	TestRecord
+	Id   string
+	Name string
+	Cars int
+}
+
+func (this *testEngine) Validate(*http.Request) map[string]string {
+	if this.Name == "" {
+		return map[string]string{"Name": "required"}
+	}
+	return nil
+}
+func (this *testEngine) Can(req *http.Request, code int) bool {
+	forbid := req.Header.Get("Forbid")
+	return forbid == "" || (forbid == "create" && code != CodeCreate)
+}
+func (this *testEngine) GetId() string   { return this.Id }
+func (this *testEngine) SetId(id string) { this.Id = id }
+func (this *testEngine) Kind() string    { return "Engine" }
+
+// A Versioned record.
+type testTrain struct {
+	TestRecord
+	Id      string
+	Name    string
+	Version int64
+}
+
+func (this *testTrain) GetId() string            { return this.Id }
+func (this *testTrain) SetId(id string)          { this.Id = id }
+func (this *testTrain) Kind() string             { return "Train" }
+func (this *testTrain) GetVersion() int64        { return this.Version }
+func (this *testTrain) SetVersion(version int64) { this.Version = version }
+
+// Resources registered in every test state.
+var testResources = map[string]Record{
+	"authors": (*testAuthor)(nil),
+	"depots":  (*testDepot)(nil),
+	"engines": (*testEngine)(nil),
+	"members": (*testMember)(nil),
+	"notes":   (*testNote)(nil),
+	"posts":   (*testPost)(nil),
+	"signals": (*testSignal)(nil),
+	"tickets": (*testTicket)(nil),
+	"trains":  (*testTrain)(nil),
+	"users":   (*testUser)(nil),
+	"wagons":  (*testWagon)(nil),
+}
+
+/********************************** Harness **********************************/
+
+// Returns the stores that the suite runs against, by name: a MemoryStore and
+// an SQLStore over a new in-memory SQLite database.
+func testStores(t *testing.T) map[string]Store {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to ":memory:" opens its own database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"sql":    NewSQLStore(db, SQLite),
+	}
+}
+
+// Runs the function once per store, in a subtest, with a new state that has
+// the test resources registered and their schema synced. The config's store is
+// replaced.
+func forEachStore(t *testing.T, config Config, fn func(*testing.T, State, *http.Request)) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			config.Store = store
+			state := Setup(config)
+			for name, record := range testResources {
+				state.Resources()[name] = record
+			}
+
+			req := testRequest("GET", "/")
+			if err := state.SyncSchema(req); err != nil {
+				t.Fatal(err)
+			}
+			fn(t, state, req)
+		})
+	}
+}
+
+// Makes a request for calls that need one.
+func testRequest(method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+// Fails the test if the error doesn't have the expected status code. A zero
+// code expects no error.
+func expectCode(t *testing.T, err error, code int) {
+	t.Helper()
+	if code == 0 && err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if code != 0 && ErrorCode(err) != code {
+		t.Fatalf("expected a %d error, got %v", code, err)
+	}
+}
+
+// Saves the records, failing the test on errors.
+func mustSave(t *testing.T, state State, req *http.Request, records ...Record) {
+	t.Helper()
+	for _, record := range records {
+		if err := state.Save(req, record); err != nil {
+			t.Fatalf("failed to save %#v: %v", record, err)
+		}
+	}
+}
+
+/*********************************** Tests ***********************************/
+
+func TestCrud(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// A new record gets an id.
+		engine := &testEngine{Name: "Zugelgeheiner", Cars: 3}
+		mustSave(t, state, req, engine)
+		if engine.Id == "" {
+			t.Fatal("expected a generated id")
+		}
+
+		// It reads back the same.
+		read := &testEngine{Id: engine.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if *read != *engine {
+			t.Fatalf("expected %#v, got %#v", engine, read)
+		}
+
+		// Updates replace it.
+		engine.Cars = 5
+		mustSave(t, state, req, engine)
+		read = &testEngine{Id: engine.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Cars != 5 {
+			t.Fatalf("expected the update to be saved, got %#v", read)
+		}
+
+		// Deleted records are gone.
+		expectCode(t, state.Delete(req, &testEngine{Id: engine.Id}), 0)
+		expectCode(t, state.Read(req, &testEngine{Id: engine.Id}), 404)
+		expectCode(t, state.Delete(req, &testEngine{Id: engine.Id}), 404)
+	})
+}
+
+func TestCrudErrors(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		forbidden := testRequest("GET", "/")
+		forbidden.Header.Set("Forbid", "true")
+
+		tests := []struct {
+			name string
+			err  error
+			code int
+		}{
+			{"invalid save", state.Save(req, &testEngine{}), 422},
+			{"forbidden save", state.Save(forbidden, &testEngine{Name: "one"}), 403},
+			{"forbidden read", state.Read(forbidden, &testEngine{Id: "one"}), 403},
+			{"forbidden delete", state.Delete(forbidden, &testEngine{Id: "one"}), 403},
+			{"missing read", state.Read(req, &testEngine{Id: "missing"}), 404},
+		}
+		for _, test := range tests {
+			if ErrorCode(test.err) != test.code {
+				t.Errorf("%s: expected a %d error, got %v", test.name, test.code, test.err)
+			}
+		}
+	})
+}
+
+func TestValidationErrors(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		mustSave(t, state, req, &testEngine{Id: "one", Name: "one"})
+
+		// Invalid records fail with their field messages and aren't written.
+		for name, err := range map[string]error{
+			"save":  state.Save(req, &testEngine{Id: "one"}),
+			"patch": state.Patch(req, &testEngine{Id: "one"}, []string{"Name"}),
+		} {
+			verr, ok := err.(ValidationError)
+			if !ok || verr["Name"] != "required" {
+				t.Errorf("%s: expected a message for the name, got %v", name, err)
+			}
+		}
+		read := &testEngine{Id: "one"}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Name != "one" {
+			t.Fatalf("expected the stored record to be kept, got %#v", read)
+		}
+	})
+}
+
+func TestFind(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		for i := 1; i <= 5; i++ {
+			mustSave(t, state, req, &testEngine{Name: "engine " + strconv.Itoa(i), Cars: i})
+		}
+
+		tests := []struct {
+			name  string
+			query Query
+			cars  []int
+		}{
+			{"all", Query{Orders: []string{"Cars"}}, []int{1, 2, 3, 4, 5}},
+			{"filter", Query{Orders: []string{"Cars"}}.Filter("Cars", OpGte, 4), []int{4, 5}},
+			{"descending", Query{Orders: []string{"-Cars"}, Limit: 2}, []int{5, 4}},
+			{"offset", Query{Orders: []string{"Cars"}, Offset: 3}, []int{4, 5}},
+			{"in", Query{Orders: []string{"Cars"}}.Filter("Cars", OpIn, []int{1, 3}), []int{1, 3}},
+		}
+		for _, test := range tests {
+			engines := []*testEngine{}
+			if _, err := state.Find(req, &engines, test.query); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if cars := engineCars(engines); !equalInts(cars, test.cars) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.cars, cars)
+			}
+		}
+
+		// Unknown fields are rejected.
+		engines := []*testEngine{}
+		_, err := state.Find(req, &engines, Query{}.Filter("Wheels", OpEq, 1))
+		expectCode(t, err, 400)
+	})
+}
+
+func TestCursorPaging(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		for i := 0; i < 7; i++ {
+			mustSave(t, state, req, &testEngine{Name: "engine", Cars: i})
+		}
+
+		// Page through the records, 3 at a time.
+		sizes := []int{}
+		seen := map[string]bool{}
+		query := Query{Orders: []string{"Cars"}, Limit: 3}
+		for {
+			engines := []*testEngine{}
+			cursor, err := state.Find(req, &engines, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(engines))
+			for _, engine := range engines {
+				if seen[engine.Id] {
+					t.Fatalf("record %s was returned twice", engine.Id)
+				}
+				seen[engine.Id] = true
+			}
+			if cursor == "" {
+				break
+			}
+			query.Cursor = cursor
+		}
+
+		if !equalInts(sizes, []int{3, 3, 1}) || len(seen) != 7 {
+			t.Fatalf("expected pages of 3, 3 and 1, got %v", sizes)
+		}
+
+		// Cursors must be ones returned by Find.
+		engines := []*testEngine{}
+		_, err := state.Find(req, &engines, Query{Limit: 3, Cursor: "not a cursor"})
+		expectCode(t, err, 400)
+	})
+}
+
+func TestMultiErrorIndexes(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// The invalid record fails, the others are saved.
+		engines := []*testEngine{{Name: "one"}, {}, {Name: "three"}}
+		err := state.SaveMulti(req, engines)
+		multiErr, ok := err.(MultiError)
+		if !ok || len(multiErr) != 3 {
+			t.Fatalf("expected a MultiError with 3 entries, got %v", err)
+		}
+		if multiErr[0] != nil || ErrorCode(multiErr[1]) != 422 || multiErr[2] != nil {
+			t.Fatalf("expected only the second record to fail, got %v", multiErr)
+		}
+		if engines[0].Id == "" || engines[2].Id == "" {
+			t.Fatal("expected the valid records to be saved")
+		}
+
+		// The missing record fails, the others are read.
+		reads := []*testEngine{{Id: engines[0].Id}, {Id: "missing"}, {Id: engines[2].Id}}
+		err = state.ReadMulti(req, reads)
+		multiErr, _ = err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || ErrorCode(multiErr[1]) != 404 || multiErr[2] != nil {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+		if reads[0].Name != "one" || reads[2].Name != "three" {
+			t.Fatalf("expected the found records to be read, got %#v and %#v", reads[0], reads[2])
+		}
+
+		// The same for deletes.
+		err = state.DeleteMulti(req, reads)
+		multiErr, _ = err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || ErrorCode(multiErr[1]) != 404 || multiErr[2] != nil {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testEngine{Id: engines[0].Id}), 404)
+	})
+}
+
+func TestTransactions(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// A committed transaction keeps its writes.
+		committed := &testEngine{Name: "committed"}
+		err := state.RunInTransaction(req, func(tx State) error {
+			return tx.Save(req, committed)
+		})
+		expectCode(t, err, 0)
+		expectCode(t, state.Read(req, &testEngine{Id: committed.Id}), 0)
+
+		// An error rolls the writes back and is returned as-is.
+		failure := errors.New("failure")
+		rolledBack := &testEngine{Name: "rolled back"}
+		err = state.RunInTransaction(req, func(tx State) error {
+			if err := tx.Save(req, rolledBack); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("expected the function's error, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testEngine{Id: rolledBack.Id}), 404)
+
+		// So does a panic, which continues.
+		panicked := &testEngine{Name: "panicked"}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected the panic to continue")
+				}
+			}()
+			state.RunInTransaction(req, func(tx State) error {
+				tx.Save(req, panicked)
+				panic("failure")
+			})
+		}()
+		expectCode(t, state.Read(req, &testEngine{Id: panicked.Id}), 404)
+
+		// A nested transaction joins the outer one.
+		inner := &testEngine{Name: "inner"}
+		err = state.RunInTransaction(req, func(tx State) error {
+			tx.RunInTransaction(req, func(tx State) error {
+				return tx.Save(req, inner)
+			})
+			return failure
+		})
+		if err != failure {
+			t.Fatalf("expected the function's error, got %v", err)
+		}
+		expectCode(t, state.Read(req, &testEngine{Id: inner.Id}), 404)
+	})
+}
+
+func TestStaleVersion(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		train := &testTrain{Name: "Orient"}
+		mustSave(t, state, req, train)
+		if train.Version != 1 {
+			t.Fatalf("expected version 1, got %d", train.Version)
+		}
+
+		// A copy with an old version fails and keeps its version.
+		stale := &testTrain{Id: train.Id, Name: "stale"}
+		err := state.Save(req, stale)
+		expectCode(t, err, 409)
+		if !errors.Is(err, errVersion) {
+			t.Fatalf("expected a version conflict, got %v", err)
+		}
+		if herr, _ := err.(*utils.HTTPError); herr == nil || herr.Details["version"] != int64(1) {
+			t.Fatalf("expected the stored version in the details, got %#v", err)
+		}
+		if stale.Version != 0 {
+			t.Fatalf("expected the failed record to keep its version, got %d", stale.Version)
+		}
+
+		// The current version succeeds and is incremented.
+		train.Name = "Express"
+		mustSave(t, state, req, train)
+		read := &testTrain{Id: train.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Version != 2 || read.Name != "Express" {
+			t.Fatalf("expected version 2 of the update, got %#v", read)
+		}
+	})
+}
+
+/********************************* Utilities *********************************/
+
+// Returns the car counts of the engines, in order.
+func engineCars(engines []*testEngine) []int {
+	cars := []int{}
+	for _, engine := range engines {
+		cars = append(cars, engine.Cars)
+	}
+	return cars
+}
+
+// Returns true if the slices hold the same numbers in the same order.
+func equalInts(one, other []int) bool {
+	if len(one) != len(other) {
+		return false
+	}
+	for i := range one {
+		if one[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package dsadapter
+
+// Automatic creation and update times.
+
+import (
+	// Standard
+	"time"
+)
+
+/******************************** Timestamps *********************************/
+
+// Timestamped is an optional interface for records that track when they were
+// created and last updated. Save, SaveMulti, Patch and PatchJson set the
+// timestamps right before writing the record: the update time to the current
+// time, and the creation time to that of the stored record, or to the current
+// time for new records. Embed Timestamps to implement it.
+type Timestamped interface {
+	// Returns own creation and update times. Zero means not set yet.
+	GetTimestamps() (time.Time, time.Time)
+
+	// Side effect: must set own creation and update times to the given ones.
+	SetTimestamps(time.Time, time.Time)
+}
+
+/**
+ * Timestamps implements Timestamped. Embed it in a record type:
+ *
+ *   type Engine struct {
+ *     dsadapter.Timestamps
+ *     Id   string
+ *     Name string
+ *   }
+ *
+ * CreatedAt is set on the first save and kept afterwards, even if the record
+ * being saved doesn't carry it, like the body of a PUT. UpdatedAt is set on
+ * every save.
+ */
+type Timestamps struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Returns CreatedAt and UpdatedAt.
+func (this *Timestamps) GetTimestamps() (time.Time, time.Time) {
+	return this.CreatedAt, this.UpdatedAt
+}
+
+// Sets CreatedAt and UpdatedAt.
+func (this *Timestamps) SetTimestamps(created, updated time.Time) {
+	this.CreatedAt = created
+	this.UpdatedAt = updated
+}
+
+/********************************* Utilities *********************************/
+
+// Sets the timestamps of a Timestamped record: the update time to the given
+// time, and the creation time to that of the stored copy, if it's not nil and
+// has one, or else to the given time if the record doesn't have one either.
+func touch(record, stored Record, at time.Time) {
+	timestamped, ok := record.(Timestamped)
+	if !ok {
+		return
+	}
+
+	created, _ := timestamped.GetTimestamps()
+	if stored != nil {
+		if storedCreated, _ := stored.(Timestamped).GetTimestamps(); !storedCreated.IsZero() {
+			created = storedCreated
+		}
+	}
+	if created.IsZero() {
+		created = at
+	}
+	timestamped.SetTimestamps(created, at)
+}
+
+// Returns the current time for timestamps and deletion marks. Stores keep
+// times with different precision, so it's rounded to microseconds.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
@@ -0,0 +1,78 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A Timestamped, SoftDeletable and Versioned record.
+type testNote struct {
+	TestRecord
+	Timestamps
+	SoftDelete
+	Id      string
+	Text    string
+	Version int64
+}
+
+func (this *testNote) GetId() string            { return this.Id }
+func (this *testNote) SetId(id string)          { this.Id = id }
+func (this *testNote) Kind() string             { return "Note" }
+func (this *testNote) GetVersion() int64        { return this.Version }
+func (this *testNote) SetVersion(version int64) { this.Version = version }
+
+func TestTimestamps(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		// New records get both times.
+		note := &testNote{Text: "one"}
+		mustSave(t, state, req, note)
+		created := note.CreatedAt
+		if created.IsZero() || !note.UpdatedAt.Equal(created) {
+			t.Fatalf("expected equal creation and update times, got %#v", note.Timestamps)
+		}
+
+		// Updates keep the creation time.
+		time.Sleep(time.Millisecond)
+		note.Text = "two"
+		mustSave(t, state, req, note)
+		if !note.CreatedAt.Equal(created) || !note.UpdatedAt.After(created) {
+			t.Fatalf("expected a later update time only, got %#v", note.Timestamps)
+		}
+
+		// So do updates that don't carry it.
+		replaced := &testNote{Id: note.Id, Text: "three", Version: note.Version}
+		mustSave(t, state, req, replaced)
+		patched := &testNote{Id: note.Id}
+		expectCode(t, state.PatchJson(req, patched, []byte(`{"Text":"four"}`)), 0)
+		multi := []*testNote{{Id: note.Id, Text: "five", Version: patched.Version}}
+		expectCode(t, state.SaveMulti(req, multi), 0)
+
+		read := &testNote{Id: note.Id}
+		expectCode(t, state.Read(req, read), 0)
+		for _, record := range []*testNote{replaced, patched, multi[0], read} {
+			if !record.CreatedAt.Equal(created) {
+				t.Fatalf("expected the creation time %v, got %v", created, record.CreatedAt)
+			}
+		}
+	})
+}
+
+func TestHandlerTimestamps(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		note := &testNote{Text: "one"}
+		mustSave(t, state, req, note)
+
+		// A PUT without CreatedAt keeps the stored one.
+		rw := testServe(state.Handler("/api"), "PUT", "/api/notes/"+note.Id, `{"Text":"two","Version":1}`)
+		if rw.Code != 200 {
+			t.Fatalf("expected 200, got %d: %s", rw.Code, rw.Body)
+		}
+		read := &testNote{Id: note.Id}
+		expectCode(t, state.Read(req, read), 0)
+		if read.Text != "two" || !read.CreatedAt.Equal(note.CreatedAt) {
+			t.Fatalf("expected the creation time %v, got %v", note.CreatedAt, read.CreatedAt)
+		}
+	})
+}
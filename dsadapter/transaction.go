@@ -0,0 +1,190 @@
+package dsadapter
+
+// Transactions across several records.
+
+import (
+	// Standard
+	"errors"
+	"net/http"
+)
+
+/******************************** Transactions *******************************/
+
+/**
+ * Runs the function in a store transaction. The function gets a State whose
+ * record and collection operations (Read, Save, Delete, Patch, Find and the
+ * rest) run in the transaction. Use only that state inside the function.
+ *
+ *   err := dsa.RunInTransaction(req, func(tx dsa.State) error {
+ *     if err := tx.Read(req, item); err != nil {
+ *       return err
+ *     }
+ *     item.Stock--
+ *     if err := tx.Save(req, item); err != nil {
+ *       return err
+ *     }
+ *     return tx.Save(req, order)
+ *   })
+ *
+ * If the function returns nil, the transaction is committed, and the change
+ * events of its writes are published; see `events.go`. If it returns an error,
+ * the transaction is rolled back and the error is returned. If it panics, the
+ * transaction is rolled back and the panic continues.
+ *
+ * If the transaction fails because of concurrent changes, the function is run
+ * again, up to Config.TransactionAttempts times in total, so it must be safe to
+ * run more than once. When all attempts fail, returns ErrTransactionConflict
+ * (409).
+ *
+ * Calling RunInTransaction on the state passed to the function runs the inner
+ * function in the same transaction. Returns a 500 error if the store doesn't
+ * implement TransactionStore.
+ *
+ * The Datastore lets a transaction touch at most 25 entity groups. Every
+ * record is its own group, and so is every entity the state writes along with
+ * it, like the claims of unique indexes. Batch operations outside of
+ * RunInTransaction split themselves into transactions within that limit, so
+ * they're atomic only chunk by chunk. Inside it, everything runs in one
+ * transaction, so keep the batches small.
+ */
+func (this *stateInstance) RunInTransaction(req *http.Request, fn func(State) error) error {
+	// Join the outer transaction.
+	if this.inTransaction {
+		return fn(this)
+	}
+
+	store, ok := this.Store().(TransactionStore)
+	if !ok {
+		return errNoTx
+	}
+
+	var err error
+	for attempt := 0; attempt < this.transactionAttempts(); attempt++ {
+		// A panic in the function is turned into an error so the store rolls the
+		// transaction back, then raised again below.
+		var panicValue interface{}
+		panicked := false
+
+		// Change events wait for the commit. A retry starts over.
+		var pending []ChangeEvent
+
+		err = store.RunInTransaction(req, func(txStore Store) (err error) {
+			pending = nil
+			defer func() {
+				if value := recover(); value != nil {
+					panicValue, panicked = value, true
+					err = errPanic
+				}
+			}()
+
+			// Copy the state, swapping the store for the transaction's.
+			tx := *this
+			tx.config.Store = txStore
+			tx.inTransaction = true
+			tx.pending = &pending
+			return fn(&tx)
+		})
+
+		if panicked {
+			panic(panicValue)
+		}
+
+		// Publish the events of a committed transaction.
+		if err == nil && len(pending) > 0 {
+			this.config.Publisher.Publish(req, this, pending)
+		}
+
+		// Retry only on conflicts.
+		if !errors.Is(err, ErrTransactionConflict) {
+			return err
+		}
+		this.log(req, "-- transaction conflict, attempt", attempt+1, "of", this.transactionAttempts())
+	}
+
+	return err
+}
+
+/********************************* Utilities *********************************/
+
+// Returns the number of times to try a transaction.
+func (this *stateInstance) transactionAttempts() int {
+	if this.config.TransactionAttempts > 0 {
+		return this.config.TransactionAttempts
+	}
+	return 3
+}
+
+// Runs the function in a transaction if the store supports them, passing the
+// transaction's state. If the store doesn't, or this state is already in a
+// transaction, passes this state instead.
+func (this *stateInstance) atomically(req *http.Request, fn func(*stateInstance) error) error {
+	if _, ok := this.Store().(TransactionStore); !ok || this.inTransaction {
+		return fn(this)
+	}
+	return this.RunInTransaction(req, func(tx State) error {
+		return fn(tx.(*stateInstance))
+	})
+}
+
+// Most entity groups that one transaction may touch, see RunInTransaction.
+const maxTxGroups = 25
+
+// Returns the most entity groups that a transaction writing the record may
+// touch: the record itself, and for each unique index that the state claims,
+// the claim, the record holding it and the claim of the old value, see
+// `index.go`, plus its audit entry and its staged change event, if any.
+func (this *stateInstance) writeGroups(record Record) int {
+	groups := 1
+	if !this.enforcesUnique() {
+		groups += 3 * len(uniqueIndexes(record))
+	}
+	if this.audits() {
+		groups++
+	}
+	if this.stages() {
+		groups++
+	}
+	return groups
+}
+
+// Calls the function with the bounds of consecutive chunks of the records,
+// each small enough to write in one transaction, see writeGroups. Calls it
+// once with all the records if the store doesn't support transactions or this
+// state is already in one. Stops at the first error.
+func (this *stateInstance) inChunks(records []Record, fn func(start, end int) error) error {
+	if _, ok := this.Store().(TransactionStore); !ok || this.inTransaction || len(records) == 0 {
+		return fn(0, len(records))
+	}
+
+	for start := 0; start < len(records); {
+		// Take records until the next one would go over the limit. A chunk has
+		// at least one record.
+		end, groups := start, 0
+		for end < len(records) {
+			next := this.writeGroups(records[end])
+			if end > start && groups+next > maxTxGroups {
+				break
+			}
+			groups += next
+			end++
+		}
+
+		if err := fn(start, end); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// Returns the indexes of the set that fall within the bounds, shifted to start
+// at 0.
+func indexesIn(indexes map[int]bool, start, end int) map[int]bool {
+	result := map[int]bool{}
+	for i := range indexes {
+		if indexes[i] && i >= start && i < end {
+			result[i-start] = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package dsadapter
+
+import (
+	// Standard
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Unique by email, and by nick within an org.
+type testUser struct {
+	TestRecord
+	Id    string
+	Email string
+	Org   string
+	Nick  string
+}
+
+func (this *testUser) GetId() string   { return this.Id }
+func (this *testUser) SetId(id string) { this.Id = id }
+func (this *testUser) Kind() string    { return "User" }
+func (this *testUser) Indexes() []Index {
+	return []Index{UniqueIndex("Email"), UniqueIndex("Org", "Nick"), {Fields: []string{"Org"}}}
+}
+
+func TestUnique(t *testing.T) {
+	stores := testStores(t)
+	stores["plain"] = testPlainStore{NewMemoryStore()}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			state := Setup(Config{Store: store})
+			state.Resources()["users"] = (*testUser)(nil)
+			req := testRequest("GET", "/")
+			expectCode(t, state.SyncSchema(req), 0)
+			expectCode(t, state.SyncSchema(req), 0)
+
+			ann := &testUser{Email: "ann@example.com", Org: "rail", Nick: "ann"}
+			mustSave(t, state, req, ann)
+
+			// Taken values fail, alone or together.
+			tests := []struct {
+				name string
+				user *testUser
+				code int
+			}{
+				{"taken email", &testUser{Email: "ann@example.com", Org: "rail", Nick: "bob"}, 409},
+				{"taken nick", &testUser{Email: "bob@example.com", Org: "rail", Nick: "ann"}, 409},
+				{"nick in another org", &testUser{Email: "bob@example.com", Org: "road", Nick: "ann"}, 200},
+				{"resave", ann, 200},
+			}
+			for _, test := range tests {
+				err := state.Save(req, test.user)
+				if ErrorCode(err) != test.code || (test.code == 409 && !errors.Is(err, ErrDuplicate)) {
+					t.Errorf("%s: expected %d, got %v", test.name, test.code, err)
+				}
+			}
+
+			// Changing a value frees the old one.
+			ann.Email = "anna@example.com"
+			mustSave(t, state, req, ann)
+			carl := &testUser{Email: "ann@example.com", Org: "sea", Nick: "carl"}
+			mustSave(t, state, req, carl)
+
+			// Patches are checked too.
+			expectCode(t, state.Patch(req, &testUser{Id: carl.Id, Email: "anna@example.com"}, []string{"Email"}), 409)
+
+			// Deleting frees the values.
+			expectCode(t, state.Delete(req, &testUser{Id: ann.Id}), 0)
+			mustSave(t, state, req, &testUser{Email: "anna@example.com", Org: "sky"})
+
+			// Duplicates within a batch fail alone.
+			batch := []*testUser{{Email: "dan@example.com", Org: "a"}, {Email: "dan@example.com", Org: "b"}, {Email: "eve@example.com", Org: "c"}}
+			err := state.SaveMulti(req, batch)
+			multiErr, _ := err.(MultiError)
+			if multiErr == nil || multiErr[0] != nil || !errors.Is(multiErr[1], ErrDuplicate) || multiErr[2] != nil {
+				t.Fatalf("expected only the second record to fail, got %v", err)
+			}
+			expectCode(t, state.Read(req, &testUser{Id: batch[2].Id}), 0)
+		})
+	}
+}
+
+// Fails transactions that touch more entity groups than the Datastore allows,
+// counting each record read or written as a group of its own.
+type testGroupStore struct {
+	*MemoryStore
+}
+
+func (this testGroupStore) RunInTransaction(req *http.Request, fn func(Store) error) error {
+	return this.MemoryStore.RunInTransaction(req, func(tx Store) error {
+		counter := &testGroupTx{Store: tx, groups: map[string]bool{}}
+		if err := fn(counter); err != nil {
+			return err
+		}
+		if len(counter.groups) > maxTxGroups {
+			return fmt.Errorf("transaction touched %d entity groups", len(counter.groups))
+		}
+		return nil
+	})
+}
+
+// Store of a transaction that counts the records it touches.
+type testGroupTx struct {
+	Store
+	groups map[string]bool
+}
+
+func (this *testGroupTx) touch(record Record) {
+	this.groups[record.Kind()+"/"+record.GetId()] = true
+}
+
+func (this *testGroupTx) Get(req *http.Request, record Record) error {
+	this.touch(record)
+	return this.Store.Get(req, record)
+}
+
+func (this *testGroupTx) Put(req *http.Request, record Record) error {
+	this.touch(record)
+	return this.Store.Put(req, record)
+}
+
+func (this *testGroupTx) Create(req *http.Request, record Record) error {
+	this.touch(record)
+	return this.Store.(CreateStore).Create(req, record)
+}
+
+func (this *testGroupTx) Delete(req *http.Request, record Record) error {
+	this.touch(record)
+	return this.Store.Delete(req, record)
+}
+
+func TestUniqueGroupLimit(t *testing.T) {
+	state := Setup(Config{Store: testGroupStore{NewMemoryStore()}})
+	state.Resources()["users"] = (*testUser)(nil)
+	req := testRequest("GET", "/")
+
+	// Each record with its claims is several groups, so a batch this big needs
+	// several transactions. Duplicates are caught across them.
+	users := []*testUser{}
+	for i := 0; i < 40; i++ {
+		users = append(users, &testUser{Email: fmt.Sprintf("%d@example.com", i), Org: "rail", Nick: fmt.Sprint(i)})
+	}
+	users[39].Email = users[0].Email
+	err := state.SaveMulti(req, users)
+	multiErr, _ := err.(MultiError)
+	if multiErr == nil || multiErr[0] != nil || multiErr[38] != nil || !errors.Is(multiErr[39], ErrDuplicate) {
+		t.Fatalf("expected only the last record to fail, got %v", err)
+	}
+
+	// Updates release the old claims, and deletes all of them.
+	users = users[:39]
+	for _, user := range users {
+		user.Nick += "!"
+	}
+	expectCode(t, state.SaveMulti(req, users), 0)
+	expectCode(t, state.DeleteMulti(req, users), 0)
+	mustSave(t, state, req, &testUser{Email: users[0].Email, Org: "rail", Nick: "0"})
+}
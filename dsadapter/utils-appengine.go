@@ -0,0 +1,26 @@
+//go:build appengine
+// +build appengine
+
+package dsadapter
+
+// Runtime-specific utilities for App Engine.
+
+import (
+	// Standard
+	"net/http"
+
+	// App Engine
+	"appengine"
+)
+
+// Logs to a GAE context with level `info`.
+func Log(req *http.Request, values ...interface{}) {
+	gc := appengine.NewContext(req)
+	gc.Infof(repeat("%v", len(values)), values...)
+}
+
+// On App Engine, records are kept in the Datastore unless the config says
+// otherwise.
+func defaultStore() Store {
+	return Datastore{}
+}
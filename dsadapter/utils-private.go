@@ -4,6 +4,7 @@ package dsadapter
 
 import (
 	// Standard
+	"errors"
 	"fmt"
 	"reflect"
 	// Third party
@@ -12,29 +13,67 @@ import (
 
 /********************************* Constants *********************************/
 
-// Error constants.
-const (
-	err403 = utils.Error("403 insufficient permissions")
-	err404 = utils.Error("404 not found")
-	err422 = utils.Error("422 unprocessable entry")
-	err500 = utils.Error("500 internal server error")
+// Error constants. Errors with an http status are *HTTPError values; match them
+// with errors.Is.
+var (
+	err403 = utils.NewHTTPError(403, "forbidden", "insufficient permissions")
+	err404 = utils.NewHTTPError(404, "not_found", "not found")
+	err405 = utils.NewHTTPError(405, "method_not_allowed", "method not allowed")
+	err500 = utils.NewHTTPError(500, "internal_error", "internal server error")
+
+	errJson       = utils.NewHTTPError(400, "malformed_json", "malformed json")
+	errCursor     = utils.NewHTTPError(400, "malformed_cursor", "malformed cursor")
+	errQuery      = utils.NewHTTPError(400, "malformed_query", "malformed query")
+	errOperator   = utils.NewHTTPError(400, "unsupported_operator", "unsupported operator")
+	errIfMatch    = utils.NewHTTPError(400, "malformed_if_match", "malformed If-Match header; expected a version")
+	errVersion    = utils.NewHTTPError(409, "version_conflict", "conflict: the record was changed since it was read")
+	errFields     = utils.NewHTTPError(403, "field_forbidden", "insufficient permissions to write some fields")
+	errNoStore    = utils.NewHTTPError(500, "no_store", "no store configured; pass a Store in the dsadapter config")
+	errNoTx       = utils.NewHTTPError(500, "no_transactions", "the store doesn't support transactions")
+	errNoHistory  = utils.NewHTTPError(500, "no_history", "the audit sink can't read entries back")
+	errCollection = utils.Error("a collection must be a slice of a struct pointer type that implements Record")
+	errPanic      = utils.Error("transaction function panicked")
+	errNotSoft    = utils.Error("the record doesn't implement SoftDeletable")
+	errClaim      = utils.Error("unique claims are managed by the state")
+	errMigration  = utils.Error("migration records are managed by the state")
+	errSeed       = utils.Error("seed records are managed by the state")
+	errAudit      = utils.Error("audit records are managed by the state")
+	errOutbox     = utils.Error("outbox records are managed by the state")
 )
 
-/********************************* Utilities *********************************/
+// Makes an error for a query field that doesn't match any property.
+func errUnknownField(name string) error {
+	return utils.NewHTTPError(400, "unknown_field", "unknown field: "+name).
+		WithDetails(map[string]interface{}{"field": name})
+}
 
-// Converts an http.Request.URL.Query to a map of params fit for a datastore
-// query.
-func toParams(query map[string][]string) map[string]string {
-	params := map[string]string{}
+// Makes an error for a query value that doesn't fit the property type.
+func errMalformedValue(name, value string) error {
+	return utils.NewHTTPError(400, "malformed_value", "malformed value for "+name+": "+value).
+		WithDetails(map[string]interface{}{"field": name, "value": value})
+}
 
-	for key, param := range query {
-		if len(param) == 0 {
-			continue
-		}
-		params[key] = param[0]
+// Makes an error for a versioned record that is older than the stored one.
+func errStale(version int64) error {
+	return errVersion.WithDetails(map[string]interface{}{"version": version})
+}
+
+/********************************* Utilities *********************************/
+
+// Converts a store error to err404, keeping the store error as the cause. Nil
+// and errors that already match err404 are returned as-is.
+func notFound(err error) error {
+	if err == nil || errors.Is(err, err404) {
+		return err
 	}
+	return err404.Wrap(err)
+}
 
-	return params
+// Allocates a zero record of the same type as the given one, with the same id.
+func newRecordLike(record Record) Record {
+	result := reflect.New(reflect.TypeOf(record).Elem()).Interface().(Record)
+	result.SetId(record.GetId())
+	return result
 }
 
 // Repeats the given string N times, joined with spaces.
@@ -0,0 +1,25 @@
+//go:build !appengine
+// +build !appengine
+
+package dsadapter
+
+// Runtime-specific utilities for runtimes other than App Engine.
+
+import (
+	// Standard
+	"net/http"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+// Logs to standard output. The request is ignored.
+func Log(req *http.Request, values ...interface{}) {
+	utils.Log(values...)
+}
+
+// Outside App Engine there's no implicit database, so a Store must be passed
+// in the config.
+func defaultStore() Store {
+	return noStore{}
+}
@@ -4,24 +4,12 @@ package dsadapter
 
 import (
 	// Standard
-	"math/rand"
-	"net/http"
 	"reflect"
-	"strconv"
-	"time"
-
-	// App Engine
-	"appengine"
 
 	// Third party
 	"github.com/Mitranim/gotools/utils"
 )
 
-// Weak-entropy seed.
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 /********************************* Constants *********************************/
 
 // CRUD operation codes.
@@ -64,17 +52,21 @@ func ToRecords(value interface{}) []Record {
 	return records
 }
 
-// Default id function. Makes a random unique id.
+// Default id function. Makes a random URL-safe id with ShortId. See `ids.go`
+// for other generators.
 func RndId() string {
-	i := rand.Int()
-	return strconv.Itoa(i)
+	return ShortId()
 }
 
 // Republish the error-to-code converter.
 var ErrorCode = utils.ErrorCode
 
-// Logs to a GAE context with level `info`.
-func Log(req *http.Request, values ...interface{}) {
-	gc := appengine.NewContext(req)
-	gc.Infof(repeat("%v", len(values)), values...)
-}
+// Error with an http status, a machine-readable code and optional details and
+// cause. Errors with a status returned by this package are *HTTPError values,
+// and match with errors.Is even when wrapped.
+type HTTPError = utils.HTTPError
+
+// Maps invalid fields to error messages. Returned by Save when validation
+// fails. Converts to 422 with ErrorCode and encodes as json like
+// {"errors": {"Email": "required"}}.
+type ValidationError = utils.ValidationError
@@ -0,0 +1,171 @@
+package dsadapter
+
+// Optimistic concurrency control for Versioned records.
+
+import (
+	// Standard
+	"net/http"
+	"strconv"
+	"strings"
+
+	// Third party
+	"github.com/Mitranim/gotools/utils"
+)
+
+/********************************* Versions **********************************/
+
+/**
+ * Writes the records that don't have an error in errs yet to the store, like
+ * multi with Store.Put, writing the failures into errs. Claims the values of
+ * unique indexes, see `index.go`.
+ *
+ * Versioned records are checked against their stored copies first. A record
+ * whose version differs from the stored one gets a 409 error with the stored
+ * version in the details, and the others have their versions incremented
+ * before the write. A record that doesn't exist in the store has version 0.
+ *
+ * Records whose indexes are in fresh are new, with generated or imported ids.
+ * They're created with the store's Create if it has one, so a taken id fails
+ * with ErrExists instead of overwriting another record. See `ids.go`.
+ *
+ * If the store supports transactions, the checks and the write run in one, so
+ * concurrent writes are caught as well. Batches too big for one transaction
+ * are split into several, see `transaction.go`. Without transactions, a write
+ * may still slip in between the check and the write. Records that fail keep
+ * their old versions. Returns an error only if the whole batch failed.
+ */
+func (this *stateInstance) putMulti(req *http.Request, records []Record, errs MultiError, fresh map[int]bool) error {
+	// Without versioned records or unique claims, just write.
+	if !hasVersioned(records) && (this.enforcesUnique() || !hasUnique(records)) {
+		return this.writeMulti(req, records, errs, fresh)
+	}
+
+	// Check and write the records in chunks that fit in a transaction each.
+	return this.inChunks(records, func(start, end int) error {
+		return this.putChecked(req, records[start:end], errs[start:end], indexesIn(fresh, start, end))
+	})
+}
+
+// Checks and writes the records for putMulti, in one transaction if possible.
+func (this *stateInstance) putChecked(req *http.Request, records []Record, errs MultiError, fresh map[int]bool) error {
+	// Remember the versions to restore them on failure.
+	versions := map[int]int64{}
+	for i, record := range records {
+		if versioned, ok := record.(Versioned); ok && errs[i] == nil {
+			versions[i] = versioned.GetVersion()
+		}
+	}
+
+	// A transaction may run more than once, so each attempt starts over from
+	// the original errors and versions.
+	initial := append(MultiError{}, errs...)
+	restore := func(all bool) {
+		for i, version := range versions {
+			if all || errs[i] != nil {
+				records[i].(Versioned).SetVersion(version)
+			}
+		}
+	}
+
+	err := this.atomically(req, func(state *stateInstance) error {
+		copy(errs, initial)
+		restore(true)
+		if err := state.checkFresh(req, records, errs, fresh); err != nil {
+			return err
+		}
+		if err := state.checkVersions(req, records, errs); err != nil {
+			return err
+		}
+		if err := state.claimUnique(req, records, errs); err != nil {
+			return err
+		}
+		return state.writeMulti(req, records, errs, fresh)
+	})
+
+	restore(err != nil)
+	return err
+}
+
+// Reads the stored copies of the versioned records that don't have an error in
+// errs yet and compares their versions. Writes a 409 error into errs for stale
+// records and increments the versions of the others.
+func (this *stateInstance) checkVersions(req *http.Request, records []Record, errs MultiError) error {
+	// Skip unversioned records and records that already failed.
+	skip := utils.Error("skip")
+	stored := make([]Record, len(records))
+	results := make(MultiError, len(records))
+	for i, record := range records {
+		if _, ok := record.(Versioned); !ok || errs[i] != nil {
+			results[i] = skip
+			continue
+		}
+		stored[i] = newRecordLike(record)
+	}
+
+	// Read the stored copies.
+	if err := this.multi(req, stored, results, BatchStore.GetMulti, Store.Get, nil); err != nil {
+		return err
+	}
+
+	// Compare the versions.
+	for i, record := range records {
+		if results[i] == skip {
+			continue
+		}
+		current, err := storedVersion(stored[i], results[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		versioned := record.(Versioned)
+		if versioned.GetVersion() != current {
+			errs[i] = errStale(current)
+			continue
+		}
+		versioned.SetVersion(current + 1)
+	}
+	return nil
+}
+
+/********************************* Utilities *********************************/
+
+// Returns true if any of the records is Versioned.
+func hasVersioned(records []Record) bool {
+	for _, record := range records {
+		if _, ok := record.(Versioned); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the version of a stored record read with the given error. A record
+// that doesn't exist has version 0.
+func storedVersion(record Record, err error) (int64, error) {
+	if err == nil {
+		return record.(Versioned).GetVersion(), nil
+	}
+	if ErrorCode(err) == 404 {
+		return 0, nil
+	}
+	return 0, err
+}
+
+// Formats a version as a strong ETag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Parses the version from an If-Match header. Returns false if the header is
+// empty or "*", which means any version matches.
+func parseIfMatch(header string) (int64, bool, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil {
+		return 0, false, errIfMatch.WithDetails(map[string]interface{}{"header": header})
+	}
+	return version, true, nil
+}
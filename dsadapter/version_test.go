@@ -0,0 +1,70 @@
+package dsadapter
+
+import (
+	// Standard
+	"net/http"
+	"testing"
+)
+
+func TestVersionMulti(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		trains := []*testTrain{{Name: "one"}, {Name: "two"}}
+		expectCode(t, state.SaveMulti(req, trains), 0)
+
+		// Only the stale record fails, and keeps its version.
+		stale := []*testTrain{{Id: trains[0].Id, Version: 1}, {Id: trains[1].Id}}
+		err := state.SaveMulti(req, stale)
+		multiErr, _ := err.(MultiError)
+		if multiErr == nil || multiErr[0] != nil || ErrorCode(multiErr[1]) != 409 {
+			t.Fatalf("expected only the second record to fail, got %v", err)
+		}
+		if stale[0].Version != 2 || stale[1].Version != 0 {
+			t.Fatalf("expected versions 2 and 0, got %d and %d", stale[0].Version, stale[1].Version)
+		}
+
+		// A new record with a version and an unknown id doesn't exist yet.
+		expectCode(t, state.Save(req, &testTrain{Id: "missing", Version: 3}), 409)
+	})
+}
+
+func TestHandlerETags(t *testing.T) {
+	forEachStore(t, Config{}, func(t *testing.T, state State, req *http.Request) {
+		handler := state.Handler("/api")
+
+		// A version in the body of a POST is ignored.
+		rw := testServe(handler, "POST", "/api/trains", `{"Name":"Orient","Version":5}`)
+		if rw.Code != 201 || rw.Header().Get("ETag") != `"1"` {
+			t.Fatalf(`expected 201 with the ETag "1", got %d with %q: %s`, rw.Code, rw.Header().Get("ETag"), rw.Body)
+		}
+		train := &testTrain{}
+		decodeBody(t, rw, train)
+		path := "/api/trains/" + train.Id
+
+		tests := []struct {
+			method  string
+			body    string
+			ifMatch string
+			code    int
+			etag    string
+		}{
+			{"GET", "", "", 200, `"1"`},
+			{"PUT", `{"Name":"Express"}`, `"2"`, 409, ""},
+			{"PUT", `{"Name":"Express"}`, `"x"`, 400, ""},
+			{"PUT", `{"Name":"Express","Version":1}`, "", 200, `"2"`},
+			{"PUT", `{"Name":"Express","Version":1}`, "", 409, ""},
+			{"PUT", `{"Name":"Express"}`, `"2"`, 200, `"3"`},
+			{"PATCH", `{"Name":"Blue"}`, `"2"`, 409, ""},
+			{"PATCH", `{"Name":"Blue"}`, "", 200, `"4"`},
+			{"PATCH", `{"Name":"Green"}`, `*`, 200, `"5"`},
+			{"DELETE", "", `"4"`, 409, ""},
+			{"DELETE", "", `"5"`, 204, ""},
+		}
+		for _, test := range tests {
+			rw := testServe(handler, test.method, path, test.body, "If-Match", test.ifMatch)
+			if rw.Code != test.code || rw.Header().Get("ETag") != test.etag {
+				t.Errorf("%s %s with If-Match %s: expected %d with the ETag %s, got %d with %s: %s",
+					test.method, test.body, test.ifMatch, test.code, test.etag, rw.Code, rw.Header().Get("ETag"), rw.Body)
+			}
+		}
+	})
+}
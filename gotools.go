@@ -19,10 +19,11 @@ import (
 
 // Functions
 var (
-	ErrorCode = utils.ErrorCode
-	CodePath  = utils.CodePath
-	ErrorPath = utils.ErrorPath
-	Log       = utils.Log
+	ErrorCode    = utils.ErrorCode
+	NewHTTPError = utils.NewHTTPError
+	CodePath     = utils.CodePath
+	ErrorPath    = utils.ErrorPath
+	Log          = utils.Log
 )
 
 /********************************** context **********************************/
@@ -58,9 +59,23 @@ func RenderSetup(config RenderConfig) (RenderState, error) {
 
 // Functions
 var (
-	DsaLog    = dsadapter.Log
-	RndId     = dsadapter.RndId
-	ToRecords = dsadapter.ToRecords
+	DsaLog          = dsadapter.Log
+	RndId           = dsadapter.RndId
+	UUIDv4          = dsadapter.UUIDv4
+	UUIDv7          = dsadapter.UUIDv7
+	ULID            = dsadapter.ULID
+	ShortId         = dsadapter.ShortId
+	ToRecords       = dsadapter.ToRecords
+	NewMemoryStore  = dsadapter.NewMemoryStore
+	NewSQLStore     = dsadapter.NewSQLStore
+	NewQuery        = dsadapter.NewQuery
+	ParseQuery      = dsadapter.ParseQuery
+	UniqueIndex     = dsadapter.UniqueIndex
+	NewAuditKind    = dsadapter.NewAuditKind
+	NewAuditLog     = dsadapter.NewAuditLog
+	NewAuditChannel = dsadapter.NewAuditChannel
+	NewMemoryBus    = dsadapter.NewMemoryBus
+	NewOutbox       = dsadapter.NewOutbox
 )
 
 // Constants
@@ -69,12 +84,39 @@ const (
 	CodeRead   = dsadapter.CodeRead
 	CodeUpdate = dsadapter.CodeUpdate
 	CodeDelete = dsadapter.CodeDelete
+
+	RelBelongsTo = dsadapter.RelBelongsTo
+	RelHasMany   = dsadapter.RelHasMany
+
+	ConflictFail      = dsadapter.ConflictFail
+	ConflictSkip      = dsadapter.ConflictSkip
+	ConflictOverwrite = dsadapter.ConflictOverwrite
 )
 
 // Types
 type Record dsadapter.Record
+type Versioned dsadapter.Versioned
 type DsaConfig dsadapter.Config
 type DsaState dsadapter.State
+type DsaStore dsadapter.Store
+
+// Aliases
+type HTTPError = utils.HTTPError
+type ValidationError = utils.ValidationError
+type DsaQuery = dsadapter.Query
+type DsaMultiError = dsadapter.MultiError
+type DsaTimestamps = dsadapter.Timestamps
+type DsaSoftDelete = dsadapter.SoftDelete
+type DsaIndex = dsadapter.Index
+type DsaRelation = dsadapter.Relation
+type DsaMigration = dsadapter.Migration
+type DsaMigrationStatus = dsadapter.MigrationStatus
+type DsaSeedSet = dsadapter.SeedSet
+type DsaSeedChange = dsadapter.SeedChange
+type DsaImportOptions = dsadapter.ImportOptions
+type DsaImportResult = dsadapter.ImportResult
+type DsaAuditEntry = dsadapter.AuditEntry
+type DsaChangeEvent = dsadapter.ChangeEvent
 
 // Adapters
 func DsaSetup(config DsaConfig) DsaState {
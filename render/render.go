@@ -132,7 +132,7 @@ func (this *stateInstance) RenderError(err error, data map[string]interface{}) (
 		bytes = this.config.UltimateFailure
 		// Otherwise use the default message.
 	} else {
-		bytes = []byte(err500ISE)
+		bytes = []byte(err500ISE.Error())
 	}
 
 	return
@@ -16,12 +16,14 @@ import (
 
 /********************************* Constants *********************************/
 
-// Errors used in this package. Each error starts with an http status code that
-// can be converted to int with ErrorCode(err).
-const (
-	err404    = utils.Error("404 template not found")
-	err500    = utils.Error("500 template rendering error")
-	err500ISE = utils.Error("500 internal server error")
+// Errors used in this package. Each error carries an http status code that can
+// be converted to int with ErrorCode(err).
+var (
+	err404    = utils.NewHTTPError(404, "template_not_found", "template not found")
+	err500    = utils.NewHTTPError(500, "rendering_error", "template rendering error")
+	err500ISE = utils.NewHTTPError(500, "internal_error", "internal server error")
+	errRead   = utils.NewHTTPError(500, "read_error", "couldn't read file")
+	errParse  = utils.NewHTTPError(500, "parse_error", "couldn't parse template")
 )
 
 /********************************** Render ***********************************/
@@ -47,7 +49,7 @@ func renderAt(temp *template.Template, path string, data map[string]interface{})
 	wr := new(utils.WR)
 	err = temp.ExecuteTemplate(wr, path, data)
 	if err != nil {
-		return nil, err
+		return nil, err500.Wrap(err)
 	}
 
 	return []byte(*wr), nil
@@ -81,13 +83,13 @@ func readTemplates(dir string, temp *template.Template) error {
 		// Get file contents
 		bytes, err := ioutil.ReadFile(path)
 		if err != nil {
-			return utils.Error(fmt.Sprintf("couldn't read file at path: %s, error: %#v\n", path, err))
+			return errRead.Wrap(err).WithDetails(map[string]interface{}{"path": path})
 		}
 
 		// Parse template
 		_, err = temp.New(modpath).Parse(string(bytes))
 		if err != nil {
-			return utils.Error(fmt.Sprintf("couldn't parse template at path: %s, error: %#v\n", modpath, err))
+			return errParse.Wrap(err).WithDetails(map[string]interface{}{"path": modpath})
 		}
 
 		return nil
@@ -105,7 +107,7 @@ func readInline(dir string, files map[string][]byte) error {
 		// Read file into memory.
 		bytes, err := ioutil.ReadFile(path)
 		if err != nil {
-			return utils.Error(fmt.Sprintf("couldn't read file at path: %s, error: %#v\n", path, err))
+			return errRead.Wrap(err).WithDetails(map[string]interface{}{"path": path})
 		}
 
 		// Remove directory prefix from path.
@@ -19,12 +19,3 @@ func atoi(str string) (result int) {
 	}
 	return
 }
-
-// Converts a positive integer into a same-looking string.
-func itoa(num int) (result string) {
-	for num > 0 {
-		result = string('0'+num%10) + result
-		num /= 10
-	}
-	return
-}
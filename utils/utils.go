@@ -3,20 +3,37 @@ package utils
 // Utilities shared between gotools packages.
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 )
 
 /********************************* Utilities *********************************/
 
-// Takes an error and tries to get an http status code from it by scanning
-// digits from the beginning. Example: Error("403 unauthorised") -> 403 int. If
-// the error is nil, this returns 200. If the error code can't be found or lies
-// outside the standard http error range (400 <= x <= 599), this returns 500.
+// Takes an error and tries to get an http status code from it. If the error is
+// or wraps an *HTTPError, returns its status; if it's or wraps a
+// ValidationError, returns 422. Otherwise scans digits from the beginning of
+// the message. Example: Error("403 unauthorised") -> 403 int. If the error is
+// nil, this returns 200. If the error code can't be found or lies outside the
+// standard http error range (400 <= x <= 599), this returns 500.
 func ErrorCode(err error) int {
 	if err == nil {
 		return 200
 	}
-	code := atoi(err.Error())
+
+	var code int
+	var herr *HTTPError
+	var verr ValidationError
+	if errors.As(err, &herr) {
+		code = herr.Status
+	} else if errors.As(err, &verr) {
+		code = 422
+	} else {
+		code = atoi(err.Error())
+	}
+
 	if code < 400 || code > 599 {
 		return 500
 	}
@@ -32,7 +49,7 @@ func ErrorPath(err error) string {
 // Converts an http status code into a template path through a straight number-
 // to-string translation.
 func CodePath(code int) string {
-	return itoa(code)
+	return strconv.Itoa(code)
 }
 
 // fmt.Println() alias for runtimes that support logging to stdout.
@@ -68,3 +85,104 @@ type Error string
 func (this Error) Error() string {
 	return string(this)
 }
+
+/********************************* HTTPError *********************************/
+
+// HTTPError is an error with an http status, a machine-readable code, details
+// for the client and an optional underlying cause. It works with errors.Is and
+// errors.As, and ErrorCode returns its status even when it's wrapped.
+type HTTPError struct {
+	// Http status code: 400 <= x <= 599.
+	Status int
+	// Machine-readable code, like "not_found".
+	Code string
+	// Human-readable message, like "not found".
+	Message string
+	// Optional data for the client, like the name of an invalid field.
+	Details map[string]interface{}
+	// Optional underlying error. Not sent to the client.
+	Cause error
+}
+
+// Creates an *HTTPError with the given status, code and message.
+func NewHTTPError(status int, code, message string) *HTTPError {
+	return &HTTPError{Status: status, Code: code, Message: message}
+}
+
+// Error method. Starts with the status, followed by the message and the cause,
+// if any. Example: "404 not found: no such entity".
+func (this *HTTPError) Error() string {
+	msg := strconv.Itoa(this.Status) + " " + this.Message
+	if this.Cause != nil {
+		msg += ": " + this.Cause.Error()
+	}
+	return msg
+}
+
+// Returns the cause for errors.Is and errors.As.
+func (this *HTTPError) Unwrap() error {
+	return this.Cause
+}
+
+// Matches any *HTTPError with the same status and code. This lets copies made
+// with Wrap and WithDetails match the original with errors.Is.
+func (this *HTTPError) Is(target error) bool {
+	other, ok := target.(*HTTPError)
+	return ok && other != nil && this.Status == other.Status && this.Code == other.Code
+}
+
+// Returns a copy of the error with the given cause.
+func (this *HTTPError) Wrap(cause error) *HTTPError {
+	copy := *this
+	copy.Cause = cause
+	return &copy
+}
+
+// Returns a copy of the error with the given details.
+func (this *HTTPError) WithDetails(details map[string]interface{}) *HTTPError {
+	copy := *this
+	copy.Details = details
+	return &copy
+}
+
+// Encodes the error as {"error": <message>, "code": <code>, "details": {...}}.
+// Empty fields are omitted, and the cause is never included.
+func (this *HTTPError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error   string                 `json:"error"`
+		Code    string                 `json:"code,omitempty"`
+		Details map[string]interface{} `json:"details,omitempty"`
+	}{this.Message, this.Code, this.Details})
+}
+
+/****************************** ValidationError ******************************/
+
+// ValidationError maps invalid fields to error messages. Its message starts
+// with 422, so ErrorCode converts it to 422. It's encoded as json like
+// {"errors": {"email": "required"}}.
+type ValidationError map[string]string
+
+// Error method. Lists the fields in alphabetical order.
+func (this ValidationError) Error() string {
+	fields := make([]string, 0, len(this))
+	for field := range this {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msg := "422 unprocessable entry"
+	for i, field := range fields {
+		if i == 0 {
+			msg += ": "
+		} else {
+			msg += "; "
+		}
+		msg += field + ": " + this[field]
+	}
+	return msg
+}
+
+// Encodes the error as {"errors": {<field>: <message>}}.
+func (this ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]map[string]string{"errors": this})
+}
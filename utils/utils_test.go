@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	notFound := NewHTTPError(404, "not_found", "not found")
+
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"nil", nil, 200},
+		{"http error", notFound, 404},
+		{"wrapped http error", fmt.Errorf("reading: %w", notFound.Wrap(errors.New("missing"))), 404},
+		{"validation error", ValidationError{"email": "required"}, 422},
+		{"wrapped validation error", fmt.Errorf("saving: %w", ValidationError{"email": "required"}), 422},
+		{"leading digits", Error("403 unauthorised"), 403},
+		{"digits out of range", Error("123 numbers"), 500},
+		{"no digits", Error("failure"), 500},
+	}
+	for _, test := range tests {
+		if code := ErrorCode(test.err); code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, code)
+		}
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	notFound := NewHTTPError(404, "not_found", "not found")
+	cause := errors.New("no such entity")
+	wrapped := notFound.Wrap(cause).WithDetails(map[string]interface{}{"id": "one"})
+
+	// Copies match the original and unwrap to the cause.
+	if !errors.Is(wrapped, notFound) || !errors.Is(wrapped, cause) {
+		t.Fatalf("expected %v to match the original and the cause", wrapped)
+	}
+	if errors.Is(wrapped, NewHTTPError(404, "other", "not found")) {
+		t.Fatal("expected errors with other codes not to match")
+	}
+	if notFound.Cause != nil || notFound.Details != nil {
+		t.Fatal("expected Wrap and WithDetails to leave the original unchanged")
+	}
+
+	if msg := wrapped.Error(); msg != "404 not found: no such entity" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	// The json leaves out the cause.
+	bytes, err := json.Marshal(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(bytes); body != `{"error":"not found","code":"not_found","details":{"id":"one"}}` {
+		t.Fatalf("unexpected json %s", body)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	verr := ValidationError{"name": "required", "email": "malformed"}
+
+	// Fields are listed in alphabetical order.
+	if msg := verr.Error(); msg != "422 unprocessable entry: email: malformed; name: required" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	bytes, err := json.Marshal(verr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(bytes); body != `{"errors":{"email":"malformed","name":"required"}}` {
+		t.Fatalf("unexpected json %s", body)
+	}
+}